@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// entryInfo describes the current state of a entry for the admin
+// endpoints
+type entryInfo struct {
+	Name       string    `json:"name"`
+	Serial     string    `json:"serial"`
+	Responders []string  `json:"responders"`
+	Status     string    `json:"status"`
+	ThisUpdate time.Time `json:"this-update"`
+	NextUpdate time.Time `json:"next-update"`
+	LastSync   time.Time `json:"last-sync"`
+	ETag       string    `json:"etag,omitempty"`
+	Response   []byte    `json:"response,omitempty"` // only included if requested
+}
+
+// describe returns a description of the entry, the response itself is
+// only included if withResponse is set
+func (e *Entry) describe(withResponse bool) entryInfo {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	info := entryInfo{
+		Name:       e.name,
+		Serial:     fmt.Sprintf("%X", e.serial),
+		Responders: append([]string{}, e.responders...),
+		Status:     "none",
+		ThisUpdate: e.thisUpdate,
+		NextUpdate: e.nextUpdate,
+		LastSync:   e.lastSync,
+		ETag:       e.eTag,
+	}
+	if e.response != nil {
+		info.Status = statusToString[e.status]
+		if withResponse {
+			info.Response = e.response
+		}
+	}
+	return info
+}
+
+// authorizeAdmin checks that a request is allowed to use the admin
+// endpoints. If a admin token is configured requests must present it
+// as a bearer token, otherwise only requests from the loopback
+// interface are allowed. Without a token the admin endpoints are only
+// served on the stats listener, since requests to the responder may
+// come from a reverse proxy on the same host and look like loopback
+func (s *stapled) authorizeAdmin(r *http.Request) (int, bool) {
+	if s.adminToken != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			return http.StatusUnauthorized, false
+		}
+		return 0, true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return http.StatusForbidden, false
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return http.StatusForbidden, false
+	}
+	return 0, true
+}
+
+// serveAdmin handles requests to the admin endpoints
+func (s *stapled) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if code, ok := s.authorizeAdmin(r); !ok {
+		s.log.Warning("[admin] Rejected request for '%s' from %s", r.URL.Path, r.RemoteAddr)
+		w.WriteHeader(code)
+		return
+	}
+	switch r.URL.Path {
+	case "/admin/entries":
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveEntries(w, r)
+	case "/admin/refresh":
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveRefresh(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveEntries writes a JSON description of each of the entries in the
+// cache, the responses themselves are included if the responses query
+// parameter is set to true
+func (s *stapled) serveEntries(w http.ResponseWriter, r *http.Request) {
+	withResponses := r.URL.Query().Get("responses") == "true"
+	entries := s.c.snapshot()
+	sort.Sort(entriesByName(entries))
+	infos := make([]entryInfo, len(entries))
+	for i, e := range entries {
+		infos[i] = e.describe(withResponses)
+	}
+	body, err := json.Marshal(infos)
+	if err != nil {
+		s.log.Err("[admin] Failed to marshal entries: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// refreshResult is the body returned by the refresh endpoint
+type refreshResult struct {
+	Error string     `json:"error,omitempty"`
+	Entry *entryInfo `json:"entry,omitempty"`
+}
+
+// serveRefresh synchronously refreshes the entry named by the name query
+// parameter, bypassing the update window and any backoff. The fetched
+// response is verified as usual before it replaces the current one
+func (s *stapled) serveRefresh(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	e, present := s.c.get(name)
+	if !present {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	code := http.StatusOK
+	result := refreshResult{}
+	err := e.forceRefresh(s.ctx)
+	if err == errRefreshInProgress {
+		code = http.StatusConflict
+		result.Error = err.Error()
+	} else if err != nil {
+		s.log.Err("[admin] Forced refresh of '%s' failed: %s", name, err)
+		code = http.StatusBadGateway
+		result.Error = err.Error()
+	} else {
+		info := e.describe(false)
+		result.Entry = &info
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		s.log.Err("[admin] Failed to marshal refresh result: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
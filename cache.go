@@ -5,11 +5,15 @@ import (
 	"crypto"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
+	"io"
 	"io/ioutil"
+	"log/syslog"
 	"math/big"
 	mrand "math/rand"
 	"net"
@@ -20,25 +24,80 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmhodges/clock"
 	"golang.org/x/crypto/ocsp"
 	"golang.org/x/net/context"
+	"golang.org/x/net/proxy"
 )
 
+// defaultLookupHashes are the hash algorithms lookup keys are computed
+// for if the cache isn't explicitly configured with a set
+var defaultLookupHashes = []crypto.Hash{crypto.SHA1}
+
+var hashNames = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// parseLookupHashes converts a list of hash algorithm names into the
+// crypto.Hash values the cache should compute lookup keys for
+func parseLookupHashes(names []string) ([]crypto.Hash, error) {
+	hashes := []crypto.Hash{}
+	for _, name := range names {
+		h, present := hashNames[strings.ToLower(name)]
+		if !present {
+			return nil, fmt.Errorf("unsupported lookup hash algorithm '%s'", name)
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
 type cache struct {
 	log       *Logger
-	entries   map[string]*Entry   // one-to-one map keyed on name -> entry
-	lookupMap map[[32]byte]*Entry // many-to-one map keyed on sha256 hashed OCSP requests -> entry
+	entries   map[string]*Entry     // one-to-one map keyed on name -> entry
+	lookupMap map[[32]byte]*Entry   // many-to-one map keyed on sha256 hashed OCSP requests -> entry
+	lazyKeys  map[*Entry][][32]byte // keys added to lookupMap by lookupLazily for each entry
+	hashes    []crypto.Hash         // hash algorithms to compute lookup keys for
 	mu        sync.RWMutex
+
+	maxEntries  int   // if non-zero the least recently served entry is evicted when full
+	accessCount int64 // logical clock used to order entries by last use, accessed atomically
+	evictions   int64 // accessed atomically
+
+	// cancelled when the cache is stopped, which stops the monitor
+	// and any refreshes it has started
+	ctx         context.Context
+	cancel      context.CancelFunc
+	monitorDone chan struct{}
+	refreshes   sync.WaitGroup
+
+	refreshSlots    chan struct{} // limits concurrent refreshes if non-nil, protected by mu
+	queuedRefreshes int64         // entries waiting for a refresh slot, accessed atomically
+
+	duplicates duplicatePolicy // protected by mu
 }
 
-func newCache(log *Logger, monitorTick time.Duration) *cache {
+func newCache(log *Logger, monitorTick time.Duration, hashes []crypto.Hash, maxEntries int) *cache {
+	if len(hashes) == 0 {
+		hashes = defaultLookupHashes
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	c := &cache{
-		log:       log,
-		entries:   make(map[string]*Entry),
-		lookupMap: make(map[[32]byte]*Entry),
+		log:         log,
+		entries:     make(map[string]*Entry),
+		lookupMap:   make(map[[32]byte]*Entry),
+		lazyKeys:    make(map[*Entry][][32]byte),
+		hashes:      hashes,
+		maxEntries:  maxEntries,
+		ctx:         ctx,
+		cancel:      cancel,
+		monitorDone: make(chan struct{}),
 	}
 	go c.monitor(monitorTick)
 	return c
@@ -53,11 +112,11 @@ func hashEntry(h hash.Hash, name, pkiBytes []byte, serial *big.Int) ([32]byte, e
 	return sha256.Sum256(append(append(issuerNameHash, issuerKeyHash...), serialHash[:]...)), nil
 }
 
-func allHashes(e *Entry) ([][32]byte, error) {
+// allHashes computes the lookup keys for an entry using each of the
+// hash algorithms the cache is configured with
+func (c *cache) allHashes(e *Entry) ([][32]byte, error) {
 	results := [][32]byte{}
-	// these should be configurable in case people don't care about
-	// supporting all of these hash algs
-	for _, h := range []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+	for _, h := range c.hashes {
 		hashed, err := hashEntry(h.New(), e.issuer.RawSubject, e.issuer.RawSubjectPublicKeyInfo, e.serial)
 		if err != nil {
 			return nil, err
@@ -75,53 +134,293 @@ func hashRequest(request *ocsp.Request) [32]byte {
 func (c *cache) lookup(request *ocsp.Request) (*Entry, bool) {
 	hash := hashRequest(request)
 	c.mu.RLock()
-	defer c.mu.RUnlock()
 	e, present := c.lookupMap[hash]
+	c.mu.RUnlock()
+	if !present && !c.indexed(request.HashAlgorithm) {
+		e, present = c.lookupLazily(request, hash)
+	}
+	if present {
+		c.touch(e)
+	}
 	return e, present
 }
 
+// lookupLazily finds the entry for a request using a hash algorithm
+// lookup keys aren't computed for up front and, if there is one, adds
+// a lookup key for it so that the next request is a normal lookup
+func (c *cache) lookupLazily(request *ocsp.Request, hash [32]byte) (*Entry, bool) {
+	c.mu.RLock()
+	e, present := c.scan(request, hash)
+	c.mu.RUnlock()
+	if !present {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the entry may have been removed while the lock wasn't held
+	if c.entries[e.name] != e {
+		return nil, false
+	}
+	if _, present := c.lookupMap[hash]; !present {
+		c.lookupMap[hash] = e
+		c.lazyKeys[e] = append(c.lazyKeys[e], hash)
+	}
+	return e, true
+}
+
+// indexed returns whether lookup keys are computed using h
+func (c *cache) indexed(h crypto.Hash) bool {
+	for _, indexed := range c.hashes {
+		if h == indexed {
+			return true
+		}
+	}
+	return false
+}
+
+// scan finds the entry for a request which uses a hash algorithm that
+// lookup keys aren't computed for, by computing the key for each entry
+// with the request's serial. Comparing serials is cheap so the cost is
+// dominated by walking the entries. Assumes the caller holds a lock
+func (c *cache) scan(request *ocsp.Request, hash [32]byte) (*Entry, bool) {
+	if !request.HashAlgorithm.Available() || request.SerialNumber == nil {
+		return nil, false
+	}
+	for _, e := range c.entries {
+		if e.issuer == nil || e.serial == nil || e.serial.Cmp(request.SerialNumber) != 0 {
+			continue
+		}
+		hashed, err := hashEntry(request.HashAlgorithm.New(), e.issuer.RawSubject, e.issuer.RawSubjectPublicKeyInfo, e.serial)
+		if err == nil && hashed == hash {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// touch marks an entry as the most recently used
+func (c *cache) touch(e *Entry) {
+	atomic.StoreInt64(&e.lastUsed, atomic.AddInt64(&c.accessCount, 1))
+}
+
+// size returns the number of entries in the cache
+func (c *cache) size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
+
+// evicted returns the number of entries that have been evicted
+// from the cache because it was full
+func (c *cache) evicted() int64 {
+	return atomic.LoadInt64(&c.evictions)
+}
+
+// makeRoom evicts the least recently used entry if adding another
+// entry would take the cache over maxEntries. Assumes the caller holds
+// a write lock
+func (c *cache) makeRoom() {
+	if c.maxEntries <= 0 || len(c.entries) < c.maxEntries {
+		return
+	}
+	var oldest *Entry
+	for _, e := range c.entries {
+		if oldest == nil || atomic.LoadInt64(&e.lastUsed) < atomic.LoadInt64(&oldest.lastUsed) {
+			oldest = e
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	delete(c.entries, oldest.name)
+	c.removeLookupKeys(oldest)
+	evictions := atomic.AddInt64(&c.evictions, 1)
+	c.log.Info("[cache] Evicted least recently used entry '%s' (%d entries, %d evictions)", oldest.name, len(c.entries), evictions)
+}
+
+// removeLookupKeys removes the lookup keys that point at e. Assumes the
+// caller holds a lock
+func (c *cache) removeLookupKeys(e *Entry) {
+	for _, h := range c.lazyKeys[e] {
+		if c.lookupMap[h] == e {
+			delete(c.lookupMap, h)
+		}
+	}
+	delete(c.lazyKeys, e)
+	if e.issuer != nil && e.serial != nil {
+		hashes, err := c.allHashes(e)
+		if err == nil {
+			for _, h := range hashes {
+				// another entry for the same certificate may have
+				// taken over the key
+				if c.lookupMap[h] == e {
+					delete(c.lookupMap, h)
+				}
+			}
+			return
+		}
+	}
+	// entries added with addSingle don't have an issuer so we can't
+	// use allHashes to find their keys
+	for k, other := range c.lookupMap {
+		if other == e {
+			delete(c.lookupMap, k)
+		}
+	}
+}
+
 func (c *cache) lookupResponse(request *ocsp.Request) ([]byte, bool) {
+	e, present := c.lookupEntry(request)
+	if !present {
+		return nil, false
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.response, true
+}
+
+// lookupEntry is lookup but records whether the request was answered
+// from the cache
+func (c *cache) lookupEntry(request *ocsp.Request) (*Entry, bool) {
 	e, present := c.lookup(request)
 	if present {
-		e.mu.RLock()
-		defer e.mu.RUnlock()
-		return e.response, present
+		lookupHits.inc()
+		return e, true
+	}
+	lookupMisses.inc()
+	return nil, false
+}
+
+// warnOnFilenameCollision logs a warning if another entry caches its
+// response at the same path as e, which would cause them to overwrite
+// each other. Assumes the caller holds a lock
+func (c *cache) warnOnFilenameCollision(e *Entry) {
+	if e.responseFilename == "" {
+		return
+	}
+	for name, other := range c.entries {
+		if name != e.name && other.responseFilename == e.responseFilename {
+			c.log.Warning("[cache] Entries '%s' and '%s' both cache their response at '%s'", e.name, name, e.responseFilename)
+		}
+	}
+}
+
+// duplicatePolicy decides what happens when a entry is added to the
+// cache with the same name as a entry that is already in it
+type duplicatePolicy int
+
+const (
+	duplicatesOverwrite duplicatePolicy = iota // replace the existing entry
+	duplicatesReject                           // keep the existing entry and fail to add the new one
+	duplicatesMerge                            // replace the existing entry but keep its response if it is fresher
+)
+
+var duplicatePolicies = map[string]duplicatePolicy{
+	"overwrite": duplicatesOverwrite,
+	"reject":    duplicatesReject,
+	"merge":     duplicatesMerge,
+}
+
+// setDuplicatePolicy sets how entries with the same name as an existing
+// entry are added
+func (c *cache) setDuplicatePolicy(policy duplicatePolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.duplicates = policy
+}
+
+// checkDuplicate applies the duplicate policy to e before it is added,
+// returning a error if it shouldn't be. Assumes the caller holds a lock
+func (c *cache) checkDuplicate(e *Entry) error {
+	existing, present := c.entries[e.name]
+	if !present {
+		c.makeRoom()
+		c.log.Info("[cache] Adding entry for '%s'", e.name)
+		return nil
+	}
+	if c.duplicates == duplicatesReject {
+		return fmt.Errorf("entry '%s' already exists in cache", e.name)
 	}
-	return nil, present
+	// the new entry may be for a different certificate so none of the
+	// existing entry's keys can be left pointing at it
+	c.removeLookupKeys(existing)
+	if c.duplicates == duplicatesMerge && e.adoptFresherResponse(existing) {
+		c.log.Info("[cache] Replacing cache entry '%s', keeping its fresher response", e.name)
+		return nil
+	}
+	c.log.Warning("[cache] Overwriting cache entry '%s'", e.name)
+	return nil
 }
 
-func (c *cache) addSingle(e *Entry, key [32]byte) {
+func (c *cache) addSingle(e *Entry, key [32]byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if _, present := c.entries[e.name]; present {
-		c.log.Warning("[cache] Entry for '%s' already exists in cache", e.name)
-		return
+	c.warnOnFilenameCollision(e)
+	err := c.checkDuplicate(e)
+	if err != nil {
+		return err
 	}
-	c.log.Info("[cache] Adding entry for '%s'", e.name)
+	c.touch(e)
 	c.entries[e.name] = e
 	c.lookupMap[key] = e
+	return nil
 }
 
-// this cache structure seems kind of gross but... idk i think it's prob
-// best for now (until I can think of something better :/)
-func (c *cache) addMulti(e *Entry) error {
-	hashes, err := allHashes(e)
+// add adds e to the cache under a lookup key for each of the cache's
+// hash algorithms, computed from its issuer and serial. Entries that
+// only have a request, and so can't have their keys computed, must be
+// added using addSingle instead
+func (c *cache) add(e *Entry) error {
+	if e.issuer == nil || e.serial == nil {
+		return fmt.Errorf("entry '%s' doesn't have a issuer and serial to compute lookup keys from", e.name)
+	}
+	hashes, err := c.allHashes(e)
 	if err != nil {
 		return err
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if _, present := c.entries[e.name]; present {
-		// log or fail...?
-		c.log.Warning("[cache] Overwriting cache entry '%s'", e.name)
-	} else {
-		c.log.Info("[cache] Adding entry for '%s'", e.name)
+	c.warnOnFilenameCollision(e)
+	err = c.checkDuplicate(e)
+	if err != nil {
+		return err
+	}
+	c.insert(e, hashes)
+	return nil
+}
+
+// replace swaps the entry with the same name as e for e, whatever the
+// duplicate policy is, in one step so that requests for it are always
+// answered by one or the other
+func (c *cache) replace(e *Entry) error {
+	if e.issuer == nil || e.serial == nil {
+		return fmt.Errorf("entry '%s' doesn't have a issuer and serial to compute lookup keys from", e.name)
+	}
+	hashes, err := c.allHashes(e)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	existing, present := c.entries[e.name]
+	if !present {
+		return fmt.Errorf("entry '%s' is not in the cache", e.name)
 	}
+	c.warnOnFilenameCollision(e)
+	c.removeLookupKeys(existing)
+	c.insert(e, hashes)
+	c.log.Info("[cache] Replaced entry for '%s'", e.name)
+	return nil
+}
+
+// insert adds e to the cache under the lookup keys hashes. Assumes the
+// caller holds a write lock
+func (c *cache) insert(e *Entry, hashes [][32]byte) {
+	c.touch(e)
 	c.entries[e.name] = e
 	for _, h := range hashes {
 		c.lookupMap[h] = e
 	}
-	return nil
 }
 
 func (c *cache) remove(name string) error {
@@ -131,339 +430,1710 @@ func (c *cache) remove(name string) error {
 	if !present {
 		return fmt.Errorf("entry '%s' is not in the cache", name)
 	}
+	// entries removed on reload may still be refreshing, or be held
+	// by a request, so the lock is released once they're gone
 	e.mu.Lock()
+	defer e.mu.Unlock()
 	delete(c.entries, name)
-	hashes, err := allHashes(e)
-	if err != nil {
-		return err
-	}
-	for _, h := range hashes {
-		delete(c.lookupMap, h)
-	}
+	c.removeLookupKeys(e)
 	c.log.Info("[cache] Removed entry for '%s' from cache", name)
 	return nil
 }
 
+// get returns the entry with the provided name
+func (c *cache) get(name string) (*Entry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, present := c.entries[name]
+	return e, present
+}
+
+// snapshot returns a copy of the current set of entries
+func (c *cache) snapshot() []*Entry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entries := make([]*Entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// stop stops the monitor and cancels any in-flight refreshes, waiting
+// for them to exit
+func (c *cache) stop() {
+	c.cancel()
+	<-c.monitorDone
+	c.refreshes.Wait()
+}
+
 func (c *cache) monitor(tick time.Duration) {
+	defer close(c.monitorDone)
 	ticker := time.NewTicker(tick)
-	for range ticker.C {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		c.mu.RLock()
-		defer c.mu.RUnlock()
-		for _, entry := range c.entries {
-			go entry.refreshAndLog()
+		slots := c.refreshSlots
+		c.mu.RUnlock()
+		// snapshot the entries so the lock isn't held while
+		// kicking off refreshes
+		entries := c.removeExpired(c.snapshot())
+		atomic.AddInt64(&c.queuedRefreshes, int64(len(entries)))
+		for i, entry := range entries {
+			// if refreshes are limited wait for a slot, which means
+			// ticks are skipped until the queue has been worked through
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+				case <-c.ctx.Done():
+					atomic.AddInt64(&c.queuedRefreshes, -int64(len(entries)-i))
+					return
+				}
+			}
+			atomic.AddInt64(&c.queuedRefreshes, -1)
+			c.refreshes.Add(1)
+			go func(e *Entry) {
+				defer c.refreshes.Done()
+				if slots != nil {
+					defer func() { <-slots }()
+				}
+				e.refreshAndLog(c.ctx)
+			}(entry)
+		}
+	}
+}
+
+// removeExpired checks whether each of entries' certificates is about
+// to expire, removing those whose certificate has expired if they are
+// configured to be removed, and returns the rest
+func (c *cache) removeExpired(entries []*Entry) []*Entry {
+	remaining := []*Entry{}
+	for _, e := range entries {
+		e.checkExpiry()
+		if e.expired == expiredRemove && e.leafExpired() {
+			err := c.remove(e.name)
+			if err != nil {
+				c.log.Err("[cache] Failed to remove entry for expired certificate '%s': %s", e.name, err)
+			}
+			continue
 		}
+		remaining = append(remaining, e)
+	}
+	return remaining
+}
+
+// setRefreshLimit limits how many refreshes the monitor runs at once,
+// entries past the limit wait in a queue. Zero means no limit
+func (c *cache) setRefreshLimit(limit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if limit <= 0 {
+		c.refreshSlots = nil
+		return
 	}
+	c.refreshSlots = make(chan struct{}, limit)
+}
+
+// refreshQueueDepth returns how many entries are waiting for the
+// monitor to start refreshing them
+func (c *cache) refreshQueueDepth() int64 {
+	return atomic.LoadInt64(&c.queuedRefreshes)
 }
 
+// maxBackoff is the longest an entry will wait between failed refreshes
+const maxBackoff = time.Hour
+
+// defaultUpdateWindow is the fraction of a response's validity period,
+// counting back from NextUpdate, during which it will be refreshed
+const defaultUpdateWindow = 0.25
+
 type Entry struct {
-	name     string
-	log      *Logger
-	clk      clock.Clock
-	lastSync time.Time
+	name       string
+	log        *Logger
+	clk        clock.Clock
+	lastSync   time.Time
+	definition *CertDefinition // set if the entry was created from the configuration
+	globals    fetcherGlobals  // global settings the entry was created from the definition with
+	lastUsed   int64           // value of the caches accessCount when last served, accessed atomically
+	refreshing int32           // set while a refresh is running, accessed atomically
+	rand       *mrand.Rand     // per-entry generator for responder selection and jitter, processRand if nil
 
 	// cert related
-	serial *big.Int
-	issuer *x509.Certificate
+	serial        *big.Int
+	issuer        *x509.Certificate
+	notAfter      time.Time     // zero if the entry wasn't loaded from a certificate
+	expiryWarning time.Duration // warn when the certificate expires within this long, disabled if zero
+	expiryWarned  time.Time     // when the last expiry warning was logged
+	expired       expiredPolicy // what to do once the certificate has expired
+	expiredLogged bool          // whether stopping because the certificate expired has been logged
 
 	// request related
-	responders  []string
-	client      *http.Client
-	timeout     time.Duration
-	baseBackoff time.Duration
-	request     []byte
+	responders         []string
+	noRespondersLogged bool         // whether having no responders to refresh from has been logged
+	allowedResponders  []string     // hosts responders may be on, any if empty
+	limiter            *hostLimiter // shared by all entries, may be nil
+	maxResponseSize    int64        // largest response body that will be read
+	minSignatureHash   crypto.Hash  // weakest hash accepted in response signatures, any if zero
+	selectResponder    responderSelector
+	nextResponder      int            // used by round-robin selection
+	responderFailures  map[string]int // consecutive failures per responder
+	client             *http.Client
+	timeout            time.Duration // deadline for each refresh, including retries
+	attemptTimeout     time.Duration // deadline for each request to a responder, only timeout applies if zero
+	retries            int           // how many times a failed fetch is retried within a refresh
+	baseBackoff        time.Duration
+	clockSkew          time.Duration // how far our clock may be behind, or ahead of, responders and clients
+	request            []byte
+	useNonce           bool          // include a nonce in each request, responses aren't written to disk
+	nonce              []byte        // encoded nonce sent in the current request
+	failures           int           // consecutive failed refreshes
+	nextRetry          time.Time     // refreshes are skipped until this time after a failure
+	startupDelay       time.Duration // how long Init waits before fetching a response if there isn't one cached
+	peerResponses      [][]byte      // responses pulled from a peer at start up, used by Init if there isn't one cached
+	updateWindow       float64       // fraction of the validity period to refresh in, defaultUpdateWindow if zero
+
+	// CRL fallback related, the status is informational only
+	crlFallback bool
+	crlURLs     []string
+	crlStatus   int
+	crlChecked  time.Time // zero if the CRL hasn't been successfully checked
 
 	// response related
-	maxAge           time.Duration
-	eTag             string
-	response         []byte
-	responseFilename string
-	nextUpdate       time.Time
-	thisUpdate       time.Time
+	maxAge                  time.Duration
+	noStore                 bool // responder sent Cache-Control: no-store
+	noCache                 bool // responder sent Cache-Control: no-cache
+	eTag                    string
+	response                []byte
+	synced                  bool     // whether the entry has ever had a valid response
+	status                  int      // certificate status of response
+	refuseUnknown           bool     // don't replace good responses with unknown ones
+	responseFilename        string   // key the response is cached under in store
+	store                   storage  // fileStorage if nil
+	shardResponses          bool     // cache responses in subdirectories keyed by issuer
+	base64Responses         bool     // cache responses base64 encoded rather than as DER
+	legacyResponseFilenames []string // older paths checked in order if responseFilename doesn't exist
+	nextUpdate              time.Time
+	thisUpdate              time.Time
+	nextPublish             time.Time     // zero if the response doesn't contain NextPublish
+	staleServed             time.Time     // NextUpdate of the last stale response serving was logged for
+	staleRefused            time.Time     // NextUpdate of the last stale response refusing to serve was logged for
+	hook                    *responseHook // notified when the response changes, may be nil
+	writeGeneration         uint64        // incremented each time a write to the store is snapshotted
 
 	mu *sync.RWMutex
+
+	// writes to the store happen without holding mu, writeMu orders them
+	// so an older snapshot never overwrites a newer one
+	writeMu           sync.Mutex
+	writtenGeneration uint64 // generation of the last snapshot written, guarded by writeMu
 }
 
-func NewEntry(log *Logger, clk clock.Clock, timeout, baseBackoff time.Duration) *Entry {
+func NewEntry(log *Logger, clk clock.Clock, timeout, baseBackoff, clockSkew time.Duration) *Entry {
 	return &Entry{
-		log:         log,
-		clk:         clk,
-		client:      new(http.Client),
-		timeout:     timeout,
-		baseBackoff: baseBackoff,
-		mu:          new(sync.RWMutex),
+		log:               log,
+		clk:               clk,
+		client:            new(http.Client),
+		timeout:           timeout,
+		baseBackoff:       baseBackoff,
+		clockSkew:         clockSkew,
+		selectResponder:   selectRandom,
+		maxResponseSize:   defaultMaxResponseSize,
+		rand:              newRand(processRand.Int63()),
+		responderFailures: make(map[string]int),
+		mu:                new(sync.RWMutex),
 	}
 }
 
-func loadProxy(uri string) (func(*http.Request) (*url.URL, error), error) {
-	proxyURL, err := url.Parse(uri)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse proxy URL: %s", err)
+// random returns the generator the entry should use for responder
+// selection and jitter
+func (e *Entry) random() *mrand.Rand {
+	if e.rand == nil {
+		return processRand
 	}
-	return http.ProxyURL(proxyURL), nil
+	return e.rand
 }
 
-func (e *Entry) generateResponseFilename(cacheFolder string) {
-	e.responseFilename = path.Join(
-		cacheFolder,
-		fmt.Sprintf(
-			"%s.resp",
-			strings.TrimSuffix(
-				filepath.Base(e.name),
-				filepath.Ext(e.name),
-			),
-		),
-	)
-}
-
-func (e *Entry) loadCertificate(filename string) error {
-	e.name = filename
-	cert, err := ReadCertificate(filename)
+// parsePositiveDuration parses a duration, using def if it isn't set,
+// and rejects anything that isn't greater than zero
+func parsePositiveDuration(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("failed to parse %s: %s", name, err)
 	}
-	e.serial = cert.SerialNumber
-	e.responders = cert.OCSPServer
-	if e.issuer == nil && len(cert.IssuingCertificateURL) > 0 {
-		for _, issuerURL := range cert.IssuingCertificateURL {
-			// this should be its own function
-			resp, err := http.Get(issuerURL)
-			if err != nil {
-				e.log.Err("Failed to retrieve issuer from '%s': %s", issuerURL, err)
-				continue
-			}
-			defer resp.Body.Close()
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				e.log.Err("Failed to read issuer body from '%s': %s", issuerURL, err)
-				continue
-			}
-			e.issuer, err = ParseCertificate(body)
-			if err != nil {
-				e.log.Err("Failed to parse issuer body from '%s': %s", issuerURL, err)
-				continue
-			}
-		}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be greater than zero, got %s", name, value)
 	}
-	return nil
+	return d, nil
 }
 
-func (e *Entry) loadCertificateInfo(name, serial string) error {
-	e.name = name
-	e.responseFilename = name + ".resp"
-	serialBytes, err := hex.DecodeString(serial)
+// newTransport builds the transport used to talk to upstream responders,
+// unset fields in tc use the same defaults as http.DefaultTransport. If
+// proxyURI is provided all requests are sent through the proxy
+func newTransport(tc TransportConfig, proxyURI string) (*http.Transport, error) {
+	dialTimeout, err := parsePositiveDuration("dial-timeout", tc.DialTimeout, 30*time.Second)
 	if err != nil {
-		return fmt.Errorf("failed to decode serial '%s': %s", e.serial, err)
+		return nil, err
 	}
-	e.serial = e.serial.SetBytes(serialBytes)
-	return nil
-}
-
-// blergh
-func (e *Entry) FromCertDef(def CertDefinition, globalUpstream []string, globalProxy string, cacheFolder string) error {
-	if def.Issuer != "" {
-		var err error
-		e.issuer, err = ReadCertificate(def.Issuer)
-		if err != nil {
-			return err
-		}
+	keepAlive, err := parsePositiveDuration("keep-alive", tc.KeepAlive, 30*time.Second)
+	if err != nil {
+		return nil, err
 	}
-	if def.Certificate != "" {
-		err := e.loadCertificate(def.Certificate)
-		if err != nil {
-			return err
-		}
-	} else if def.Name != "" && def.Serial != "" {
-		err := e.loadCertificateInfo(def.Name, def.Serial)
-		if err != nil {
-			return err
-		}
-	} else {
-		return fmt.Errorf("either certificate or name and serial must be provided")
+	tlsHandshakeTimeout, err := parsePositiveDuration("tls-handshake-timeout", tc.TLSHandshakeTimeout, 10*time.Second)
+	if err != nil {
+		return nil, err
 	}
-	if e.issuer == nil {
-		return fmt.Errorf("either issuer or a certificate containing issuer AIA information must be provided")
+	if tc.MaxIdleConns < 0 {
+		return nil, fmt.Errorf("max-idle-conns must not be negative, got %d", tc.MaxIdleConns)
 	}
-	if cacheFolder != "" {
-		e.generateResponseFilename(cacheFolder)
+	maxIdleConns := tc.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = 100
 	}
-	if len(globalUpstream) > 0 && !def.OverrideGlobalUpstream {
-		e.responders = globalUpstream
-	} else if len(def.Responders) > 0 {
-		e.responders = def.Responders
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: keepAlive,
 	}
-	proxyURI := ""
-	if globalProxy != "" && !def.OverrideGlobalProxy {
-		proxyURI = globalProxy
-	} else if def.Proxy != "" {
-		proxyURI = def.Proxy
+	t := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+		MaxIdleConns:        maxIdleConns,
+		// transports are shared by entries that mostly talk to the
+		// same few responders so don't limit idle connections per host
+		// any more than overall
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	t.TLSClientConfig, err = newClientTLSConfig(tc)
+	if err != nil {
+		return nil, err
 	}
 	if proxyURI != "" {
-		proxy, err := loadProxy(proxyURI)
+		err = loadProxy(t, proxyURI, dialer)
 		if err != nil {
-			return err
-		}
-		e.client.Transport = &http.Transport{
-			Proxy: proxy,
-			Dial: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout: 10 * time.Second,
+			return nil, err
 		}
 	}
-	return nil
+	return t, nil
 }
 
-func (e *Entry) Init() error {
-	if e.request == nil {
-		if e.issuer == nil {
-			return errors.New("if request isn't provided issuer must be non-nil")
-		}
-		issuerNameHash, issuerKeyHash, err := hashNameAndPKI(
-			crypto.SHA1.New(),
-			e.issuer.RawSubject,
-			e.issuer.RawSubjectPublicKeyInfo,
-		)
-		if err != nil {
-			return err
-		}
-		ocspRequest := &ocsp.Request{
-			crypto.SHA1,
-			issuerNameHash,
-			issuerKeyHash,
-			e.serial,
-		}
-		e.request, err = ocspRequest.Marshal()
-		if err != nil {
-			return err
+// transportKey identifies the transports that can be shared by entries
+type transportKey struct {
+	config   TransportConfig
+	proxyURI string
+}
+
+// pooledTransport is a transport in a transportPool along with a digest
+// of the files it was built from
+type pooledTransport struct {
+	transport *http.Transport
+	files     [sha256.Size]byte
+}
+
+// transportPool shares transports between entries with the same
+// transport settings and proxy, so entries whose responders are on the
+// same host reuse connections rather than each dialing their own
+type transportPool struct {
+	mu         sync.Mutex
+	transports map[transportKey]pooledTransport
+}
+
+// sharedTransports is the pool used by entries created from definitions
+var sharedTransports = newTransportPool()
+
+func newTransportPool() *transportPool {
+	return &transportPool{transports: make(map[transportKey]pooledTransport)}
+}
+
+// transportFilesDigest hashes the contents of the client certificate,
+// key, and root CAs files tc refers to, so that a transport can be
+// rebuilt when they are rotated without its settings changing
+func transportFilesDigest(tc TransportConfig) ([sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	h := sha256.New()
+	for _, filename := range []string{tc.ClientCertificate, tc.ClientKey, tc.RootCAs} {
+		var contents []byte
+		if filename != "" {
+			var err error
+			contents, err = ioutil.ReadFile(filename)
+			if err != nil {
+				return digest, fmt.Errorf("failed to read '%s': %s", filename, err)
+			}
 		}
+		fmt.Fprintf(h, "%d:", len(contents))
+		h.Write(contents)
 	}
-	for i := range e.responders {
-		e.responders[i] = strings.TrimSuffix(e.responders[i], "/")
-	}
-	err := e.readFromDisk()
-	if err == nil {
-		return nil
+	copy(digest[:], h.Sum(nil))
+	return digest, nil
+}
+
+// get returns the transport for tc and proxyURI, creating it if this
+// is the first time they've been asked for or if the files tc refers
+// to have changed since it was created. A transport that is replaced
+// has its idle connections closed, entries still using it carry on
+// working until they are replaced themselves
+func (p *transportPool) get(tc TransportConfig, proxyURI string) (*http.Transport, error) {
+	key := transportKey{tc, proxyURI}
+	files, err := transportFilesDigest(tc)
+	if err != nil {
+		return nil, err
 	}
-	if !os.IsNotExist(err) {
-		e.err("Failed to read response from disk: %s", err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	existing, present := p.transports[key]
+	if present && existing.files == files {
+		return existing.transport, nil
 	}
-	err = e.refreshResponse()
+	t, err := newTransport(tc, proxyURI)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return nil
+	if present {
+		existing.transport.CloseIdleConnections()
+	}
+	p.transports[key] = pooledTransport{transport: t, files: files}
+	return t, nil
+}
+
+// prune removes the transports that aren't in inUse from the pool,
+// closing their idle connections
+func (p *transportPool) prune(inUse map[http.RoundTripper]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, pooled := range p.transports {
+		if inUse[pooled.transport] {
+			continue
+		}
+		pooled.transport.CloseIdleConnections()
+		delete(p.transports, key)
+	}
+}
+
+// loadProxy configures t to send requests through the proxy described
+// by uri. HTTP(S) proxies are used via CONNECT, SOCKS5 proxies replace
+// the transport's dialer with one that connects through the proxy using
+// forward. URIs without a scheme are assumed to be HTTP proxies
+func loadProxy(t *http.Transport, uri string, forward *net.Dialer) error {
+	if !strings.Contains(uri, "://") {
+		uri = "http://" + uri
+	}
+	proxyURL, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("failed to parse proxy URL: %s", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https":
+		t.Proxy = http.ProxyURL(proxyURL)
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, forward)
+		if err != nil {
+			return fmt.Errorf("failed to create SOCKS5 dialer: %s", err)
+		}
+		t.DialContext = dialer.(proxy.ContextDialer).DialContext
+	default:
+		return fmt.Errorf("unsupported proxy scheme '%s'", proxyURL.Scheme)
+	}
+	return nil
+}
+
+// generateResponseFilename sets the path the entry's response is cached
+// at in cacheFolder, if the entry uses a shared store the key is used
+// instead and if it doesn't and cacheFolder isn't set responses aren't
+// cached. The serial is included in the filename so that
+// certificates with the same base filename don't clobber each other's
+// responses. If shardResponses is set responses are split into
+// subdirectories named after a prefix of the issuer key hash. Paths used
+// by older versions, or the flat layout, are kept so responses cached
+// using them can still be read
+func (e *Entry) generateResponseFilename(cacheFolder string) {
+	if e.sharedStore() {
+		e.generateResponseKey()
+		return
+	}
+	if cacheFolder == "" {
+		return
+	}
+	base := strings.TrimSuffix(filepath.Base(e.name), filepath.Ext(e.name))
+	unsuffixed := path.Join(cacheFolder, fmt.Sprintf("%s.resp", base))
+	if e.serial == nil {
+		e.responseFilename = unsuffixed
+		return
+	}
+	name := fmt.Sprintf("%s-%X.resp", base, e.serial)
+	e.responseFilename = path.Join(cacheFolder, name)
+	e.legacyResponseFilenames = []string{unsuffixed}
+	if !e.shardResponses {
+		return
+	}
+	keyHash, err := e.issuerKeyHash()
+	if err != nil {
+		e.err("Failed to compute issuer key hash, not sharding response: %s", err)
+		return
+	}
+	e.legacyResponseFilenames = []string{e.responseFilename, unsuffixed}
+	e.responseFilename = path.Join(cacheFolder, fmt.Sprintf("%X", keyHash[:4]), name)
+}
+
+// generateResponseKey sets the key the entry's response is cached under
+// in a shared store to the issuer key hash and serial, so that separate
+// instances agree on it regardless of how their certificates are named
+func (e *Entry) generateResponseKey() {
+	keyHash, err := e.issuerKeyHash()
+	if err != nil || e.serial == nil {
+		e.err("Failed to compute storage key, response won't be cached: %v", err)
+		return
+	}
+	e.responseFilename = fmt.Sprintf("%X-%X.resp", keyHash, e.serial)
+}
+
+// issuerKeyHash returns the SHA1 hash of the issuer's public key, using
+// the request if the entry doesn't have the issuer itself
+func (e *Entry) issuerKeyHash() ([]byte, error) {
+	if e.issuer != nil {
+		_, keyHash, err := hashNameAndPKI(crypto.SHA1.New(), e.issuer.RawSubject, e.issuer.RawSubjectPublicKeyInfo)
+		return keyHash, err
+	}
+	if e.request != nil {
+		req, err := ocsp.ParseRequest(e.request)
+		if err != nil {
+			return nil, err
+		}
+		return req.IssuerKeyHash, nil
+	}
+	return nil, errors.New("entry has neither an issuer or a request")
+}
+
+// loadCertificate loads the certificate in filename, if issuers is
+// provided the one that issued the certificate is used as the issuer
+// otherwise the issuer is fetched using the certificate's AIA extension
+func (e *Entry) loadCertificate(filename string, issuers []*x509.Certificate) error {
+	e.name = filename
+	cert, err := ReadCertificate(filename)
+	if err != nil {
+		return err
+	}
+	e.serial = cert.SerialNumber
+	e.notAfter = cert.NotAfter
+	e.responders = cert.OCSPServer
+	e.crlURLs = cert.CRLDistributionPoints
+	if len(issuers) > 0 {
+		e.issuer, err = selectIssuer(issuers, cert)
+		if err != nil {
+			return fmt.Errorf("failed to find issuer of '%s': %s", filename, err)
+		}
+	} else if len(cert.IssuingCertificateURL) > 0 {
+		e.issuer = e.fetchIssuer(cert)
+	}
+	return nil
+}
+
+// fetchIssuer tries to retrieve the issuer of cert from each of the URLs
+// in its AIA extension in turn, returning the first certificate whose
+// subject matches the issuer of cert and that has signed it
+func (e *Entry) fetchIssuer(cert *x509.Certificate) *x509.Certificate {
+	for _, issuerURL := range cert.IssuingCertificateURL {
+		issuer, err := e.fetchCertificate(issuerURL)
+		if err != nil {
+			e.err("Failed to retrieve issuer from '%s': %s", issuerURL, err)
+			continue
+		}
+		if !bytes.Equal(issuer.RawSubject, cert.RawIssuer) {
+			e.err("Issuer from '%s' has the wrong subject: wanted '%s', got '%s'", issuerURL, cert.Issuer.CommonName, issuer.Subject.CommonName)
+			continue
+		}
+		err = cert.CheckSignatureFrom(issuer)
+		if err != nil {
+			e.err("Issuer from '%s' didn't sign certificate: %s", issuerURL, err)
+			continue
+		}
+		e.info("Loaded issuer from '%s'", issuerURL)
+		return issuer
+	}
+	return nil
+}
+
+// maxIssuerSize is the largest issuer certificate that will be
+// downloaded via AIA
+const maxIssuerSize = 4 << 20
+
+// fetchCertificate retrieves and parses a certificate from url, giving
+// up after the entry's client timeout
+func (e *Entry) fetchCertificate(url string) (*x509.Certificate, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got a non-200 response: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIssuerSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %s", err)
+	}
+	if len(body) > maxIssuerSize {
+		return nil, fmt.Errorf("body is larger than %d bytes", maxIssuerSize)
+	}
+	cert, err := ParseCertificate(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse body: %s", err)
+	}
+	return cert, nil
+}
+
+func (e *Entry) loadCertificateInfo(name, serial string) error {
+	e.name = name
+	e.responseFilename = name + ".resp"
+	serialBytes, err := hex.DecodeString(serial)
+	if err != nil {
+		return fmt.Errorf("failed to decode serial '%s': %s", e.serial, err)
+	}
+	e.serial = e.serial.SetBytes(serialBytes)
+	return nil
+}
+
+// blergh
+func (e *Entry) FromCertDef(def CertDefinition, globalUpstream []string, globalProxy string, globalTransport TransportConfig, cacheFolder string) error {
+	e.definition = &def
+	e.globals = fetcherGlobals{globalUpstream, globalProxy, globalTransport}
+	issuers, err := def.issuers()
+	if err != nil {
+		return err
+	}
+	if def.Certificate != "" {
+		err := e.loadCertificate(def.Certificate, issuers)
+		if err != nil {
+			return err
+		}
+	} else if def.Name != "" && def.Serial != "" {
+		// without the certificate there is no way to tell which
+		// certificate in a bundle is the issuer
+		if len(issuers) > 1 {
+			return fmt.Errorf("issuer contains %d certificates, certificate must be provided to select between them", len(issuers))
+		}
+		if len(issuers) == 1 {
+			e.issuer = issuers[0]
+		}
+		err := e.loadCertificateInfo(def.Name, def.Serial)
+		if err != nil {
+			return err
+		}
+	} else {
+		return fmt.Errorf("either certificate or name and serial must be provided")
+	}
+	if e.issuer == nil {
+		return fmt.Errorf("either issuer or a certificate containing issuer AIA information must be provided")
+	}
+	e.generateResponseFilename(cacheFolder)
+	if len(globalUpstream) > 0 && !enabled(def.OverrideGlobalUpstream) {
+		e.responders = globalUpstream
+	} else if len(def.Responders) > 0 {
+		e.responders = def.Responders
+	}
+	e.useNonce = enabled(def.UseNonce)
+	e.crlFallback = enabled(def.CRLFallback)
+	err = def.checkUpdateWindow()
+	if err != nil {
+		return err
+	}
+	e.updateWindow = def.UpdateWindow
+	selector, err := def.responderSelector()
+	if err != nil {
+		return err
+	}
+	if selector != nil {
+		e.selectResponder = selector
+	}
+	transport, err := def.transportFrom(sharedTransports, globalProxy, globalTransport)
+	if err != nil {
+		return err
+	}
+	e.client.Transport = transport
+	timeout, err := def.requestTimeout(e.timeout)
+	if err != nil {
+		return err
+	}
+	e.timeout = timeout
+	return nil
+}
+
+func (e *Entry) Init() error {
+	err := e.prepare()
+	if err != nil {
+		return err
+	}
+	// responses fetched using a nonce are never written to disk
+	if !e.useNonce {
+		err := e.readFromDisk()
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			e.err("Failed to read response from disk: %s", err)
+		}
+	}
+	if e.usePeerResponse() {
+		return nil
+	}
+	// entries that only have CRLs never get a response, their status
+	// is checked straight away instead
+	e.mu.RLock()
+	crlOnly := e.crlOnly()
+	e.mu.RUnlock()
+	if crlOnly {
+		e.checkCRL(context.Background())
+		return nil
+	}
+	// refreshing skips entries without responders, which would leave
+	// the entry without a response to serve
+	if e.lacksResponders() {
+		return errors.New("no responders configured and no cached response")
+	}
+	if e.startupDelay > 0 {
+		e.info("Waiting %s before fetching initial response", e.startupDelay)
+		e.clk.Sleep(e.startupDelay)
+	}
+	err = e.refreshResponse(context.Background())
+	// unlike later refreshes the initial fetch waits for the rate limit
+	// rather than leaving the entry without a response
+	for err == errThrottled {
+		e.clk.Sleep(e.limiter.interval())
+		err = e.refreshResponse(context.Background())
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// prepare builds the entry's request, if it wasn't provided, and
+// normalizes its list of responders
+func (e *Entry) prepare() error {
+	if e.request == nil {
+		if e.issuer == nil {
+			return errors.New("if request isn't provided issuer must be non-nil")
+		}
+		issuerNameHash, issuerKeyHash, err := hashNameAndPKI(
+			crypto.SHA1.New(),
+			e.issuer.RawSubject,
+			e.issuer.RawSubjectPublicKeyInfo,
+		)
+		if err != nil {
+			return err
+		}
+		ocspRequest := &ocsp.Request{
+			HashAlgorithm:  crypto.SHA1,
+			IssuerNameHash: issuerNameHash,
+			IssuerKeyHash:  issuerKeyHash,
+			SerialNumber:   e.serial,
+		}
+		e.request, err = ocspRequest.Marshal()
+		if err != nil {
+			return err
+		}
+	}
+	for i := range e.responders {
+		e.responders[i] = strings.TrimSuffix(e.responders[i], "/")
+	}
+	if len(e.allowedResponders) > 0 && len(e.responders) > 0 {
+		e.responders = e.filterResponders()
+		if len(e.responders) == 0 {
+			return errors.New("none of the responders are on allowed hosts")
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the entry
+func (e *Entry) Name() string {
+	return e.name
+}
+
+// Serial returns a copy of the serial of the certificate the entry
+// holds responses for
+func (e *Entry) Serial() *big.Int {
+	if e.serial == nil {
+		return nil
+	}
+	return new(big.Int).Set(e.serial)
+}
+
+// Response returns a copy of the current DER encoded response, or nil
+// if there isn't one
+func (e *Entry) Response() []byte {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.response == nil {
+		return nil
+	}
+	return append([]byte{}, e.response...)
+}
+
+// Status returns the certificate status, e.g. ocsp.Good, of the
+// current response and whether there is a response
+func (e *Entry) Status() (int, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.status, e.response != nil
+}
+
+// ThisUpdate returns the ThisUpdate of the current response, the
+// zero time if there isn't one
+func (e *Entry) ThisUpdate() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.thisUpdate
+}
+
+// NextUpdate returns the NextUpdate of the current response, the
+// zero time if there isn't one
+func (e *Entry) NextUpdate() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.nextUpdate
+}
+
+// LastSync returns when the response was last successfully fetched
+// or revalidated
+func (e *Entry) LastSync() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.lastSync
+}
+
+// NextRefresh returns the earliest time the entry will try to refresh
+// its response. The exact time within the update window is picked at
+// random each time the entry is checked, so the refresh may happen
+// any time between then and NextUpdate
+func (e *Entry) NextRefresh() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.failures > 0 {
+		return e.nextRetry
+	}
+	if e.response == nil || e.noCache {
+		return e.clk.Now()
+	}
+	next, _ := e.updateWindowBounds()
+	if e.maxAge > 0 && e.lastSync.Add(e.maxAge).Before(next) {
+		next = e.lastSync.Add(e.maxAge)
+	}
+	if !e.nextPublish.IsZero() && e.lastSync.Before(e.nextPublish) && e.nextPublish.Before(next) {
+		next = e.nextPublish
+	}
+	return next
+}
+
+// logFields returns the structured logging fields that identify the
+// entry, and the responder if one is provided
+func (e *Entry) logFields(responder string) map[string]string {
+	fields := map[string]string{"entry": e.name}
+	if e.serial != nil {
+		fields["serial"] = fmt.Sprintf("%X", e.serial)
+	}
+	if responder != "" {
+		fields["responder"] = responder
+	}
+	return fields
 }
 
 // info makes a Info Logger call tagged with the entry name
 func (e *Entry) info(msg string, args ...interface{}) {
-	e.log.Info(fmt.Sprintf("[entry:%s] %s", e.name, msg), args...)
+	if !e.log.enabled(syslog.LOG_INFO) {
+		return
+	}
+	e.log.logFields(syslog.LOG_INFO, e.logFields(""), fmt.Sprintf(msg, args...))
+}
+
+// info makes a Err Logger call tagged with the entry name
+func (e *Entry) err(msg string, args ...interface{}) {
+	if !e.log.enabled(syslog.LOG_ERR) {
+		return
+	}
+	e.log.logFields(syslog.LOG_ERR, e.logFields(""), fmt.Sprintf(msg, args...))
+}
+
+// warning makes a Warning Logger call tagged with the entry name
+func (e *Entry) warning(msg string, args ...interface{}) {
+	if !e.log.enabled(syslog.LOG_WARNING) {
+		return
+	}
+	e.log.logFields(syslog.LOG_WARNING, e.logFields(""), fmt.Sprintf(msg, args...))
+}
+
+// responderInfo makes a Info Logger call tagged with the entry
+// name and the responder being talked to
+func (e *Entry) responderInfo(responder, msg string, args ...interface{}) {
+	if !e.log.enabled(syslog.LOG_INFO) {
+		return
+	}
+	e.log.logFields(syslog.LOG_INFO, e.logFields(responder), fmt.Sprintf(msg, args...))
+}
+
+// responderWarning makes a Warning Logger call tagged with the entry
+// name and the responder being talked to
+func (e *Entry) responderWarning(responder, msg string, args ...interface{}) {
+	if !e.log.enabled(syslog.LOG_WARNING) {
+		return
+	}
+	e.log.logFields(syslog.LOG_WARNING, e.logFields(responder), fmt.Sprintf(msg, args...))
+}
+
+// responderErr makes a Err Logger call tagged with the entry
+// name and the responder being talked to
+func (e *Entry) responderErr(responder, msg string, args ...interface{}) {
+	if !e.log.enabled(syslog.LOG_ERR) {
+		return
+	}
+	e.log.logFields(syslog.LOG_ERR, e.logFields(responder), fmt.Sprintf(msg, args...))
+}
+
+// responseFileMode is the mode cached responses and their metadata are
+// written with, responses are public but shouldn't be writable by anyone
+// other than stapled
+const responseFileMode = 0644
+
+// writeFile writes contents to a temporary file and then renames
+// it to filename so readers never see a partially written file. Both
+// the file and the directory containing it are synced so a crash
+// can't leave an empty or truncated file in place of the old one
+func writeFile(filename string, contents []byte) error {
+	tmpName := fmt.Sprintf("%s.tmp", filename)
+	f, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, responseFileMode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	err = os.Rename(tmpName, filename)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// entryMetadata is the HTTP caching state of an entry that is stored
+// alongside the response on disk so it survives restarts
+type entryMetadata struct {
+	ResponseHash string    `json:"response-hash"` // hex SHA256 of the response the metadata belongs to
+	ETag         string    `json:"etag,omitempty"`
+	MaxAge       int       `json:"max-age,omitempty"` // seconds
+	NoCache      bool      `json:"no-cache,omitempty"`
+	LastSync     time.Time `json:"last-sync"`
+}
+
+// storage returns where the entry's response should be cached
+func (e *Entry) storage() storage {
+	if e.store == nil {
+		return fileStorage{}
+	}
+	return e.store
+}
+
+// storageTTL returns how long the current response should be kept in
+// the store for, which is until it expires. Assumes the caller holds
+// a lock
+func (e *Entry) storageTTL() time.Duration {
+	if e.nextUpdate.IsZero() {
+		return 0
+	}
+	ttl := e.nextUpdate.Sub(e.clk.Now())
+	// a expired response is kept as briefly as possible
+	if ttl <= 0 {
+		ttl = time.Nanosecond
+	}
+	return ttl
+}
+
+// sharedStore returns whether the entry's response is cached somewhere
+// other stapled instances may also be using
+func (e *Entry) sharedStore() bool {
+	if e.store == nil {
+		return false
+	}
+	_, isFile := e.store.(fileStorage)
+	return !isFile
+}
+
+// metadataFilename returns the path of the metadata for the response
+// cached at responseFilename
+func metadataFilename(responseFilename string) string {
+	return responseFilename + ".json"
+}
+
+// pendingWrite is a snapshot of what needs writing to an entry's store,
+// taken while holding the entry's lock so that the write itself, which
+// may go over the network, can happen after it has been released
+type pendingWrite struct {
+	generation uint64
+	store      storage
+	filename   string
+	response   []byte // nil if only the metadata needs writing
+	metadata   []byte
+	ttl        time.Duration
+}
+
+// snapshotWrite snapshots the caching metadata for the current response,
+// and the response itself if withResponse is set, so they can be written
+// by writeSnapshot. Assumes the caller holds a write lock
+func (e *Entry) snapshotWrite(withResponse bool) (*pendingWrite, error) {
+	respHash := sha256.Sum256(e.response)
+	metadata, err := json.Marshal(entryMetadata{
+		ResponseHash: hex.EncodeToString(respHash[:]),
+		ETag:         e.eTag,
+		MaxAge:       int(e.maxAge.Seconds()),
+		NoCache:      e.noCache,
+		LastSync:     e.lastSync,
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.writeGeneration++
+	w := &pendingWrite{
+		generation: e.writeGeneration,
+		store:      e.storage(),
+		filename:   e.responseFilename,
+		metadata:   metadata,
+		ttl:        e.storageTTL(),
+	}
+	if withResponse {
+		w.response = e.response
+		if e.base64Responses {
+			w.response = []byte(base64.StdEncoding.EncodeToString(e.response))
+		}
+	}
+	return w, nil
 }
 
-// info makes a Err Logger call tagged with the entry name
-func (e *Entry) err(msg string, args ...interface{}) {
-	e.log.Err(fmt.Sprintf("[entry:%s] %s", e.name, msg), args...)
+// writeSnapshot writes a snapshot taken by snapshotWrite to the store,
+// unless a newer one has already been written. The caller must not hold
+// the entry's lock
+func (e *Entry) writeSnapshot(w *pendingWrite) error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	if w.generation <= e.writtenGeneration {
+		return nil
+	}
+	if w.response != nil {
+		err := w.store.write(w.filename, w.response, w.ttl)
+		if err != nil {
+			return err
+		}
+		e.info("Written new response to %s", w.filename)
+	}
+	err := w.store.write(metadataFilename(w.filename), w.metadata, w.ttl)
+	if err != nil {
+		return err
+	}
+	e.writtenGeneration = w.generation
+	return nil
 }
 
-// writeToDisk writes a response to disk. Assumes the
-// caller holds a write lock
+// writeToDisk writes the current response, and its metadata, to disk.
+// The caller must not hold the entry's lock
 func (e *Entry) writeToDisk() error {
-	tmpName := fmt.Sprintf("%s.tmp", e.responseFilename)
-	err := ioutil.WriteFile(tmpName, e.response, os.ModePerm)
+	e.mu.Lock()
+	w, err := e.snapshotWrite(true)
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return e.writeSnapshot(w)
+}
+
+// readMetadata attempts to read the caching metadata for respBytes,
+// which was read from responseFilename, from disk, nil is returned if
+// there is no metadata or it was written for a different response
+func (e *Entry) readMetadata(responseFilename string, respBytes []byte) (*entryMetadata, error) {
+	contents, err := e.storage().read(metadataFilename(responseFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var metadata entryMetadata
+	err = json.Unmarshal(contents, &metadata)
+	if err != nil {
+		return nil, err
+	}
+	respHash := sha256.Sum256(respBytes)
+	if metadata.ResponseHash != hex.EncodeToString(respHash[:]) {
+		return nil, nil
+	}
+	return &metadata, nil
+}
+
+// ImportResponse verifies a response fetched out of band, in either DER
+// or base64 encoding, against the entry's certificate and issuer and
+// caches it, writing it to disk so that it doesn't need to be fetched
+// when stapled is next started
+func (e *Entry) ImportResponse(contents []byte) error {
+	if e.issuer == nil {
+		return errors.New("the issuer is needed to verify imported responses")
+	}
+	if e.responseFilename == "" || e.useNonce {
+		return errors.New("responses for this certificate aren't cached on disk")
+	}
+	respBytes, err := decodeStoredResponse(contents)
+	if err != nil {
+		return err
+	}
+	resp, err := e.parseResponse(respBytes)
 	if err != nil {
 		return err
 	}
-	err = os.Rename(tmpName, e.responseFilename)
+	err = e.verifyResponse(resp, respBytes)
 	if err != nil {
 		return err
 	}
-	e.info("Written new response to %s", e.responseFilename)
+	err = e.updateResponse("", cacheControl{}, resp, respBytes, true)
+	if err != nil {
+		return fmt.Errorf("failed to write response: %s", err)
+	}
 	return nil
 }
 
-// readFromDisk attempts to read a response that has been
-// cached on disk
+// decodeStoredResponse returns the DER form of a cached response which
+// may have been stored either as DER or, e.g. by other tools, base64
+// encoded. DER responses always start with a SEQUENCE tag, which can't
+// be the first character of a base64 encoded response
+func decodeStoredResponse(contents []byte) ([]byte, error) {
+	if len(contents) == 0 || contents[0] == 0x30 {
+		return contents, nil
+	}
+	stripped := strings.Join(strings.Fields(string(contents)), "")
+	respBytes, err := base64.StdEncoding.DecodeString(stripped)
+	if err != nil {
+		return nil, fmt.Errorf("response is neither DER nor base64 encoded: %s", err)
+	}
+	return respBytes, nil
+}
+
+// quarantineResponse moves a corrupt response file aside, keeping it
+// for inspection, so that it isn't read again every time stapled is
+// started. Responses in a shared store are left alone since they'll be
+// overwritten by the next response fetched
+func (e *Entry) quarantineResponse(filename string, cause error) {
+	if e.sharedStore() {
+		e.warning("Response in shared store under %s is corrupt: %s", filename, cause)
+		return
+	}
+	quarantined := filename + ".corrupt"
+	err := os.Rename(filename, quarantined)
+	if err != nil {
+		e.warning("Response file %s is corrupt (%s) and couldn't be moved aside: %s", filename, cause, err)
+		return
+	}
+	e.warning("Response file %s is corrupt, moved it to %s: %s", filename, quarantined, cause)
+}
+
+// readFromDisk attempts to read a response, and its metadata if
+// present, that has been cached on disk
 func (e *Entry) readFromDisk() error {
-	respBytes, err := ioutil.ReadFile(e.responseFilename)
+	filename := e.responseFilename
+	respBytes, err := e.storage().read(filename)
+	for _, legacy := range e.legacyResponseFilenames {
+		if !os.IsNotExist(err) {
+			break
+		}
+		filename = legacy
+		respBytes, err = e.storage().read(filename)
+	}
+	if err != nil {
+		return err
+	}
+	respBytes, err = decodeStoredResponse(respBytes)
+	if err != nil {
+		e.quarantineResponse(filename, err)
+		return err
+	}
+	e.info("Read response from %s", filename)
+	resp, err := e.parseResponse(respBytes)
 	if err != nil {
+		e.quarantineResponse(filename, err)
 		return err
 	}
-	e.info("Read response from %s", e.responseFilename)
-	resp, err := ocsp.ParseResponse(respBytes, e.issuer)
+	err = e.verifyResponse(resp, respBytes)
 	if err != nil {
 		return err
 	}
-	err = e.verifyResponse(resp)
+	metadata, err := e.readMetadata(filename, respBytes)
+	if err != nil {
+		e.err("Failed to read response metadata from %s: %s", metadataFilename(filename), err)
+	}
+	if metadata == nil {
+		err = e.updateResponse("", cacheControl{}, resp, respBytes, false)
+	} else {
+		err = e.updateResponse(metadata.ETag, cacheControl{maxAge: metadata.MaxAge, noCache: metadata.NoCache}, resp, respBytes, false)
+	}
 	if err != nil {
 		return err
 	}
-	e.updateResponse("", 0, resp, respBytes, false)
+	if metadata != nil {
+		e.mu.Lock()
+		e.lastSync = metadata.LastSync
+		e.mu.Unlock()
+	}
+	// responses read from an older path are moved to the current one,
+	// the old copy is only removed once the new one has been written
+	if filename != e.responseFilename {
+		err = e.writeToDisk()
+		if err != nil {
+			e.err("Failed to move response from %s to %s: %s", filename, e.responseFilename, err)
+			return nil
+		}
+		err = removeResponseFile(filename)
+		if err != nil {
+			e.err("Failed to remove response moved from %s: %s", filename, err)
+		}
+	}
+	return nil
+}
+
+// removeResponseFile removes the response cached at filename on disk,
+// along with its metadata if there is any
+func removeResponseFile(filename string) error {
+	for _, f := range []string{filename, metadataFilename(filename)} {
+		err := os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
 // updateResponse updates the actual response body/metadata
 // stored in the entry
-func (e *Entry) updateResponse(eTag string, maxAge int, resp *ocsp.Response, respBytes []byte, write bool) error {
+func (e *Entry) updateResponse(eTag string, cc cacheControl, resp *ocsp.Response, respBytes []byte, write bool) error {
 	e.mu.Lock()
-	defer e.mu.Unlock()
+	w, event, err := e.applyResponse(eTag, cc, resp, respBytes, write)
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// the store may be remote so it's written to without holding the
+	// lock, which would block serving the response
+	if w != nil {
+		err = e.writeSnapshot(w)
+		if err != nil {
+			return err
+		}
+	}
+	// hooks may read the cached response so they're only told about it
+	// once it has been written
+	if event != nil {
+		e.hook.fire(*event)
+	}
+	return nil
+}
+
+// applyResponse does the work of updateResponse that needs the lock,
+// returning what needs writing to the store and the event hooks should
+// be sent, either of which may be nil. Assumes the caller holds a write
+// lock
+func (e *Entry) applyResponse(eTag string, cc cacheControl, resp *ocsp.Response, respBytes []byte, write bool) (*pendingWrite, *responseEvent, error) {
+	// responses read from disk at start up aren't changes, anything
+	// else that replaces the response is
+	notify := write || e.response != nil
 	e.eTag = eTag
-	e.maxAge = time.Second * time.Duration(maxAge)
+	e.maxAge = time.Second * time.Duration(cc.maxAge)
+	e.noStore = cc.noStore
+	e.noCache = cc.noCache
+	// responses fetched using a nonce or that the responder asked
+	// not to be stored are never written to disk
+	write = write && e.responseFilename != "" && !e.useNonce && !e.noStore
 	e.lastSync = e.clk.Now()
 	if resp != nil {
+		if resp.Status == ocsp.Revoked && (e.status != ocsp.Revoked || e.response == nil) {
+			e.warning(
+				"Certificate has been revoked at %s for reason %s",
+				resp.RevokedAt,
+				revocationReasonToString[resp.RevocationReason],
+			)
+		}
+		changed := !bytes.Equal(e.response, respBytes)
+		if changed {
+			responseStatuses.inc(statusToString[resp.Status])
+		}
+		notify = notify && changed
 		e.response = respBytes
+		e.synced = true
+		e.status = resp.Status
 		e.nextUpdate = resp.NextUpdate
 		e.thisUpdate = resp.ThisUpdate
-		if e.responseFilename != "" && write {
-			err := e.writeToDisk()
-			if err != nil {
-				return err
-			}
+		nextPublish, err := responseNextPublish(respBytes)
+		if err != nil {
+			e.warning("Ignoring NextPublish in response: %s", err)
+		}
+		// a NextPublish outside of the validity period is meaningless
+		if nextPublish.Before(resp.ThisUpdate) || nextPublish.After(resp.NextUpdate) {
+			nextPublish = time.Time{}
+		}
+		e.nextPublish = nextPublish
+		var event *responseEvent
+		if notify {
+			ev := e.responseEvent()
+			event = &ev
+		}
+		if !write {
+			return nil, event, nil
 		}
+		w, err := e.snapshotWrite(true)
+		return w, event, err
+	} else if write && e.response != nil {
+		// the response hasn't changed but the metadata may have
+		w, err := e.snapshotWrite(false)
+		return w, nil, err
 	}
-	return nil
+	return nil, nil, nil
+}
+
+// adoptFresherResponse replaces e's response, along with the caching
+// state that goes with it, with other's if other is for the same
+// certificate and its response is fresher, returning whether it did
+func (e *Entry) adoptFresherResponse(other *Entry) bool {
+	if e.serial == nil || other.serial == nil || e.serial.Cmp(other.serial) != 0 {
+		return false
+	}
+	if e.issuer != nil && other.issuer != nil && !bytes.Equal(e.issuer.Raw, other.issuer.Raw) {
+		return false
+	}
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	if other.response == nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.response != nil && !other.thisUpdate.After(e.thisUpdate) {
+		return false
+	}
+	e.response = other.response
+	e.synced = true
+	e.status = other.status
+	e.thisUpdate = other.thisUpdate
+	e.nextUpdate = other.nextUpdate
+	e.nextPublish = other.nextPublish
+	e.eTag = other.eTag
+	e.maxAge = other.maxAge
+	e.noStore = other.noStore
+	e.noCache = other.noCache
+	e.lastSync = other.lastSync
+	return true
+}
+
+// firstStale records that the stale response expiring at nextUpdate is
+// being served, or refused, returning whether it is the first time
+func (e *Entry) firstStale(refused bool, nextUpdate time.Time) bool {
+	// this is called for every request while the response is stale so
+	// the common case, where it has already been recorded, only needs a
+	// read lock
+	e.mu.RLock()
+	logged := e.staleServed
+	if refused {
+		logged = e.staleRefused
+	}
+	e.mu.RUnlock()
+	if logged.Equal(nextUpdate) {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	last := &e.staleServed
+	if refused {
+		last = &e.staleRefused
+	}
+	// another request may have recorded it since the check
+	if last.Equal(nextUpdate) {
+		return false
+	}
+	*last = nextUpdate
+	return true
+}
+
+// responseEvent describes the current response for hooks. Assumes the
+// caller holds a lock
+func (e *Entry) responseEvent() responseEvent {
+	event := responseEvent{
+		Name:       e.name,
+		Serial:     fmt.Sprintf("%X", e.serial),
+		Status:     statusToString[e.status],
+		ThisUpdate: e.thisUpdate,
+		NextUpdate: e.nextUpdate,
+	}
+	if _, isFile := e.storage().(fileStorage); isFile {
+		event.Filename = e.responseFilename
+	}
+	return event
 }
 
 // refreshResponse fetches and verifies a response and replaces
 // the current response if it is valid and newer
-func (e *Entry) refreshResponse() error {
+func (e *Entry) refreshResponse(parent context.Context) error {
+	// only one refresh should run at a time, if the previous one is
+	// still going there is no point in starting another
+	if !atomic.CompareAndSwapInt32(&e.refreshing, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&e.refreshing, 0)
+	if e.stoppedForExpiry() {
+		return nil
+	}
+	// entries using the CRL fallback still go through the usual
+	// failure path, which is what triggers the CRL check
+	if !e.crlFallback && e.lacksResponders() {
+		return nil
+	}
+	if e.backingOff() {
+		return nil
+	}
 	if !e.timeToUpdate() {
 		return nil
 	}
-	responder := randomResponder(e.responders)
-	e.info("Fetching response from %s", responder)
-	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	// another instance sharing the store may have already fetched
+	// a newer response, in which case there is no need to ask the
+	// responder for one
+	if e.refreshFromStore() && !e.timeToUpdate() {
+		return nil
+	}
+	return e.fetchAndUpdate(parent)
+}
+
+// refreshFromStore replaces the current response with the one in the
+// entry's shared store if it is newer, returning whether it did. Errors
+// talking to the store are logged and otherwise ignored so that the
+// entry falls back to fetching responses itself
+func (e *Entry) refreshFromStore() bool {
+	if !e.sharedStore() || e.responseFilename == "" || e.useNonce {
+		return false
+	}
+	respBytes, err := e.store.read(e.responseFilename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			e.err("Failed to read response from shared store: %s", err)
+		}
+		return false
+	}
+	respBytes, err = decodeStoredResponse(respBytes)
+	if err != nil {
+		e.err("Failed to decode response from shared store: %s", err)
+		return false
+	}
+	e.mu.RLock()
+	unchanged := bytes.Equal(respBytes, e.response)
+	e.mu.RUnlock()
+	if unchanged {
+		return false
+	}
+	resp, err := e.parseResponse(respBytes)
+	if err != nil {
+		e.err("Failed to parse response from shared store: %s", err)
+		return false
+	}
+	err = e.verifyResponse(resp, respBytes)
+	if err != nil {
+		e.err("Ignoring response from shared store: %s", err)
+		return false
+	}
+	cc := cacheControl{}
+	eTag := ""
+	metadata, err := e.readMetadata(e.responseFilename, respBytes)
+	if err != nil {
+		e.err("Failed to read response metadata from shared store: %s", err)
+	}
+	if metadata != nil {
+		eTag, cc = metadata.ETag, cacheControl{maxAge: metadata.MaxAge, noCache: metadata.NoCache}
+	}
+	err = e.updateResponse(eTag, cc, resp, respBytes, false)
+	if err != nil {
+		e.err("Failed to load response from shared store: %s", err)
+		return false
+	}
+	e.info("Loaded newer response from shared store")
+	return true
+}
+
+// lacksResponders returns whether the entry has no responders to fetch
+// responses from, which is a misconfiguration refreshing won't fix, so
+// it is only logged the first time
+func (e *Entry) lacksResponders() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.responders) > 0 {
+		return false
+	}
+	if !e.noRespondersLogged {
+		e.noRespondersLogged = true
+		e.err("Entry has no responders, it won't be refreshed until some are configured")
+	}
+	return true
+}
+
+// errRefreshInProgress is returned by forceRefresh if the entry is
+// already being refreshed
+var errRefreshInProgress = errors.New("refresh already in progress")
+
+// forceRefresh fetches and verifies a response, replacing the current
+// response if it is valid and newer, regardless of whether the entry is
+// backing off or in its update window
+func (e *Entry) forceRefresh(parent context.Context) error {
+	if !atomic.CompareAndSwapInt32(&e.refreshing, 0, 1) {
+		return errRefreshInProgress
+	}
+	defer atomic.StoreInt32(&e.refreshing, 0)
+	e.info("Forcing refresh")
+	return e.fetchAndUpdate(parent)
+}
+
+// fetchAndUpdate does the work of refreshResponse and forceRefresh, the
+// caller must have set refreshing
+func (e *Entry) fetchAndUpdate(parent context.Context) error {
+	if e.useNonce {
+		err := e.regenerateNonce()
+		if err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(parent, e.timeout)
 	defer cancel()
-	resp, respBytes, eTag, maxAge, err := e.fetchResponse(ctx, responder)
+	result, err := e.fetchWithRetries(ctx)
+	if err == errThrottled {
+		// nothing was sent so this isn't a failure, the refresh is
+		// just put off until the next time the entry is checked
+		refreshResults.inc("throttled")
+		return err
+	}
+	if _, older := err.(olderResponseError); older {
+		// the responder isn't failing so there's no backoff, the entry
+		// is refreshed again the next time it's checked
+		e.responderWarning(result.fetched.responder, "Ignoring response from '%s': %s", result.fetched.responder, err)
+		refreshResults.inc("older")
+		return nil
+	}
 	if err != nil {
+		refreshResults.inc("failure")
+		var notBefore time.Time
+		if fetchErr, ok := err.(*fetchError); ok {
+			notBefore = fetchErr.retryAfter
+		}
+		e.backOff(notBefore)
+		e.mu.RLock()
+		failures := e.failures
+		e.mu.RUnlock()
+		if e.crlFallback && (failures >= crlFallbackAfter || len(e.responders) == 0) {
+			e.checkCRL(parent)
+		}
 		return err
 	}
 
 	e.mu.RLock()
-	if resp == nil || bytes.Compare(respBytes, e.response) == 0 {
-		e.mu.RUnlock()
-		e.info("Response hasn't changed since last sync")
-		e.updateResponse(eTag, maxAge, nil, nil, true)
-		return nil
-	}
+	unchanged := result.resp == nil || bytes.Compare(result.respBytes, e.response) == 0
 	e.mu.RUnlock()
-	err = e.verifyResponse(resp)
+	if unchanged {
+		err = e.updateResponse(result.eTag, result.cc, nil, nil, true)
+	} else {
+		err = e.updateResponse(result.eTag, result.cc, result.resp, result.respBytes, true)
+	}
 	if err != nil {
+		// the response is served from memory regardless, but a refresh
+		// that couldn't be persisted isn't counted as a success
+		e.err("Failed to write response: %s", err)
+		refreshResults.inc("failure")
+		e.backOff(time.Time{})
 		return err
 	}
-	e.updateResponse(eTag, maxAge, resp, respBytes, true)
-	e.info("Response has been refreshed")
+	e.resetBackoff()
+	if unchanged {
+		e.info("Response hasn't changed since last sync")
+		refreshResults.inc("unchanged")
+		return nil
+	}
+	refreshResults.inc("success")
+	e.logRefreshed(result.resp, result.fetched)
 	return nil
 }
 
+// logRefreshed logs that the response has been replaced by resp, along
+// with where it came from, how long fetching it took, and when it will
+// next be updated
+func (e *Entry) logRefreshed(resp *ocsp.Response, fetched fetchDetails) {
+	if !e.log.enabled(syslog.LOG_INFO) {
+		return
+	}
+	fields := e.logFields(fetched.responder)
+	fields["duration"] = fetched.elapsed.String()
+	fields["next_update"] = resp.NextUpdate.UTC().Format(time.RFC3339)
+	e.log.logFields(syslog.LOG_INFO, fields, fmt.Sprintf(
+		"Response has been refreshed from '%s' in %s, next update at %s",
+		fetched.responder,
+		fetched.elapsed,
+		resp.NextUpdate.UTC().Format(time.RFC3339),
+	))
+}
+
+// backingOff checks if the entry is still waiting out the backoff
+// period from a previous failed refresh
+func (e *Entry) backingOff() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.failures > 0 && e.clk.Now().Before(e.nextRetry)
+}
+
+// backOff records a failed refresh and schedules the next attempt
+// using exponential backoff, starting at baseBackoff and doubling
+// for each consecutive failure up to maxBackoff. The wait is jittered
+// so entries that failed together don't all retry in lockstep, it
+// is extended to notBefore if that is later
+func (e *Entry) backOff(notBefore time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures++
+	backoff := e.baseBackoff
+	for i := 1; i < e.failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	backoff = backoff/2 + time.Duration(e.random().Int63n(int64(backoff/2)+1))
+	now := e.clk.Now()
+	// responders asking to not be retried until later win out over
+	// the normal backoff
+	if notBefore.After(now.Add(backoff)) {
+		backoff = notBefore.Sub(now)
+	}
+	e.nextRetry = now.Add(backoff)
+	e.info("Refresh failed %d times in a row, backing off for %s", e.failures, humanDuration(backoff))
+}
+
+// resetBackoff clears any backoff state after a successful refresh
+func (e *Entry) resetBackoff() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures = 0
+	e.nextRetry = time.Time{}
+}
+
 // refreshAndLog is a small wrapper around refreshResponse
 // for when a caller wants to run it in a goroutine and doesn't
 // want to handle the returned error itself
-func (e *Entry) refreshAndLog() {
-	err := e.refreshResponse()
+func (e *Entry) refreshAndLog(ctx context.Context) {
+	err := e.refreshResponse(ctx)
+	if err == errThrottled {
+		e.info("Refresh deferred, responders are being rate limited")
+		return
+	}
 	if err != nil {
-		e.err("Failed to refresh response", err)
+		e.err("Failed to refresh response: %s", err)
+	}
+}
+
+// expiredPolicy decides what happens to a entry once its certificate
+// has expired
+type expiredPolicy int
+
+const (
+	expiredServe  expiredPolicy = iota // keep refreshing and serving responses
+	expiredStop                        // stop refreshing, the current response is served until it goes stale
+	expiredRemove                      // remove the entry from the cache
+)
+
+var expiredPolicies = map[string]expiredPolicy{
+	"serve":  expiredServe,
+	"stop":   expiredStop,
+	"remove": expiredRemove,
+}
+
+// leafExpired returns whether the entry's certificate has expired, it
+// is always false for entries that weren't loaded from a certificate
+func (e *Entry) leafExpired() bool {
+	return !e.notAfter.IsZero() && e.clk.Now().After(e.notAfter)
+}
+
+// stoppedForExpiry returns whether the entry shouldn't be refreshed
+// because its certificate has expired, logging it the first time
+func (e *Entry) stoppedForExpiry() bool {
+	if e.expired == expiredServe || !e.leafExpired() {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.expiredLogged {
+		e.expiredLogged = true
+		e.warning("Certificate expired at %s, no longer refreshing its response", e.notAfter)
+	}
+	return true
+}
+
+// expiryWarningInterval is how often the warning about a certificate
+// that is about to expire is repeated
+const expiryWarningInterval = 24 * time.Hour
+
+// checkExpiry warns if the entry's certificate expires within the
+// expiry warning window, at most once every expiryWarningInterval
+func (e *Entry) checkExpiry() {
+	now := e.clk.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.expiryWarning <= 0 || e.notAfter.IsZero() || e.notAfter.Sub(now) > e.expiryWarning {
+		return
+	}
+	if !e.expiryWarned.IsZero() && now.Sub(e.expiryWarned) < expiryWarningInterval {
+		return
+	}
+	e.expiryWarned = now
+	certificateExpiryWarnings.inc(e.name)
+	if e.notAfter.Before(now) {
+		e.warning("Certificate expired at %s, %s ago", e.notAfter, humanDuration(now.Sub(e.notAfter)))
+		return
+	}
+	e.warning("Certificate expires at %s, in %s", e.notAfter, humanDuration(e.notAfter.Sub(now)))
+}
+
+// updateWindowBounds returns when the update window, the last
+// updateWindow of NextUpdate - ThisUpdate, starts and how long it
+// is. Assumes the caller holds a lock
+func (e *Entry) updateWindowBounds() (time.Time, time.Duration) {
+	fraction := e.updateWindow
+	if fraction == 0 {
+		fraction = defaultUpdateWindow
 	}
+	windowSize := time.Duration(float64(e.nextUpdate.Sub(e.thisUpdate)) * fraction)
+	return e.nextUpdate.Add(-windowSize), windowSize
 }
 
 // timeToUpdate checks if a current entry should be refreshed
@@ -472,11 +2142,16 @@ func (e *Entry) timeToUpdate() bool {
 	now := e.clk.Now()
 	e.mu.RLock()
 	defer e.mu.RUnlock()
-	// no response or nextUpdate is in the past
-	if e.response == nil || e.nextUpdate.Before(now) {
+	// no response or nextUpdate is in the past, or close enough that
+	// clients whose clocks are ahead of ours may think it is
+	if e.response == nil || e.nextUpdate.Before(now.Add(e.clockSkew)) {
 		e.info("Stale response, updating immediately")
 		return true
 	}
+	if e.noCache {
+		e.info("Responder asked for no-cache, revalidating")
+		return true
+	}
 	if e.maxAge > 0 {
 		// cache max age has expired
 		if e.lastSync.Add(e.maxAge).Before(now) {
@@ -485,17 +2160,26 @@ func (e *Entry) timeToUpdate() bool {
 		}
 	}
 
-	// update window is last quarter of NextUpdate - ThisUpdate
-	// TODO: support using NextPublish instead of ThisUpdate if provided
-	// in responses
-	windowSize := e.nextUpdate.Sub(e.thisUpdate) / 4
-	updateWindowStarts := e.nextUpdate.Add(-windowSize)
+	// if the responder said when it would publish a new response
+	// refresh as soon as it has instead of waiting for the window
+	if !e.nextPublish.IsZero() && !e.nextPublish.After(now) && e.lastSync.Before(e.nextPublish) {
+		e.info("Responder has published a new response, updating immediately")
+		return true
+	}
+
+	updateWindowStarts, windowSize := e.updateWindowBounds()
 	if updateWindowStarts.After(now) {
 		return false
 	}
+	// windows shorter than a second can't be randomly picked from
+	// below, which would panic, so just update
+	if windowSize < time.Second {
+		e.info("Time to update")
+		return true
+	}
 
 	// randomly pick time in update window
-	updateTime := updateWindowStarts.Add(time.Second * time.Duration(mrand.Intn(int(windowSize.Seconds()))))
+	updateTime := updateWindowStarts.Add(time.Second * time.Duration(e.random().Intn(int(windowSize.Seconds()))))
 	if updateTime.Before(now) {
 		e.info("Time to update")
 		return true
@@ -1,29 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"hash"
 	"io/ioutil"
+	"strings"
 )
 
 // ParseCertificate parses a certificate from either it's PEM
-// or DER form
+// or DER form, contents is first decoded as PEM and if that fails
+// it's assumed to be DER
 func ParseCertificate(contents []byte) (*x509.Certificate, error) {
-	certBytes := []byte{}
 	block, _ := pem.Decode(contents)
 	if block == nil {
-		certBytes = contents
-	} else {
-		if block.Type != "CERTIFICATE" {
-			return nil, fmt.Errorf("Invalid PEM type '%s'", block.Type)
+		cert, err := x509.ParseCertificate(contents)
+		if err != nil {
+			return nil, fmt.Errorf("not a PEM or DER encoded certificate: %s", err)
 		}
-		certBytes = block.Bytes
+		return cert, nil
+	}
+	if block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("Invalid PEM type '%s'", block.Type)
 	}
-	return x509.ParseCertificate(certBytes)
+	return x509.ParseCertificate(block.Bytes)
 }
 
 func ReadCertificate(filename string) (*x509.Certificate, error) {
@@ -34,6 +39,79 @@ func ReadCertificate(filename string) (*x509.Certificate, error) {
 	return ParseCertificate(contents)
 }
 
+// ParseCertificates parses either a single DER certificate or all of
+// the certificates in a PEM bundle, such as a chain distributed by a CA
+func ParseCertificates(contents []byte) ([]*x509.Certificate, error) {
+	block, rest := pem.Decode(contents)
+	if block == nil {
+		cert, err := x509.ParseCertificate(contents)
+		if err != nil {
+			return nil, fmt.Errorf("not a PEM or DER encoded certificate: %s", err)
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+	certs := []*x509.Certificate{}
+	for block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("Invalid PEM type '%s'", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+		block, rest = pem.Decode(rest)
+	}
+	return certs, nil
+}
+
+func ReadCertificates(filename string) ([]*x509.Certificate, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCertificates(contents)
+}
+
+// ParseInlineCertificates parses certificates included directly in the
+// configuration, either as PEM or as base64 encoded DER
+func ParseInlineCertificates(value string) ([]*x509.Certificate, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return ParseCertificates([]byte(value))
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+	if err != nil {
+		return nil, fmt.Errorf("not a PEM or base64 encoded certificate: %s", err)
+	}
+	return ParseCertificates(der)
+}
+
+// selectIssuer returns the certificate from candidates whose subject
+// matches the issuer of cert and that has signed it
+func selectIssuer(candidates []*x509.Certificate, cert *x509.Certificate) (*x509.Certificate, error) {
+	for _, candidate := range candidates {
+		if !bytes.Equal(candidate.RawSubject, cert.RawIssuer) {
+			continue
+		}
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("none of the %d issuer certificates issued the certificate, looking for '%s'", len(candidates), cert.Issuer.CommonName)
+}
+
+// ParseCRL parses a CRL from either it's PEM or DER form
+func ParseCRL(contents []byte) (*pkix.CertificateList, error) {
+	block, _ := pem.Decode(contents)
+	if block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("Invalid PEM type '%s'", block.Type)
+		}
+		contents = block.Bytes
+	}
+	return x509.ParseDERCRL(contents)
+}
+
 func hashNameAndPKI(h hash.Hash, name, pki []byte) ([]byte, []byte, error) {
 	h.Write(name)
 	nameHash := h.Sum(nil)
@@ -3,24 +3,127 @@ package main
 import (
 	"bytes"
 	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
 	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
 )
 
 func TestReadCertificate(t *testing.T) {
-	_, err := ReadCertificate("testdata/test-issuer.der")
+	fromDER, err := ReadCertificate("testdata/test-issuer.der")
 	if err != nil {
 		t.Fatalf("Failed to read DER certificate: %s", err)
 	}
-	_, err = ReadCertificate("testdata/test-issuer.pem")
+	fromPEM, err := ReadCertificate("testdata/test-issuer.pem")
 	if err != nil {
 		t.Fatalf("Failed to read PEM certificate: %s", err)
 	}
+	if !fromDER.Equal(fromPEM) {
+		t.Fatal("DER and PEM encodings of the same certificate were parsed differently")
+	}
+	_, err = ParseCertificate([]byte("neither PEM nor DER"))
+	if err == nil {
+		t.Fatal("ParseCertificate didn't fail with invalid contents")
+	}
+}
+
+func TestParseInlineCertificates(t *testing.T) {
+	issuer, err := ReadCertificate("testdata/test-issuer.der")
+	if err != nil {
+		t.Fatalf("Failed to read test issuer: %s", err)
+	}
+	pemContents, err := ioutil.ReadFile("testdata/test-issuer.pem")
+	if err != nil {
+		t.Fatalf("Failed to read test issuer: %s", err)
+	}
+	// line wrapped as it would be in a YAML block scalar
+	encoded := base64.StdEncoding.EncodeToString(issuer.Raw)
+	wrapped := encoded[:64] + "\n  " + encoded[64:] + "\n"
+	for _, value := range []string{string(pemContents), encoded, wrapped} {
+		certs, err := ParseInlineCertificates(value)
+		if err != nil {
+			t.Fatalf("Failed to parse inline certificate: %s", err)
+		}
+		if len(certs) != 1 || !certs[0].Equal(issuer) {
+			t.Fatalf("Inline certificate wasn't parsed the same as the file: %q", value)
+		}
+	}
+	_, err = ParseInlineCertificates("not base64!")
+	if err == nil {
+		t.Fatal("ParseInlineCertificates didn't fail with invalid contents")
+	}
+
+	e := NewEntry(NewLogger("", "", 10, clock.Default()), clock.Default(), time.Second, time.Second, 0)
+	err = e.FromCertDef(CertDefinition{Certificate: "testdata/test.der", IssuerPEM: string(pemContents)}, nil, "", TransportConfig{}, "")
+	if err != nil {
+		t.Fatalf("Failed to create entry with inline issuer: %s", err)
+	}
+	if !e.issuer.Equal(issuer) {
+		t.Fatal("Entry doesn't use the inline issuer")
+	}
+}
+
+func TestIssuerBundle(t *testing.T) {
+	issuer, key := testIssuer(t)
+	// has the same subject as issuer but a different key
+	impostor, _ := testIssuer(t)
+	other, _ := testIssuer(t)
+	leaf := testCertificate(t, issuer, key, 1)
+
+	bundle := func(certs ...*x509.Certificate) []byte {
+		contents := []byte{}
+		for _, cert := range certs {
+			contents = append(contents, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		return contents
+	}
+
+	certs, err := ParseCertificates(bundle(impostor, issuer))
+	if err != nil {
+		t.Fatalf("Failed to parse bundle: %s", err)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("Unexpected number of certificates in bundle: wanted 2, got %d", len(certs))
+	}
+	selected, err := selectIssuer(certs, leaf)
+	if err != nil {
+		t.Fatalf("Failed to select issuer from bundle: %s", err)
+	}
+	if !bytes.Equal(selected.Raw, issuer.Raw) {
+		t.Fatal("selectIssuer returned the wrong certificate")
+	}
+
+	certs, err = ParseCertificates(issuer.Raw)
+	if err != nil {
+		t.Fatalf("Failed to parse DER certificate: %s", err)
+	}
+	if len(certs) != 1 {
+		t.Fatalf("Unexpected number of certificates: wanted 1, got %d", len(certs))
+	}
+
+	certs, err = ParseCertificates(bundle(impostor, other))
+	if err != nil {
+		t.Fatalf("Failed to parse bundle: %s", err)
+	}
+	_, err = selectIssuer(certs, leaf)
+	if err == nil {
+		t.Fatal("selectIssuer didn't fail when no certificate in the bundle issued the leaf")
+	}
+
+	_, err = ParseCertificates(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}))
+	if err == nil {
+		t.Fatal("ParseCertificates didn't fail with a non-certificate PEM block")
+	}
 }
 
 func TestHashNameAndPKI(t *testing.T) {
 	issuer, err := ReadCertificate("testdata/test-issuer.der")
 	if err != nil {
-		t.Fatalf("Failed to read test issuer", err)
+		t.Fatalf("Failed to read test issuer: %s", err)
 	}
 	nameHash, pkiHash, err := hashNameAndPKI(crypto.SHA1.New(), issuer.RawSubject, issuer.RawSubjectPublicKeyInfo)
 	if err != nil {
@@ -1,28 +1,383 @@
 package main
 
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
 type CertDefinition struct {
 	Certificate            string
 	Name                   string
 	ResponseName           string
 	Issuer                 string
+	IssuerPEM              string `yaml:"issuer-pem"` // the issuer itself rather than a path, PEM or base64 DER
 	Serial                 string
 	Responders             []string
-	Proxy                  string
-	OverrideGlobalUpstream bool `yaml:"override-global-upstream"`
-	OverrideGlobalProxy    bool `yaml:"override-global-proxy"`
+	ResponderSelection     string `yaml:"responder-selection"`
+	Proxy                  string // or "direct" to never use a proxy, even if there is a global one
+	Timeout                string
+	Transport              TransportConfig
+	UseNonce               *bool   `yaml:"use-nonce"`
+	CRLFallback            *bool   `yaml:"crl-fallback"`
+	UpdateWindow           float64 `yaml:"update-window"`
+	OverrideGlobalUpstream *bool   `yaml:"override-global-upstream"`
+	OverrideGlobalProxy    *bool   `yaml:"override-global-proxy"`
+}
+
+// enabled returns whether a boolean definition setting is set to true,
+// unset ones are off
+func enabled(setting *bool) bool {
+	return setting != nil && *setting
+}
+
+// entryName returns the name of the entry that will be created
+// from the definition
+func (def CertDefinition) entryName() string {
+	if def.Certificate != "" {
+		return def.Certificate
+	}
+	return def.Name
+}
+
+// withDefaults returns def with any settings it doesn't set taken from
+// defaults. Which certificate the definition is for is never inherited,
+// the issuer and issuer-pem are inherited together, so a definition
+// with either doesn't get the other, and the transport is merged field
+// by field. Booleans are only inherited if the definition doesn't set
+// them, so a definition can set one to false to turn off a default
+func (def CertDefinition) withDefaults(defaults CertDefinition) CertDefinition {
+	if def.Issuer == "" && def.IssuerPEM == "" {
+		def.Issuer, def.IssuerPEM = defaults.Issuer, defaults.IssuerPEM
+	}
+	if len(def.Responders) == 0 {
+		def.Responders = defaults.Responders
+	}
+	if def.ResponderSelection == "" {
+		def.ResponderSelection = defaults.ResponderSelection
+	}
+	if def.Proxy == "" {
+		def.Proxy = defaults.Proxy
+	}
+	if def.Timeout == "" {
+		def.Timeout = defaults.Timeout
+	}
+	if def.UpdateWindow == 0 {
+		def.UpdateWindow = defaults.UpdateWindow
+	}
+	def.Transport = defaults.Transport.merge(def.Transport)
+	if def.UseNonce == nil {
+		def.UseNonce = defaults.UseNonce
+	}
+	if def.CRLFallback == nil {
+		def.CRLFallback = defaults.CRLFallback
+	}
+	if def.OverrideGlobalUpstream == nil {
+		def.OverrideGlobalUpstream = defaults.OverrideGlobalUpstream
+	}
+	if def.OverrideGlobalProxy == nil {
+		def.OverrideGlobalProxy = defaults.OverrideGlobalProxy
+	}
+	return def
+}
+
+// directProxy is the proxy a definition can use to talk to its
+// responders directly regardless of the global proxy
+const directProxy = "direct"
+
+// proxyURI returns the proxy the entry created from the definition
+// should use, an empty string meaning none. A definition using the
+// direct proxy never uses one, otherwise the global proxy is used
+// unless the definition overrides it, in which case its own is used
+func (def CertDefinition) proxyURI(globalProxy string) string {
+	switch {
+	case def.Proxy == directProxy:
+		return ""
+	case globalProxy != "" && !enabled(def.OverrideGlobalProxy):
+		return globalProxy
+	}
+	return def.Proxy
+}
+
+// fetcherGlobals are the global fetcher settings that, along with its
+// definition, determine how an entry is created
+type fetcherGlobals struct {
+	upstream  []string
+	proxy     string
+	transport TransportConfig
+}
+
+// checkUpdateWindow returns an error if the definition's update window
+// isn't a fraction of the validity period
+func (def CertDefinition) checkUpdateWindow() error {
+	if def.UpdateWindow < 0 || def.UpdateWindow > 1 {
+		return fmt.Errorf("update-window must be between 0 and 1, got %g", def.UpdateWindow)
+	}
+	return nil
+}
+
+// responderSelector returns the selector the definition names, nil if
+// it doesn't name one
+func (def CertDefinition) responderSelector() (responderSelector, error) {
+	if def.ResponderSelection == "" {
+		return nil, nil
+	}
+	selector, present := responderSelectors[def.ResponderSelection]
+	if !present {
+		return nil, fmt.Errorf("invalid responder selection '%s'", def.ResponderSelection)
+	}
+	return selector, nil
+}
+
+// requestTimeout returns the definition's timeout, fallback if it
+// doesn't set one
+func (def CertDefinition) requestTimeout(fallback time.Duration) (time.Duration, error) {
+	return parsePositiveDuration("timeout", def.Timeout, fallback)
+}
+
+// transportFrom returns the transport from pool that the entry created
+// from the definition should use to talk to its responders
+func (def CertDefinition) transportFrom(pool *transportPool, globalProxy string, globalTransport TransportConfig) (*http.Transport, error) {
+	return pool.get(globalTransport.merge(def.Transport), def.proxyURI(globalProxy))
+}
+
+// issuers returns the certificates in either the issuer file or the
+// inline issuer, nil if neither is set
+func (def CertDefinition) issuers() ([]*x509.Certificate, error) {
+	switch {
+	case def.Issuer != "" && def.IssuerPEM != "":
+		return nil, errors.New("only one of issuer and issuer-pem can be provided")
+	case def.Issuer != "":
+		return ReadCertificates(def.Issuer)
+	case def.IssuerPEM != "":
+		return ParseInlineCertificates(def.IssuerPEM)
+	}
+	return nil, nil
+}
+
+// TransportConfig tunes the HTTP transport used to talk to upstream
+// responders, durations are strings parsed with time.ParseDuration
+type TransportConfig struct {
+	DialTimeout         string `yaml:"dial-timeout"`
+	KeepAlive           string `yaml:"keep-alive"`
+	TLSHandshakeTimeout string `yaml:"tls-handshake-timeout"`
+	MaxIdleConns        int    `yaml:"max-idle-conns"`
+	ClientCertificate   string `yaml:"client-certificate"` // presented to responders that require client authentication
+	ClientKey           string `yaml:"client-key"`
+	RootCAs             string `yaml:"root-cas"` // PEM bundle used instead of the system roots to verify responders' TLS certificates
+}
+
+// merge returns tc with any fields set in override replaced
+func (tc TransportConfig) merge(override TransportConfig) TransportConfig {
+	if override.DialTimeout != "" {
+		tc.DialTimeout = override.DialTimeout
+	}
+	if override.KeepAlive != "" {
+		tc.KeepAlive = override.KeepAlive
+	}
+	if override.TLSHandshakeTimeout != "" {
+		tc.TLSHandshakeTimeout = override.TLSHandshakeTimeout
+	}
+	if override.MaxIdleConns != 0 {
+		tc.MaxIdleConns = override.MaxIdleConns
+	}
+	// the certificate and key only make sense as a pair
+	if override.ClientCertificate != "" || override.ClientKey != "" {
+		tc.ClientCertificate, tc.ClientKey = override.ClientCertificate, override.ClientKey
+	}
+	if override.RootCAs != "" {
+		tc.RootCAs = override.RootCAs
+	}
+	return tc
 }
 
 type FetcherConfig struct {
 	Timeout            string
-	BaseBackoff        string `yaml:"base-backoff"`
+	BaseBackoff        string  `yaml:"base-backoff"`
+	ClockSkew          string  `yaml:"clock-skew"`
+	StartupJitter      string  `yaml:"startup-jitter"`
+	MaxRefreshes       int     `yaml:"max-refreshes"`      // concurrent refreshes, unlimited if zero
+	HostRateLimit      float64 `yaml:"host-rate-limit"`    // requests per second to each responder host, unlimited if zero
+	HostRateBurst      int     `yaml:"host-rate-burst"`    // defaults to host-rate-limit
+	MaxResponseSize    int64   `yaml:"max-response-size"`  // bytes, defaults to 64KB
+	MinSignatureHash   string  `yaml:"min-signature-hash"` // weakest hash response signatures may use, e.g. sha256, any if empty
+	Retries            int     // times a failed fetch is retried before the refresh fails
+	AttemptTimeout     string  `yaml:"attempt-timeout"` // deadline for each request, timeout still applies to the whole refresh
 	Proxy              string
+	RefuseUnknown      bool `yaml:"refuse-unknown"`
+	Transport          TransportConfig
 	UpstreamResponders []string `yaml:"upstream-responders"`
+	AllowedResponders  []string `yaml:"allowed-responders"` // hosts responders may be on, any if empty
 }
 
 type CertificateDefinitions struct {
-	CertWatchFolder string `yaml:"cert-watch-folder"`
-	IssuerFolder    string `yaml:"issuer-folder"`
-	Certificates    []CertDefinition
+	CertWatchFolder  string         `yaml:"cert-watch-folder"`
+	IssuerFolder     string         `yaml:"issuer-folder"`
+	CertificateGlobs []string       `yaml:"certificate-globs"`
+	DefinitionsDir   string         `yaml:"definitions-dir"` // every .yaml or .yml file in it contains more certificate definitions
+	ExpiryWarning    string         `yaml:"expiry-warning"`  // warn when a certificate expires within this long
+	Expired          string         // serve, stop, or remove entries whose certificate has expired
+	Defaults         CertDefinition // settings inherited by every definition that doesn't set them itself
+	Certificates     []CertDefinition
+}
+
+// all returns the explicit certificate definitions followed by a
+// definition for each certificate matched by CertificateGlobs, all with
+// Defaults applied. Issuers for matched certificates are resolved using
+// their AIA information, unless there is a default issuer. Files that
+// can't be parsed as certificates are skipped, as are any certificates
+// with the same issuer and serial as one that has already been matched
+func (d CertificateDefinitions) all(log *Logger) []CertDefinition {
+	defs := []CertDefinition{}
+	for _, def := range d.Certificates {
+		defs = append(defs, def.withDefaults(d.Defaults))
+	}
+	seenFiles := make(map[string]struct{})
+	for _, def := range d.Certificates {
+		if def.Certificate != "" {
+			seenFiles[filepath.Clean(def.Certificate)] = struct{}{}
+		}
+	}
+	seenSerials := make(map[string]string)
+	for _, pattern := range d.CertificateGlobs {
+		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			pattern = filepath.Join(pattern, "*")
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Err("Invalid certificate glob '%s': %s", pattern, err)
+			continue
+		}
+		for _, filename := range matches {
+			filename = filepath.Clean(filename)
+			if _, present := seenFiles[filename]; present {
+				continue
+			}
+			if info, err := os.Stat(filename); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			cert, err := ReadCertificate(filename)
+			if err != nil {
+				log.Warning("Skipping '%s' matched by '%s', not a certificate: %s", filename, pattern, err)
+				continue
+			}
+			key := string(cert.RawIssuer) + cert.SerialNumber.String()
+			if first, present := seenSerials[key]; present {
+				log.Warning("Skipping '%s', it has the same serial as '%s'", filename, first)
+				continue
+			}
+			seenFiles[filename] = struct{}{}
+			seenSerials[key] = filename
+			defs = append(defs, CertDefinition{Certificate: filename}.withDefaults(d.Defaults))
+		}
+	}
+	return defs
+}
+
+// validate checks that an entry could be created from the definition
+// without contacting any upstream servers, returning every problem that
+// was found rather than just the first
+func (def CertDefinition) validate(globalUpstream []string, globalProxy string, globalTransport TransportConfig) []error {
+	errs := []error{}
+	responders := def.Responders
+	if len(globalUpstream) > 0 && !enabled(def.OverrideGlobalUpstream) {
+		responders = globalUpstream
+	}
+	hasAIAIssuer := false
+	var cert *x509.Certificate
+	if def.Certificate != "" {
+		var err error
+		cert, err = ReadCertificate(def.Certificate)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read certificate: %s", err))
+		} else {
+			if len(responders) == 0 {
+				responders = cert.OCSPServer
+			}
+			hasAIAIssuer = len(cert.IssuingCertificateURL) > 0
+		}
+	} else if def.Name != "" && def.Serial != "" {
+		if _, err := hex.DecodeString(def.Serial); err != nil {
+			errs = append(errs, fmt.Errorf("failed to decode serial '%s': %s", def.Serial, err))
+		}
+	} else {
+		errs = append(errs, errors.New("either certificate or name and serial must be provided"))
+	}
+	if def.Issuer != "" || def.IssuerPEM != "" {
+		issuers, err := def.issuers()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read issuer: %s", err))
+		} else if cert != nil {
+			if _, err := selectIssuer(issuers, cert); err != nil {
+				errs = append(errs, fmt.Errorf("failed to find issuer of certificate: %s", err))
+			}
+		}
+	} else if !hasAIAIssuer {
+		errs = append(errs, errors.New("either issuer or a certificate containing issuer AIA information must be provided"))
+	}
+	// if the certificate couldn't be read it's unknown whether it
+	// contains any responders, which has already been reported. With
+	// the CRL fallback a certificate's CRLs can stand in for them
+	crlOnly := enabled(def.CRLFallback) && cert != nil && len(cert.CRLDistributionPoints) > 0
+	if len(responders) == 0 && (def.Certificate == "" || cert != nil) && !crlOnly {
+		errs = append(errs, errors.New("no responders configured and certificate doesn't contain any"))
+	}
+	for _, responder := range responders {
+		u, err := url.Parse(responder)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid responder '%s'", responder))
+		}
+	}
+	if _, err := def.responderSelector(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := def.requestTimeout(time.Second); err != nil {
+		errs = append(errs, err)
+	}
+	if err := def.checkUpdateWindow(); err != nil {
+		errs = append(errs, err)
+	}
+	// a throwaway pool is used so that validating doesn't leave
+	// transports in the shared one
+	if _, err := def.transportFrom(newTransportPool(), globalProxy, globalTransport); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// validateDefinitions checks all of the definitions up front so that
+// every mistake in the configuration can be reported at once
+func validateDefinitions(defs []CertDefinition, globalUpstream []string, globalProxy string, globalTransport TransportConfig) error {
+	problems := []string{}
+	for _, def := range defs {
+		for _, err := range def.validate(globalUpstream, globalProxy, globalTransport) {
+			problems = append(problems, fmt.Sprintf("definition '%s': %s", def.entryName(), err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems with certificate definitions:\n\t%s", len(problems), strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// ResponderTLS configures serving the responder over HTTPS, the
+// certificate and key are reloaded on SIGHUP
+type ResponderTLS struct {
+	Certificate  string
+	Key          string
+	MinVersion   string   `yaml:"min-version"`   // 1.0, 1.1, 1.2 (the default), or 1.3
+	CipherSuites []string `yaml:"cipher-suites"` // crypto/tls names, Go's defaults if empty, no effect on TLS 1.3 connections
 }
 
 type Configuration struct {
@@ -33,19 +388,126 @@ type Configuration struct {
 	Syslog struct {
 		Network     string
 		Addr        string
-		StdoutLevel int `yaml:"stdout-level"`
+		StdoutLevel int    `yaml:"stdout-level"`
+		Format      string // text or json
+		Level       string // least severe level to log, e.g. warning
 	}
 	StatsAddr string `yaml:"stats-addr"`
 
+	// Hooks are notified whenever a entry's response changes
+	Hooks struct {
+		Command []string // run with a JSON description of the entry on stdin
+		Webhook string   // POSTed a JSON description of the entry
+		Timeout string   // how long each hook can take, defaults to 10s
+	}
+
 	HTTP struct {
-		Addr string
+		Addr           string
+		Addrs          []string // listened on as well as Addr, e.g. a IPv6 address
+		MaxRequestSize int64    `yaml:"max-request-size"`
+		MissResponse   string   `yaml:"miss-response"`
+		AdminToken     string   `yaml:"admin-token"`
+		StaleGrace     string   `yaml:"stale-grace"` // how long past NextUpdate responses are served, until they're replaced if unset
+		Socket         string
+		TLS            ResponderTLS
+	}
+
+	Cache struct {
+		LookupHashes []string `yaml:"lookup-hashes"`
+		MaxEntries   int      `yaml:"max-entries"`
+		Duplicates   string   // what to do when adding a entry that already exists, overwrite, reject, or merge
+		MonitorTick  string   `yaml:"monitor-tick"` // how often entries are checked to see if they need refreshing
 	}
 
 	Disk struct {
 		CacheFolder string `yaml:"cache-folder"`
+		Layout      string // flat or sharded
+		Encoding    string // der or base64, responses of either encoding are read
+		HTTPBackend string `yaml:"http-backend"`
+		Redis       string // address of a Redis server to share responses through
+	}
+
+	// Warmup pulls the current responses from another instance at
+	// start up, e.g. during a rolling deploy, rather than fetching them
+	// all from the responders
+	Warmup struct {
+		Peer    string // base URL of the peer's responder
+		Token   string // the peer's admin-token, if it has one
+		Timeout string // how long fetching from the peer can take, defaults to 10s
 	}
 
 	Fetcher FetcherConfig
 
 	Definitions CertificateDefinitions
 }
+
+// definitionsFile is the format of the files in definitions-dir
+type definitionsFile struct {
+	Certificates []CertDefinition
+}
+
+// loadDefinitionsDir appends the definitions in each of the YAML files
+// in DefinitionsDir, in filename order, to Certificates. Every
+// definition for a certificate that is already defined, either in the
+// main configuration or another file, is reported in the returned error
+func (d *CertificateDefinitions) loadDefinitionsDir() error {
+	if d.DefinitionsDir == "" {
+		return nil
+	}
+	filenames := []string{}
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(d.DefinitionsDir, pattern))
+		if err != nil {
+			return err
+		}
+		filenames = append(filenames, matches...)
+	}
+	sort.Strings(filenames)
+	definedIn := make(map[string]string)
+	for _, def := range d.Certificates {
+		definedIn[def.entryName()] = "the main configuration"
+	}
+	duplicates := []string{}
+	for _, filename := range filenames {
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		var file definitionsFile
+		err = yaml.Unmarshal(contents, &file)
+		if err != nil {
+			return fmt.Errorf("failed to parse '%s': %s", filename, err)
+		}
+		for _, def := range file.Certificates {
+			name := def.entryName()
+			// definitions without a name are reported by validate
+			if other, present := definedIn[name]; present && name != "" {
+				duplicates = append(duplicates, fmt.Sprintf("'%s' in '%s' is already defined in %s", name, filename, other))
+				continue
+			}
+			definedIn[name] = fmt.Sprintf("'%s'", filename)
+			d.Certificates = append(d.Certificates, def)
+		}
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("%d duplicate certificate definitions:\n\t%s", len(duplicates), strings.Join(duplicates, "\n\t"))
+	}
+	return nil
+}
+
+func loadConfig(filename string) (*Configuration, error) {
+	configBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration file '%s': %s", filename, err)
+	}
+	var config Configuration
+	err = yaml.Unmarshal(configBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse configuration file '%s': %s", filename, err)
+	}
+	err = config.Definitions.loadDefinitionsDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load definitions-dir: %s", err)
+	}
+	return &config, nil
+}
@@ -1 +1,297 @@
 package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmhodges/clock"
+)
+
+// setting returns a boolean definition setting set to b
+func setting(b bool) *bool {
+	return &b
+}
+
+func TestCertificateGlobs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stapled")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	cert, err := ioutil.ReadFile("testdata/test.der")
+	if err != nil {
+		t.Fatalf("Failed to read test certificate: %s", err)
+	}
+	issuer, err := ioutil.ReadFile("testdata/test-issuer.pem")
+	if err != nil {
+		t.Fatalf("Failed to read test issuer: %s", err)
+	}
+	for name, contents := range map[string][]byte{
+		"a.crt":      cert,
+		"b.crt":      cert, // duplicate serial
+		"issuer.pem": issuer,
+		"notes.txt":  []byte("not a certificate"),
+	} {
+		err = ioutil.WriteFile(filepath.Join(tmpDir, name), contents, os.ModePerm)
+		if err != nil {
+			t.Fatalf("Failed to write '%s': %s", name, err)
+		}
+	}
+	err = os.Mkdir(filepath.Join(tmpDir, "subdir"), os.ModePerm)
+	if err != nil {
+		t.Fatalf("Failed to create subdirectory: %s", err)
+	}
+
+	log := NewLogger("", "", 10, clock.NewFake())
+	explicit := CertDefinition{Certificate: filepath.Join(tmpDir, "issuer.pem"), Issuer: "testdata/test-issuer.der"}
+	for _, pattern := range []string{tmpDir, filepath.Join(tmpDir, "*")} {
+		defs := CertificateDefinitions{
+			CertificateGlobs: []string{pattern},
+			Certificates:     []CertDefinition{explicit},
+		}.all(log)
+		if len(defs) != 2 {
+			t.Fatalf("Unexpected number of definitions for '%s': wanted 2, got %d (%v)", pattern, len(defs), defs)
+		}
+		if defs[0].Certificate != explicit.Certificate {
+			t.Fatalf("Explicit definition wasn't kept first for '%s': %v", pattern, defs[0])
+		}
+		if expected := filepath.Join(tmpDir, "a.crt"); defs[1].Certificate != expected {
+			t.Fatalf("Unexpected definition for '%s': wanted %s, got %s", pattern, expected, defs[1].Certificate)
+		}
+	}
+}
+
+func TestValidateDefinitions(t *testing.T) {
+	issuerPEM, err := ioutil.ReadFile("testdata/test-issuer.pem")
+	if err != nil {
+		t.Fatalf("Failed to read test issuer: %s", err)
+	}
+	good := []CertDefinition{
+		{Certificate: "testdata/test.der", Issuer: "testdata/test-issuer.der"},
+		{Certificate: "testdata/test.der"},
+		{Name: "named", Serial: "FF", Issuer: "testdata/test-issuer.pem", Responders: []string{"http://ocsp.example.com"}},
+		{Certificate: "testdata/test.der", IssuerPEM: string(issuerPEM)},
+	}
+	err = validateDefinitions(good, nil, "", TransportConfig{})
+	if err != nil {
+		t.Fatalf("Valid definitions failed validation: %s", err)
+	}
+
+	bad := []CertDefinition{
+		{},
+		{Certificate: "testdata/missing.der"},
+		{Name: "bad-serial", Serial: "not hex", Issuer: "testdata/test-issuer.der", Responders: []string{"http://ocsp.example.com"}},
+		{Name: "no-responders", Serial: "FF", Issuer: "testdata/test-issuer.der"},
+		{Name: "bad-responder", Serial: "FF", Issuer: "testdata/test-issuer.der", Responders: []string{"ocsp.example.com"}},
+		{Certificate: "testdata/test.der", Issuer: "testdata/test.der", ResponderSelection: "best", UpdateWindow: 2},
+		{Name: "both-issuers", Serial: "FF", Issuer: "testdata/test-issuer.pem", IssuerPEM: string(issuerPEM), Responders: []string{"http://ocsp.example.com"}},
+		{Name: "bad-transport", Serial: "FF", Issuer: "testdata/test-issuer.der", Responders: []string{"http://ocsp.example.com"}, Transport: TransportConfig{DialTimeout: "soon"}},
+		{Name: "bad-proxy", Serial: "FF", Issuer: "testdata/test-issuer.der", Responders: []string{"http://ocsp.example.com"}, Proxy: "ftp://proxy.example.com"},
+	}
+	err = validateDefinitions(bad, nil, "", TransportConfig{})
+	if err == nil {
+		t.Fatal("Invalid definitions passed validation")
+	}
+	for _, problem := range []string{
+		"definition '': either certificate or name and serial must be provided",
+		"definition 'testdata/missing.der': failed to read certificate",
+		"definition 'bad-serial': failed to decode serial",
+		"definition 'no-responders': no responders configured",
+		"definition 'bad-responder': invalid responder",
+		"definition 'testdata/test.der': failed to find issuer",
+		"definition 'testdata/test.der': invalid responder selection",
+		"definition 'testdata/test.der': update-window must be between 0 and 1",
+		"definition 'both-issuers': failed to read issuer: only one of issuer and issuer-pem can be provided",
+		"definition 'bad-transport': failed to parse dial-timeout",
+		"definition 'bad-proxy': unsupported proxy scheme 'ftp'",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("Validation error doesn't contain '%s': %s", problem, err)
+		}
+	}
+
+	// global upstream responders cover definitions without their own
+	err = validateDefinitions([]CertDefinition{bad[3]}, []string{"http://upstream.example.com"}, "", TransportConfig{})
+	if err != nil {
+		t.Fatalf("Definition using global upstream responders failed validation: %s", err)
+	}
+}
+
+func TestValidateCRLOnlyDefinition(t *testing.T) {
+	issuer, key := testIssuer(t)
+	tmpDir, err := ioutil.TempDir("", "stapled")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	files := map[string][]byte{
+		"crl.der":    testCRLCertificate(t, issuer, key, 1, "http://crl.example.com").Raw,
+		"no-crl.der": testCertificate(t, issuer, key, 2).Raw,
+		"issuer.der": issuer.Raw,
+	}
+	for name, contents := range files {
+		err = ioutil.WriteFile(filepath.Join(tmpDir, name), contents, os.ModePerm)
+		if err != nil {
+			t.Fatalf("Failed to write '%s': %s", name, err)
+		}
+	}
+	def := func(certificate string, crlFallback bool) CertDefinition {
+		return CertDefinition{
+			Certificate: filepath.Join(tmpDir, certificate),
+			Issuer:      filepath.Join(tmpDir, "issuer.der"),
+			CRLFallback: setting(crlFallback),
+		}
+	}
+
+	err = validateDefinitions([]CertDefinition{def("crl.der", true)}, nil, "", TransportConfig{})
+	if err != nil {
+		t.Fatalf("Definition with CRLs and crl-fallback failed validation: %s", err)
+	}
+	for _, d := range []CertDefinition{def("crl.der", false), def("no-crl.der", true)} {
+		err = validateDefinitions([]CertDefinition{d}, nil, "", TransportConfig{})
+		if err == nil || !strings.Contains(err.Error(), "no responders configured") {
+			t.Fatalf("Definition without responders passed validation: %+v", d)
+		}
+	}
+}
+
+func TestDefinitionsDir(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stapled")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	confDir := filepath.Join(tmpDir, "conf.d")
+	err = os.Mkdir(confDir, os.ModePerm)
+	if err != nil {
+		t.Fatalf("Failed to create definitions directory: %s", err)
+	}
+	write := func(filename, contents string) {
+		err := ioutil.WriteFile(filename, []byte(contents), os.ModePerm)
+		if err != nil {
+			t.Fatalf("Failed to write '%s': %s", filename, err)
+		}
+	}
+	configFile := filepath.Join(tmpDir, "config.yaml")
+	write(configFile, "definitions:\n  definitions-dir: "+confDir+"\n  certificates:\n    - name: main\n      serial: \"01\"\n")
+	write(filepath.Join(confDir, "b.yml"), "certificates:\n  - name: service-b\n    serial: \"03\"\n")
+	write(filepath.Join(confDir, "a.yaml"), "certificates:\n  - name: service-a\n    serial: \"02\"\n  - certificate: certs/a.pem\n")
+	write(filepath.Join(confDir, "notes.txt"), "not yaml: [")
+
+	config, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %s", err)
+	}
+	names := []string{}
+	for _, def := range config.Definitions.Certificates {
+		names = append(names, def.entryName())
+	}
+	if expected := "main service-a certs/a.pem service-b"; strings.Join(names, " ") != expected {
+		t.Fatalf("Unexpected definitions: wanted %s, got %s", expected, strings.Join(names, " "))
+	}
+
+	write(filepath.Join(confDir, "c.yaml"), "certificates:\n  - name: service-a\n    serial: \"04\"\n  - name: main\n    serial: \"05\"\n")
+	_, err = loadConfig(configFile)
+	if err == nil {
+		t.Fatal("Configuration with duplicate definitions loaded")
+	}
+	for _, problem := range []string{
+		"'service-a' in '" + filepath.Join(confDir, "c.yaml") + "' is already defined in '" + filepath.Join(confDir, "a.yaml") + "'",
+		"'main' in '" + filepath.Join(confDir, "c.yaml") + "' is already defined in the main configuration",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("Error doesn't report '%s': %s", problem, err)
+		}
+	}
+
+	write(filepath.Join(confDir, "c.yaml"), "certificates: [")
+	_, err = loadConfig(configFile)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse") {
+		t.Fatalf("Unexpected error for invalid definitions file: %v", err)
+	}
+}
+
+func TestDefinitionDefaults(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stapled")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	configFile := filepath.Join(tmpDir, "config.yaml")
+	err = ioutil.WriteFile(configFile, []byte(`
+definitions:
+  defaults:
+    issuer: issuer.pem
+    responders:
+      - http://ocsp.example.com
+    proxy: http://proxy.example.com
+    timeout: 10s
+    use-nonce: true
+    crl-fallback: true
+    transport:
+      dial-timeout: 5s
+      max-idle-conns: 4
+  certificates:
+    - certificate: a.pem
+    - certificate: b.pem
+      issuer-pem: inline
+      responders:
+        - http://other.example.com
+      proxy: direct
+      transport:
+        dial-timeout: 1s
+    - certificate: c.pem
+      use-nonce: false
+      crl-fallback: false
+`), os.ModePerm)
+	if err != nil {
+		t.Fatalf("Failed to write configuration: %s", err)
+	}
+	config, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %s", err)
+	}
+	defs := config.Definitions.all(NewLogger("", "", 10, clock.NewFake()))
+	if len(defs) != 3 {
+		t.Fatalf("Unexpected number of definitions: %d", len(defs))
+	}
+
+	a := defs[0]
+	if a.Certificate != "a.pem" || a.Issuer != "issuer.pem" || a.Proxy != "http://proxy.example.com" || a.Timeout != "10s" || !enabled(a.UseNonce) || !enabled(a.CRLFallback) {
+		t.Fatalf("Definition didn't inherit defaults: %+v", a)
+	}
+	if len(a.Responders) != 1 || a.Responders[0] != "http://ocsp.example.com" {
+		t.Fatalf("Definition didn't inherit default responders: %v", a.Responders)
+	}
+	if a.Transport.DialTimeout != "5s" || a.Transport.MaxIdleConns != 4 {
+		t.Fatalf("Definition didn't inherit default transport: %+v", a.Transport)
+	}
+
+	b := defs[1]
+	if b.Certificate != "b.pem" || b.Issuer != "" || b.IssuerPEM != "inline" {
+		t.Fatalf("Definition with issuer-pem inherited default issuer: %+v", b)
+	}
+	if len(b.Responders) != 1 || b.Responders[0] != "http://other.example.com" || b.Proxy != directProxy {
+		t.Fatalf("Definition overrides were replaced by defaults: %+v", b)
+	}
+	if b.Transport.DialTimeout != "1s" || b.Transport.MaxIdleConns != 4 {
+		t.Fatalf("Transport wasn't merged field by field: %+v", b.Transport)
+	}
+
+	// booleans set to false in the definition turn off the defaults
+	c := defs[2]
+	if enabled(c.UseNonce) || enabled(c.CRLFallback) {
+		t.Fatalf("Definition couldn't turn off defaults: use-nonce %t, crl-fallback %t", enabled(c.UseNonce), enabled(c.CRLFallback))
+	}
+	if enabled(c.withDefaults(config.Definitions.Defaults).UseNonce) {
+		t.Fatal("Applying defaults again turned use-nonce back on")
+	}
+
+	// applying the defaults again doesn't change anything
+	if again := b.withDefaults(config.Definitions.Defaults); again.Issuer != b.Issuer || again.Transport != b.Transport {
+		t.Fatalf("Applying defaults twice changed the definition: %+v", again)
+	}
+}
@@ -0,0 +1,106 @@
+// Optional CRL based revocation checking for entries whose OCSP
+// responders are unavailable. The status found this way can't be
+// stapled, it's only used to report on the entry.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/context"
+)
+
+// crlFallbackAfter is the number of consecutive failed refreshes
+// after which the CRL is checked
+const crlFallbackAfter = 3
+
+// maxCRLSize is the largest CRL that will be downloaded
+const maxCRLSize = 32 << 20
+
+// fetchCRLStatus downloads the CRL from url, checks it was signed by
+// the entry's issuer and hasn't expired, and returns the status of the
+// entry's serial according to it
+func (e *Entry) fetchCRLStatus(ctx context.Context, url string) (int, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("got a non-200 response: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCRLSize+1))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read CRL: %s", err)
+	}
+	if len(body) > maxCRLSize {
+		return 0, fmt.Errorf("CRL is larger than %d bytes", maxCRLSize)
+	}
+	crl, err := ParseCRL(body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse CRL: %s", err)
+	}
+	err = e.issuer.CheckCRLSignature(crl)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CRL signature: %s", err)
+	}
+	if crl.HasExpired(e.clk.Now()) {
+		return 0, fmt.Errorf("CRL expired at %s", crl.TBSCertList.NextUpdate)
+	}
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		if revoked.SerialNumber.Cmp(e.serial) == 0 {
+			return ocsp.Revoked, nil
+		}
+	}
+	return ocsp.Good, nil
+}
+
+// checkCRL tries each of the entry's CRL distribution points until one
+// of them provides a status for the entry
+func (e *Entry) checkCRL(parent context.Context) {
+	ctx, cancel := context.WithTimeout(parent, e.timeout)
+	defer cancel()
+	for _, url := range e.crlURLs {
+		status, err := e.fetchCRLStatus(ctx, url)
+		if err != nil {
+			e.err("Failed to check CRL '%s': %s", url, err)
+			continue
+		}
+		e.mu.Lock()
+		e.crlStatus = status
+		e.crlChecked = e.clk.Now()
+		e.mu.Unlock()
+		if status == ocsp.Revoked {
+			e.warning("Certificate is revoked according to CRL '%s'", url)
+		} else {
+			e.info("Certificate isn't revoked according to CRL '%s'", url)
+		}
+		return
+	}
+}
+
+// crlOnly returns whether the entry has no responders but uses the CRL
+// fallback, in which case it never has a response and only reports the
+// status from its CRLs. Assumes the caller holds a read lock
+func (e *Entry) crlOnly() bool {
+	return e.crlFallback && len(e.responders) == 0
+}
+
+// crlStatusString returns the status found by the last successful
+// CRL check, or an empty string if it hasn't been checked. Assumes
+// the caller holds a read lock
+func (e *Entry) crlStatusString() string {
+	if e.crlChecked.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%s as of %s", statusToString[e.crlStatus], e.crlChecked.Format(time.RFC3339))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/context"
+)
+
+type x509Issuer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// testCRL creates a CRL signed by signer, valid for an hour either side
+// of now, revoking serials
+func testCRL(t *testing.T, clk clock.Clock, signer *x509Issuer, serials ...int64) []byte {
+	revoked := []pkix.RevokedCertificate{}
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: clk.Now()})
+	}
+	der, err := signer.cert.CreateCRL(rand.Reader, signer.key, revoked, clk.Now().Add(-time.Hour), clk.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create CRL: %s", err)
+	}
+	return der
+}
+
+// testCRLCertificate generates a certificate signed by issuer that lists
+// crlURL as its CRL distribution point and has no OCSP responders
+func testCRLCertificate(t *testing.T, issuer *x509.Certificate, issuerKey crypto.Signer, serial int64, crlURL string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "stapled test certificate"},
+		NotBefore:             time.Unix(0, 0),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		CRLDistributionPoints: []string{crlURL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %s", err)
+	}
+	return cert
+}
+
+func TestCRLFallback(t *testing.T) {
+	issuer, key := testIssuer(t)
+	otherIssuer, otherKey := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+
+	var crl []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(crl)
+	}))
+	defer srv.Close()
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, time.Second, 0)
+	e.name = "crl"
+	e.issuer = issuer
+	e.serial = big.NewInt(1337)
+	e.crlFallback = true
+	e.crlURLs = []string{srv.URL}
+
+	for _, tc := range []struct {
+		signer  *x509Issuer
+		serials []int64
+		checked bool
+		status  int
+	}{
+		{&x509Issuer{otherIssuer, otherKey}, []int64{1337}, false, 0},
+		{&x509Issuer{issuer, key}, []int64{1, 1337}, true, ocsp.Revoked},
+		{&x509Issuer{issuer, key}, []int64{1, 2}, true, ocsp.Good},
+	} {
+		// wait out any backoff from the last attempt
+		clk.Add(maxBackoff)
+		crl = testCRL(t, clk, tc.signer, tc.serials...)
+		err := e.refreshResponse(context.Background())
+		if err == nil {
+			t.Fatal("Refresh didn't fail for entry without responders")
+		}
+		if checked := !e.crlChecked.IsZero(); checked != tc.checked {
+			t.Fatalf("Unexpected CRL check result: wanted %t, got %t", tc.checked, checked)
+		}
+		if tc.checked && e.crlStatus != tc.status {
+			t.Fatalf("Unexpected CRL status: wanted %s, got %s", statusToString[tc.status], statusToString[e.crlStatus])
+		}
+	}
+
+	// the status shouldn't be checked if the fallback isn't enabled
+	e.crlFallback = false
+	e.crlChecked = time.Time{}
+	clk.Add(maxBackoff)
+	e.refreshResponse(context.Background())
+	if !e.crlChecked.IsZero() {
+		t.Fatal("CRL was checked without the fallback being enabled")
+	}
+}
+
+func TestCRLOnlyEntry(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	log := NewLogger("", "", 10, clk)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testCRL(t, clk, &x509Issuer{issuer, key}))
+	}))
+	defer srv.Close()
+
+	tmpDir, err := ioutil.TempDir("", "stapled")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	leaf := testCRLCertificate(t, issuer, key, 1337, srv.URL)
+	def := CertDefinition{
+		Certificate: filepath.Join(tmpDir, "crl-only.der"),
+		Issuer:      filepath.Join(tmpDir, "issuer.der"),
+		CRLFallback: setting(true),
+	}
+	for filename, contents := range map[string][]byte{def.Certificate: leaf.Raw, def.Issuer: issuer.Raw} {
+		err = ioutil.WriteFile(filename, contents, os.ModePerm)
+		if err != nil {
+			t.Fatalf("Failed to write '%s': %s", filename, err)
+		}
+	}
+
+	err = validateDefinitions([]CertDefinition{def}, nil, "", TransportConfig{})
+	if err != nil {
+		t.Fatalf("CRL only definition failed validation: %s", err)
+	}
+	e := NewEntry(log, clk, time.Second*5, time.Second, 0)
+	err = e.FromCertDef(def, nil, "", TransportConfig{}, tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to create entry from definition: %s", err)
+	}
+	err = e.Init()
+	if err != nil {
+		t.Fatalf("Failed to initialize CRL only entry: %s", err)
+	}
+	s, err := New(Options{log: log, clk: clk, clientTimeout: time.Second * 5, clientBackoff: time.Second, monitorTick: time.Minute}, []*Entry{e})
+	if err != nil {
+		t.Fatalf("Failed to create stapled with CRL only entry: %s", err)
+	}
+	defer s.c.stop()
+	report := s.health()
+	if len(report.Unhealthy) != 1 {
+		t.Fatalf("Unexpected number of unhealthy entries: wanted 1, got %d", len(report.Unhealthy))
+	}
+	if status := report.Unhealthy[0].CRLStatus; !strings.HasPrefix(status, "good as of ") {
+		t.Fatalf("Unexpected CRL status for CRL only entry: %q", status)
+	}
+}
@@ -0,0 +1,83 @@
+// Dry run of the fetch and verify flow for a single certificate, used
+// to debug responder problems without starting the server.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/context"
+)
+
+// DryRun builds the entry's request and fetches a response from each of
+// its responders in turn, verifying each one and describing every step
+// to w. Nothing is cached or written to disk. An error is returned if
+// any of the responders didn't return a valid response
+func (e *Entry) DryRun(ctx context.Context, w io.Writer) error {
+	err := e.prepare()
+	if err != nil {
+		return fmt.Errorf("failed to build request: %s", err)
+	}
+	fmt.Fprintf(w, "Certificate: %s\n", e.name)
+	fmt.Fprintf(w, "  Serial: %X\n", e.serial)
+	if e.issuer != nil {
+		fmt.Fprintf(w, "  Issuer: %s\n", e.issuer.Subject.CommonName)
+	}
+	fmt.Fprintf(w, "  Request: %s\n", base64.StdEncoding.EncodeToString(e.request))
+	if len(e.responders) == 0 {
+		return fmt.Errorf("no responders available")
+	}
+	failed := 0
+	for _, responder := range e.responders {
+		fmt.Fprintf(w, "Responder: %s\n", responder)
+		err := e.dryRunResponder(ctx, w, responder)
+		if err != nil {
+			fmt.Fprintf(w, "  Failed (%s): %s\n", failureClass(err), err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "  Response is valid\n")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d responders didn't return a valid response", failed, len(e.responders))
+	}
+	return nil
+}
+
+// dryRunResponder fetches and verifies a response from responder,
+// describing it to w
+func (e *Entry) dryRunResponder(ctx context.Context, w io.Writer, responder string) error {
+	if e.useNonce {
+		err := e.regenerateNonce()
+		if err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	started := time.Now()
+	resp, respBytes, _, _, err := e.fetchFrom(ctx, responder)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "  Fetched %d bytes in %s\n", len(respBytes), time.Since(started))
+	fmt.Fprintf(w, "  Status: %s\n", statusToString[resp.Status])
+	if resp.Status == ocsp.Revoked {
+		fmt.Fprintf(w, "  Revoked at: %s (%s)\n", resp.RevokedAt, revocationReasonToString[resp.RevocationReason])
+	}
+	fmt.Fprintf(w, "  Produced at: %s\n", resp.ProducedAt)
+	fmt.Fprintf(w, "  This update: %s\n", resp.ThisUpdate)
+	fmt.Fprintf(w, "  Next update: %s\n", resp.NextUpdate)
+	if resp.Certificate != nil {
+		fmt.Fprintf(w, "  Signed by: %s (serial %X)\n", resp.Certificate.Subject.CommonName, resp.Certificate.SerialNumber)
+	}
+	err = e.verifyResponse(resp, respBytes)
+	if err != nil {
+		return classifiedError{failureVerify, err}
+	}
+	return nil
+}
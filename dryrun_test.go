@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/context"
+)
+
+func TestDryRun(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testResponse(t, issuer, key, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(1),
+			ThisUpdate:   clk.Now().Add(-time.Hour),
+			NextUpdate:   clk.Now().Add(time.Hour),
+		}, nil))
+	}))
+	defer good.Close()
+	stale := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testResponse(t, issuer, key, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(1),
+			ThisUpdate:   clk.Now().Add(-time.Hour * 2),
+			NextUpdate:   clk.Now().Add(-time.Hour),
+		}, nil))
+	}))
+	defer stale.Close()
+
+	newEntry := func(responders ...string) *Entry {
+		e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, time.Second, 0)
+		e.name = "test.der"
+		e.issuer = issuer
+		e.serial = big.NewInt(1)
+		e.client = new(http.Client)
+		e.responders = responders
+		e.responseFilename = "should-not-exist.resp"
+		return e
+	}
+
+	e := newEntry(good.URL)
+	out := new(bytes.Buffer)
+	err := e.DryRun(context.Background(), out)
+	if err != nil {
+		t.Fatalf("Dry run against valid responder failed: %s\n%s", err, out)
+	}
+	for _, expected := range []string{"Certificate: test.der", "Responder: " + good.URL, "Status: good", "Response is valid"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Dry run output doesn't contain '%s':\n%s", expected, out)
+		}
+	}
+	if e.response != nil {
+		t.Fatal("Dry run cached the response")
+	}
+
+	out.Reset()
+	err = newEntry(good.URL, stale.URL).DryRun(context.Background(), out)
+	if err == nil {
+		t.Fatal("Dry run with a responder returning a stale response didn't fail")
+	}
+	if !strings.Contains(out.String(), "stale OCSP response") {
+		t.Fatalf("Dry run output doesn't contain the verification error:\n%s", out)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// responseEvent describes a entry whose response has changed, it is
+// sent to hooks as JSON
+type responseEvent struct {
+	Name       string    `json:"name"`
+	Serial     string    `json:"serial"`
+	Status     string    `json:"status"`
+	ThisUpdate time.Time `json:"this-update"`
+	NextUpdate time.Time `json:"next-update"`
+	Filename   string    `json:"filename,omitempty"` // where the response is cached, if it is
+}
+
+// hookQueueSize is how many events can be waiting to be delivered
+// before new ones are dropped
+const hookQueueSize = 100
+
+// responseHook notifies external systems, e.g. to reload a server
+// stapling responses, when a response changes by running a command
+// and/or POSTing to a webhook. Events are delivered in order by a
+// single goroutine so a slow hook never blocks refreshes, if it falls
+// too far behind events are dropped
+type responseHook struct {
+	command []string
+	webhook string
+	timeout time.Duration
+	client  *http.Client
+	log     *Logger
+	events  chan responseEvent
+
+	quit     chan struct{} // closed by stop to tell deliver to exit
+	done     chan struct{} // closed by deliver once it has exited
+	stopOnce sync.Once
+}
+
+func newResponseHook(command []string, webhook string, timeout time.Duration, log *Logger) *responseHook {
+	h := &responseHook{
+		command: command,
+		webhook: webhook,
+		timeout: timeout,
+		client:  &http.Client{Timeout: timeout},
+		log:     log,
+		events:  make(chan responseEvent, hookQueueSize),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go h.deliver()
+	return h
+}
+
+// fire queues a event for delivery without waiting for it to be
+// delivered, it is safe to call on a nil hook
+func (h *responseHook) fire(event responseEvent) {
+	if h == nil {
+		return
+	}
+	select {
+	case h.events <- event:
+	default:
+		h.log.Warning("[hook] Dropping event for '%s', %d events are already waiting", event.Name, hookQueueSize)
+	}
+}
+
+// stop waits for the event being delivered, if there is one, and stops
+// delivering events, any that are still queued are dropped. It is safe
+// to call on a nil hook and more than once
+func (h *responseHook) stop() {
+	if h == nil {
+		return
+	}
+	h.stopOnce.Do(func() { close(h.quit) })
+	<-h.done
+}
+
+func (h *responseHook) deliver() {
+	defer close(h.done)
+	for {
+		select {
+		case <-h.quit:
+			return
+		case event := <-h.events:
+			h.deliverEvent(event)
+		}
+	}
+}
+
+func (h *responseHook) deliverEvent(event responseEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		h.log.Err("[hook] Failed to marshal event for '%s': %s", event.Name, err)
+		return
+	}
+	if len(h.command) > 0 {
+		err = h.run(body)
+		if err != nil {
+			h.log.Err("[hook] Command failed for '%s': %s", event.Name, err)
+		}
+	}
+	if h.webhook != "" {
+		err = h.post(body)
+		if err != nil {
+			h.log.Err("[hook] Webhook failed for '%s': %s", event.Name, err)
+		}
+	}
+}
+
+// run executes the command with the event on stdin, killing it if it
+// runs for longer than the timeout
+func (h *responseHook) run(body []byte) error {
+	cmd := exec.Command(h.command[0], h.command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	timer := time.AfterFunc(h.timeout, func() { cmd.Process.Kill() })
+	defer timer.Stop()
+	return cmd.Wait()
+}
+
+func (h *responseHook) post(body []byte) error {
+	resp, err := h.client.Post(h.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got a non-2xx response: %d", resp.StatusCode)
+	}
+	return nil
+}
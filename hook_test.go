@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestResponseHook(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	logger := NewLogger("", "", 10, clk)
+	events := make(chan responseEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event responseEvent
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil {
+			t.Errorf("Failed to decode event: %s", err)
+		}
+		events <- event
+	}))
+	defer srv.Close()
+	tmpDir, err := ioutil.TempDir("", "stapled-hook")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	output := filepath.Join(tmpDir, "event.json")
+
+	e := NewEntry(logger, clk, time.Second, time.Second, 0)
+	e.name = "example"
+	e.serial = big.NewInt(1337)
+	e.hook = newResponseHook([]string{"sh", "-c", "cat > " + output}, srv.URL, time.Second, logger)
+	makeResponse := func(thisUpdate time.Time) (*ocsp.Response, []byte) {
+		respBytes := testResponse(t, issuer, key, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(1337),
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   thisUpdate.Add(time.Hour),
+		}, nil)
+		resp, err := ocsp.ParseResponse(respBytes, issuer)
+		if err != nil {
+			t.Fatalf("Failed to parse response: %s", err)
+		}
+		return resp, respBytes
+	}
+
+	// loading a response at start up isn't a change
+	resp, respBytes := makeResponse(clk.Now().Add(-time.Hour))
+	e.updateResponse("", cacheControl{}, resp, respBytes, false)
+	// neither is fetching the same response again
+	e.updateResponse("", cacheControl{}, resp, respBytes, true)
+	resp, respBytes = makeResponse(clk.Now())
+	e.updateResponse("", cacheControl{}, resp, respBytes, true)
+
+	select {
+	case event := <-events:
+		if event.Name != "example" || event.Serial != "539" || event.Status != "good" {
+			t.Fatalf("Unexpected event: %#v", event)
+		}
+		if !event.NextUpdate.Equal(resp.NextUpdate) {
+			t.Fatalf("Unexpected next update, expected %s, got %s", resp.NextUpdate, event.NextUpdate)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook wasn't called")
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("Unexpected second event: %#v", event)
+	default:
+	}
+	// the command runs before the webhook is sent
+	contents, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Command wasn't run: %s", err)
+	}
+	var event responseEvent
+	err = json.Unmarshal(contents, &event)
+	if err != nil || event.Name != "example" {
+		t.Fatalf("Command got unexpected event %q: %v", contents, err)
+	}
+}
+
+func TestResponseHookDoesntBlock(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+	h := newResponseHook(nil, srv.URL, time.Minute, NewLogger("", "", 10, clock.NewFake()))
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < hookQueueSize*2; i++ {
+			h.fire(responseEvent{Name: "example"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Firing events blocked on a hung webhook")
+	}
+}
+
+func TestResponseHookAfterWrite(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	logger := NewLogger("", "", 10, clk)
+	logger.stdout = ioutil.Discard
+	tmpDir, err := ioutil.TempDir("", "stapled-hook")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	copied := filepath.Join(tmpDir, "copied.resp")
+
+	e := NewEntry(logger, clk, time.Second, time.Second, 0)
+	e.name = "example"
+	e.serial = big.NewInt(1337)
+	e.responseFilename = filepath.Join(tmpDir, "example.resp")
+	// the command copies the cached response, which should already be
+	// the new one
+	e.hook = newResponseHook([]string{"cp", e.responseFilename, copied}, "", time.Second, logger)
+	respBytes := testResponse(t, issuer, key, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1337),
+		ThisUpdate:   clk.Now(),
+		NextUpdate:   clk.Now().Add(time.Hour),
+	}, nil)
+	resp, err := ocsp.ParseResponse(respBytes, issuer)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %s", err)
+	}
+	err = e.updateResponse("", cacheControl{}, resp, respBytes, true)
+	if err != nil {
+		t.Fatalf("Failed to update response: %s", err)
+	}
+	// stopping waits for the event that is being delivered
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		contents, err := ioutil.ReadFile(copied)
+		if err == nil {
+			if !bytes.Equal(contents, respBytes) {
+				t.Fatal("Hook ran before the new response was written")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Hook command wasn't run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	e.hook.stop()
+	e.hook.stop()
+	e.hook.fire(responseEvent{Name: "after-stop"})
+	var nilHook *responseHook
+	nilHook.stop()
+}
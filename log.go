@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/syslog"
 	"os"
 	"path"
+	"sync/atomic"
+	"time"
 
 	"github.com/jmhodges/clock"
 )
@@ -13,6 +17,9 @@ type Logger struct {
 	SyslogWriter *syslog.Writer
 	stdoutLevel  int
 	clk          clock.Clock
+	json         bool  // emit structured JSON lines instead of plain text
+	level        int32 // least severe syslog.Priority that is logged, accessed atomically
+	stdout       io.Writer
 }
 
 const defaultPriority = syslog.LOG_INFO | syslog.LOG_LOCAL0
@@ -25,16 +32,104 @@ func NewLogger(network, addr string, level int, clk clock.Clock) *Logger {
 	if err != nil {
 		panic(err)
 	}
-	return &Logger{syslogger, level, clk}
+	return &Logger{
+		SyslogWriter: syslogger,
+		stdoutLevel:  level,
+		clk:          clk,
+		level:        int32(syslog.LOG_DEBUG),
+		stdout:       os.Stdout,
+	}
+}
+
+// SetFormat sets the format log lines are written in, either "text"
+// (the default) or "json"
+func (log *Logger) SetFormat(format string) error {
+	switch format {
+	case "", "text":
+		log.json = false
+	case "json":
+		log.json = true
+	default:
+		return fmt.Errorf("invalid log format '%s'", format)
+	}
+	return nil
+}
+
+var levelNames = map[syslog.Priority]string{
+	syslog.LOG_EMERG:   "emerg",
+	syslog.LOG_ALERT:   "alert",
+	syslog.LOG_CRIT:    "crit",
+	syslog.LOG_ERR:     "err",
+	syslog.LOG_WARNING: "warning",
+	syslog.LOG_NOTICE:  "notice",
+	syslog.LOG_INFO:    "info",
+	syslog.LOG_DEBUG:   "debug",
+}
+
+// SetLevel sets the least severe level that will be logged, messages
+// for less severe levels are dropped before they are formatted. It is
+// safe to call while the logger is in use
+func (log *Logger) SetLevel(name string) error {
+	if name == "" {
+		atomic.StoreInt32(&log.level, int32(syslog.LOG_DEBUG))
+		return nil
+	}
+	for level, levelName := range levelNames {
+		if levelName == name {
+			atomic.StoreInt32(&log.level, int32(level))
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log level '%s'", name)
+}
+
+// enabled checks if messages at level should be logged
+func (log *Logger) enabled(level syslog.Priority) bool {
+	return int32(level) <= atomic.LoadInt32(&log.level)
+}
+
+// logFields logs msg along with a set of structured fields. In the text
+// format only the entry field is included, as a prefix to the message,
+// since the rest are generally already part of the message
+func (log *Logger) logFields(level syslog.Priority, fields map[string]string, msg string) {
+	if !log.json {
+		if entry, present := fields["entry"]; present {
+			msg = fmt.Sprintf("[entry:%s] %s", entry, msg)
+		}
+		log.write(level, msg)
+		return
+	}
+	line := map[string]string{
+		"time":    log.clk.Now().UTC().Format(time.RFC3339),
+		"level":   levelNames[level],
+		"message": msg,
+	}
+	for k, v := range fields {
+		line[k] = v
+	}
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		// can't really happen with a map of strings
+		encoded = []byte(msg)
+	}
+	log.write(level, string(encoded))
 }
 
 func (log *Logger) logAtLevel(level syslog.Priority, msg string) {
+	log.logFields(level, nil, msg)
+}
+
+func (log *Logger) write(level syslog.Priority, msg string) {
 	if int(level) <= log.stdoutLevel {
-		fmt.Printf("%s %11s %s\n",
-			log.clk.Now().Format("15:04:05"),
-			path.Base(os.Args[0]),
-			msg,
-		)
+		if log.json {
+			fmt.Fprintln(log.stdout, msg)
+		} else {
+			fmt.Fprintf(log.stdout, "%s %11s %s\n",
+				log.clk.Now().Format("15:04:05"),
+				path.Base(os.Args[0]),
+				msg,
+			)
+		}
 	}
 
 	switch level {
@@ -58,77 +153,57 @@ func (log *Logger) logAtLevel(level syslog.Priority, msg string) {
 }
 
 func (log *Logger) Alert(msg string, args ...interface{}) {
+	if !log.enabled(syslog.LOG_ALERT) {
+		return
+	}
 	log.logAtLevel(syslog.LOG_ALERT, fmt.Sprintf(msg, args...))
 }
 
 func (log *Logger) Crit(msg string, args ...interface{}) {
+	if !log.enabled(syslog.LOG_CRIT) {
+		return
+	}
 	log.logAtLevel(syslog.LOG_CRIT, fmt.Sprintf(msg, args...))
 }
 
 func (log *Logger) Debug(msg string, args ...interface{}) {
+	if !log.enabled(syslog.LOG_DEBUG) {
+		return
+	}
 	log.logAtLevel(syslog.LOG_DEBUG, fmt.Sprintf(msg, args...))
 }
 
 func (log *Logger) Emerg(msg string, args ...interface{}) {
+	if !log.enabled(syslog.LOG_EMERG) {
+		return
+	}
 	log.logAtLevel(syslog.LOG_EMERG, fmt.Sprintf(msg, args...))
 }
 
 func (log *Logger) Err(msg string, args ...interface{}) {
+	if !log.enabled(syslog.LOG_ERR) {
+		return
+	}
 	log.logAtLevel(syslog.LOG_ERR, fmt.Sprintf(msg, args...))
 }
 
 func (log *Logger) Info(msg string, args ...interface{}) {
+	if !log.enabled(syslog.LOG_INFO) {
+		return
+	}
 	log.logAtLevel(syslog.LOG_INFO, fmt.Sprintf(msg, args...))
 }
 
 func (log *Logger) Warning(msg string, args ...interface{}) {
+	if !log.enabled(syslog.LOG_WARNING) {
+		return
+	}
 	log.logAtLevel(syslog.LOG_WARNING, fmt.Sprintf(msg, args...))
 }
 
 func (log *Logger) Notice(msg string, args ...interface{}) {
+	if !log.enabled(syslog.LOG_NOTICE) {
+		return
+	}
 	log.logAtLevel(syslog.LOG_NOTICE, fmt.Sprintf(msg, args...))
 }
-
-type responderLogger struct {
-	l *Logger
-}
-
-func (rl *responderLogger) Alert(msg string) error {
-	rl.l.Alert("[responder] " + msg)
-	return nil
-}
-
-func (rl *responderLogger) Crit(msg string) error {
-	rl.l.Crit("[responder] " + msg)
-	return nil
-}
-
-func (rl *responderLogger) Debug(msg string) error {
-	rl.l.Debug("[responder] " + msg)
-	return nil
-}
-
-func (rl *responderLogger) Emerg(msg string) error {
-	rl.l.Emerg("[responder] " + msg)
-	return nil
-}
-
-func (rl *responderLogger) Err(msg string) error {
-	rl.l.Err("[responder] " + msg)
-	return nil
-}
-
-func (rl *responderLogger) Info(msg string) error {
-	rl.l.Info("[responder] " + msg)
-	return nil
-}
-
-func (rl *responderLogger) Warning(msg string) error {
-	rl.l.Warning("[responder] " + msg)
-	return nil
-}
-
-func (rl *responderLogger) Notice(msg string) error {
-	rl.l.Notice("[responder] " + msg)
-	return nil
-}
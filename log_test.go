@@ -1 +1,111 @@
 package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/jmhodges/clock"
+)
+
+func TestJSONLogging(t *testing.T) {
+	clk := clock.NewFake()
+	log := NewLogger("", "", 10, clk)
+	buf := new(bytes.Buffer)
+	log.stdout = buf
+	e := NewEntry(log, clk, 0, 0, 0)
+	e.name = "test.der"
+	e.serial = big.NewInt(1337)
+
+	e.info("hello %s", "world")
+	if line := buf.String(); !strings.HasSuffix(line, "[entry:test.der] hello world\n") {
+		t.Fatalf("Unexpected text log line: %q", line)
+	}
+
+	err := log.SetFormat("xml")
+	if err == nil {
+		t.Fatal("SetFormat didn't fail with invalid format")
+	}
+	err = log.SetFormat("json")
+	if err != nil {
+		t.Fatalf("Failed to set JSON format: %s", err)
+	}
+	for _, tc := range []struct {
+		log    func()
+		fields map[string]string
+	}{
+		{
+			func() { log.Warning("plain %d", 1) },
+			map[string]string{"level": "warning", "message": "plain 1"},
+		},
+		{
+			func() { e.err("failed: %s", "oops") },
+			map[string]string{"level": "err", "message": "failed: oops", "entry": "test.der", "serial": "539"},
+		},
+		{
+			func() { e.responderInfo("http://ocsp.example.com", "sending") },
+			map[string]string{"level": "info", "message": "sending", "entry": "test.der", "serial": "539", "responder": "http://ocsp.example.com"},
+		},
+	} {
+		buf.Reset()
+		tc.log()
+		var line map[string]string
+		err = json.Unmarshal(buf.Bytes(), &line)
+		if err != nil {
+			t.Fatalf("Failed to parse JSON log line %q: %s", buf.String(), err)
+		}
+		if _, present := line["time"]; !present {
+			t.Fatalf("JSON log line is missing time: %q", buf.String())
+		}
+		delete(line, "time")
+		if len(line) != len(tc.fields) {
+			t.Fatalf("Unexpected fields in JSON log line: wanted %v, got %v", tc.fields, line)
+		}
+		for k, v := range tc.fields {
+			if line[k] != v {
+				t.Fatalf("Unexpected value for %s in JSON log line: wanted %q, got %q", k, v, line[k])
+			}
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	clk := clock.NewFake()
+	log := NewLogger("", "", 10, clk)
+	buf := new(bytes.Buffer)
+	log.stdout = buf
+	e := NewEntry(log, clk, 0, 0, 0)
+	e.name = "test.der"
+
+	err := log.SetLevel("chatty")
+	if err == nil {
+		t.Fatal("SetLevel didn't fail with invalid level")
+	}
+	err = log.SetLevel("warning")
+	if err != nil {
+		t.Fatalf("Failed to set level: %s", err)
+	}
+	log.Info("dropped")
+	e.info("dropped")
+	log.Debug("dropped")
+	if buf.Len() != 0 {
+		t.Fatalf("Messages below the threshold were logged: %q", buf.String())
+	}
+	log.Warning("kept")
+	e.err("kept")
+	if lines := strings.Count(buf.String(), "kept\n"); lines != 2 {
+		t.Fatalf("Unexpected number of messages at or above the threshold: wanted 2, got %d (%q)", lines, buf.String())
+	}
+
+	buf.Reset()
+	err = log.SetLevel("")
+	if err != nil {
+		t.Fatalf("Failed to reset level: %s", err)
+	}
+	log.Debug("kept")
+	if buf.Len() == 0 {
+		t.Fatal("Debug message wasn't logged after resetting level")
+	}
+}
@@ -1,92 +1,475 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/jmhodges/clock"
-	"gopkg.in/yaml.v2"
+	"golang.org/x/net/context"
 )
 
-func main() {
-	configFilename := "example.yaml"
+// override returns flagValue if it is set, otherwise the value of the
+// environment variable envName if it is set, otherwise value
+func override(flagValue, envName, value string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if env := os.Getenv(envName); env != "" {
+		return env
+	}
+	return value
+}
 
-	configBytes, err := ioutil.ReadFile(configFilename)
+// validateAddr checks that addr is a valid host:port listen address
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read configuration file '%s': %s", configFilename, err)
-		os.Exit(1)
+		return err
+	}
+	_, err = net.LookupPort("tcp", port)
+	return err
+}
+
+// importResponse imports the response in filename for the entry
+// whose certificate is certificate
+func importResponse(entries []*Entry, certificate, filename string) error {
+	if certificate == "" {
+		return errors.New("-certificate must be provided")
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
 	}
-	var config Configuration
-	err = yaml.Unmarshal(configBytes, &config)
+	for _, e := range entries {
+		if filepath.Clean(e.name) == filepath.Clean(certificate) {
+			return e.ImportResponse(contents)
+		}
+	}
+	return fmt.Errorf("no definition for certificate '%s'", certificate)
+}
+
+// dryRunDefinition returns the definition for certificate, or if there
+// isn't one a definition which relies on the certificate's AIA
+// information and the global settings
+func dryRunDefinition(defs []CertDefinition, certificate string) CertDefinition {
+	for _, def := range defs {
+		if def.Certificate != "" && filepath.Clean(def.Certificate) == filepath.Clean(certificate) {
+			return def
+		}
+	}
+	return CertDefinition{Certificate: certificate}
+}
+
+func main() {
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and certificate definitions then exit without starting")
+	configFlag := flag.String("config", "", "Path to the configuration file, overrides $STAPLED_CONFIG (default \"example.yaml\")")
+	httpAddrFlag := flag.String("http-addr", "", "Address for the responder to listen on, overrides $STAPLED_HTTP_ADDR and http.addr")
+	cacheFolderFlag := flag.String("cache-folder", "", "Folder to cache responses in, overrides $STAPLED_CACHE_FOLDER and disk.cache-folder")
+	importFlag := flag.String("import-response", "", "Verify a OCSP response file and write it to the cache for the definition given by -certificate then exit")
+	certificateFlag := flag.String("certificate", "", "Certificate of the definition the response passed to -import-response is for, or to fetch with -dry-run")
+	dryRunFlag := flag.Bool("dry-run", false, "Fetch and verify a response for the certificate given by -certificate from each responder, printing the results, then exit")
+	flag.Parse()
+	configFilename := override(*configFlag, "STAPLED_CONFIG", "example.yaml")
+
+	config, err := loadConfig(configFilename)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to parse configuration file: %s", err)
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
+	config.HTTP.Addr = override(*httpAddrFlag, "STAPLED_HTTP_ADDR", config.HTTP.Addr)
+	config.Disk.CacheFolder = override(*cacheFolderFlag, "STAPLED_CACHE_FOLDER", config.Disk.CacheFolder)
 
 	clk := clock.Default()
 	logger := NewLogger(config.Syslog.Network, config.Syslog.Addr, config.Syslog.StdoutLevel, clk)
+	err = logger.SetFormat(config.Syslog.Format)
+	if err != nil {
+		logger.Err("Failed to set log format: %s", err)
+		os.Exit(1)
+	}
+	err = logger.SetLevel(config.Syslog.Level)
+	if err != nil {
+		logger.Err("Failed to set log level: %s", err)
+		os.Exit(1)
+	}
+
+	httpAddrs := config.HTTP.Addrs
+	if config.HTTP.Addr != "" {
+		httpAddrs = append([]string{config.HTTP.Addr}, httpAddrs...)
+	}
+	seenAddrs := make(map[string]bool)
+	for _, addr := range httpAddrs {
+		err = validateAddr(addr)
+		if err != nil {
+			logger.Err("Invalid HTTP address '%s': %s", addr, err)
+			os.Exit(1)
+		}
+		if seenAddrs[addr] {
+			logger.Err("HTTP address '%s' is listed more than once", addr)
+			os.Exit(1)
+		}
+		seenAddrs[addr] = true
+	}
 
 	baseBackoff := time.Second * time.Duration(10)
 	timeout := time.Second * time.Duration(10)
+	clockSkew := time.Minute * time.Duration(5)
 	if config.Fetcher.BaseBackoff != "" {
-		backoffSeconds, err := time.ParseDuration(config.Fetcher.BaseBackoff)
+		baseBackoff, err = time.ParseDuration(config.Fetcher.BaseBackoff)
 		if err != nil {
 			logger.Err("Failed to parse base-backoff: %s", err)
 			os.Exit(1)
 		}
-		baseBackoff = time.Second * time.Duration(backoffSeconds)
 	}
 	if config.Fetcher.Timeout != "" {
-		timeoutSeconds, err := time.ParseDuration(config.Fetcher.Timeout)
+		timeout, err = time.ParseDuration(config.Fetcher.Timeout)
 		if err != nil {
 			logger.Err("Failed to parse timeout: %s", err)
 			os.Exit(1)
 		}
-		timeout = time.Second * time.Duration(timeoutSeconds)
+	}
+	if config.Fetcher.ClockSkew != "" {
+		clockSkew, err = time.ParseDuration(config.Fetcher.ClockSkew)
+		if err != nil {
+			logger.Err("Failed to parse clock-skew: %s", err)
+			os.Exit(1)
+		}
+		if clockSkew < 0 {
+			logger.Err("clock-skew can't be negative, got %s", config.Fetcher.ClockSkew)
+			os.Exit(1)
+		}
+	}
+	var startupJitter time.Duration
+	if config.Fetcher.StartupJitter != "" {
+		startupJitter, err = time.ParseDuration(config.Fetcher.StartupJitter)
+		if err != nil {
+			logger.Err("Failed to parse startup-jitter: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.Disk.CacheFolder != "" {
+		err = os.MkdirAll(config.Disk.CacheFolder, 0755)
+		if err != nil {
+			logger.Err("Failed to create cache-folder: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	shardResponses := false
+	switch config.Disk.Layout {
+	case "", "flat":
+	case "sharded":
+		shardResponses = true
+	default:
+		logger.Err("Invalid disk layout '%s', must be flat or sharded", config.Disk.Layout)
+		os.Exit(1)
+	}
+
+	base64Responses := false
+	switch config.Disk.Encoding {
+	case "", "der":
+	case "base64":
+		base64Responses = true
+	default:
+		logger.Err("Invalid disk encoding '%s', must be der or base64", config.Disk.Encoding)
+		os.Exit(1)
+	}
+
+	var store storage
+	switch {
+	case config.Disk.HTTPBackend != "" && config.Disk.Redis != "":
+		logger.Err("Only one of http-backend and redis can be used")
+		os.Exit(1)
+	case config.Disk.HTTPBackend != "":
+		transport, err := newTransport(config.Fetcher.Transport, config.Fetcher.Proxy)
+		if err != nil {
+			logger.Err("Failed to create transport for http-backend: %s", err)
+			os.Exit(1)
+		}
+		store = newHTTPStorage(config.Disk.HTTPBackend, timeout, transport)
+	case config.Disk.Redis != "":
+		store = newRedisStorage(config.Disk.Redis, timeout)
+	}
+
+	var limiter *hostLimiter
+	if config.Fetcher.HostRateLimit < 0 || config.Fetcher.HostRateBurst < 0 {
+		logger.Err("host-rate-limit and host-rate-burst can't be negative")
+		os.Exit(1)
+	}
+	if config.Fetcher.HostRateLimit > 0 {
+		limiter = newHostLimiter(clk, config.Fetcher.HostRateLimit, config.Fetcher.HostRateBurst)
+	}
+
+	maxResponseSize := int64(defaultMaxResponseSize)
+	if config.Fetcher.MaxResponseSize < 0 {
+		logger.Err("max-response-size can't be negative")
+		os.Exit(1)
+	}
+	if config.Fetcher.MaxResponseSize > 0 {
+		maxResponseSize = config.Fetcher.MaxResponseSize
+	}
+
+	minSignatureHash, err := parseMinSignatureHash(config.Fetcher.MinSignatureHash)
+	if err != nil {
+		logger.Err("Invalid min-signature-hash: %s", err)
+		os.Exit(1)
+	}
+
+	if config.Fetcher.Retries < 0 {
+		logger.Err("retries can't be negative")
+		os.Exit(1)
+	}
+	attemptTimeout, err := parsePositiveDuration("attempt-timeout", config.Fetcher.AttemptTimeout, 0)
+	if err != nil {
+		logger.Err("Invalid fetcher configuration: %s", err)
+		os.Exit(1)
+	}
+
+	expiryWarning, err := parsePositiveDuration("expiry-warning", config.Definitions.ExpiryWarning, 0)
+	if err != nil {
+		logger.Err("Invalid definitions configuration: %s", err)
+		os.Exit(1)
+	}
+
+	expired := expiredServe
+	if config.Definitions.Expired != "" {
+		policy, present := expiredPolicies[config.Definitions.Expired]
+		if !present {
+			logger.Err("Invalid expired policy '%s', must be serve, stop, or remove", config.Definitions.Expired)
+			os.Exit(1)
+		}
+		expired = policy
+	}
+
+	var hook *responseHook
+	if len(config.Hooks.Command) > 0 || config.Hooks.Webhook != "" {
+		hookTimeout, err := parsePositiveDuration("hooks timeout", config.Hooks.Timeout, 10*time.Second)
+		if err != nil {
+			logger.Err("Invalid hooks configuration: %s", err)
+			os.Exit(1)
+		}
+		hook = newResponseHook(config.Hooks.Command, config.Hooks.Webhook, hookTimeout, logger)
+	}
+
+	staleGrace, err := parsePositiveDuration("stale-grace", config.HTTP.StaleGrace, 0)
+	if err != nil {
+		logger.Err("Invalid HTTP configuration: %s", err)
+		os.Exit(1)
+	}
+
+	duplicates := duplicatesOverwrite
+	if config.Cache.Duplicates != "" {
+		policy, present := duplicatePolicies[config.Cache.Duplicates]
+		if !present {
+			logger.Err("Invalid duplicates policy '%s', must be overwrite, reject, or merge", config.Cache.Duplicates)
+			os.Exit(1)
+		}
+		duplicates = policy
+	}
+
+	monitorTick, err := parsePositiveDuration("monitor-tick", config.Cache.MonitorTick, defaultMonitorTick)
+	if err != nil {
+		logger.Err("Invalid cache configuration: %s", err)
+		os.Exit(1)
+	}
+
+	lookupHashes, err := parseLookupHashes(config.Cache.LookupHashes)
+	if err != nil {
+		logger.Err("Failed to parse lookup-hashes: %s", err)
+		os.Exit(1)
+	}
+
+	defs := config.Definitions.all(logger)
+	err = validateDefinitions(defs, config.Fetcher.UpstreamResponders, config.Fetcher.Proxy, config.Fetcher.Transport)
+	if err != nil {
+		logger.Err("Invalid configuration: %s", err)
+		os.Exit(1)
+	}
+	if *checkConfig {
+		logger.Info("Configuration is valid")
+		os.Exit(0)
+	}
+	if *dryRunFlag {
+		if *certificateFlag == "" {
+			logger.Err("-certificate must be provided with -dry-run")
+			os.Exit(1)
+		}
+		defs = []CertDefinition{dryRunDefinition(defs, *certificateFlag).withDefaults(config.Definitions.Defaults)}
+	}
+
+	opts := Options{
+		log:                    logger,
+		clk:                    clk,
+		httpAddr:               config.HTTP.Addr,
+		statsAddr:              config.StatsAddr,
+		maxRequestSize:         config.HTTP.MaxRequestSize,
+		missBehaviour:          config.HTTP.MissResponse,
+		adminToken:             config.HTTP.AdminToken,
+		socketPath:             config.HTTP.Socket,
+		additionalAddrs:        config.HTTP.Addrs,
+		staleGrace:             staleGrace,
+		dontDieOnStaleResponse: config.DontDieOnStaleResponse,
+		certFolder:             config.Definitions.CertWatchFolder,
+		clientTimeout:          timeout,
+		clientBackoff:          baseBackoff,
+		clientClockSkew:        clockSkew,
+		refuseUnknown:          config.Fetcher.RefuseUnknown,
+		upstreamResponders:     config.Fetcher.UpstreamResponders,
+		allowedResponders:      config.Fetcher.AllowedResponders,
+		limiter:                limiter,
+		maxResponseSize:        maxResponseSize,
+		minSignatureHash:       minSignatureHash,
+		expiryWarning:          expiryWarning,
+		expired:                expired,
+		retries:                config.Fetcher.Retries,
+		attemptTimeout:         attemptTimeout,
+		cacheFolder:            config.Disk.CacheFolder,
+		shardResponses:         shardResponses,
+		base64Responses:        base64Responses,
+		store:                  store,
+		hook:                   hook,
+		monitorTick:            monitorTick,
+		lookupHashes:           lookupHashes,
+		maxEntries:             config.Cache.MaxEntries,
+		maxRefreshes:           config.Fetcher.MaxRefreshes,
+		duplicates:             duplicates,
 	}
 
 	logger.Info("Loading definitions")
 	entries := []*Entry{}
-	for _, def := range config.Definitions.Certificates {
-		e := NewEntry(logger, clk, timeout, baseBackoff)
-		err = e.FromCertDef(def, config.Fetcher.UpstreamResponders, config.Fetcher.Proxy, config.Disk.CacheFolder)
+	for _, def := range defs {
+		e := opts.newEntry()
+		err = e.FromCertDef(def, config.Fetcher.UpstreamResponders, config.Fetcher.Proxy, config.Fetcher.Transport, config.Disk.CacheFolder)
 		if err != nil {
 			logger.Err("Failed to populate entry: %s", err)
 			os.Exit(1)
 		}
-		err = e.Init()
+		if e.expired == expiredRemove && e.leafExpired() && !*dryRunFlag {
+			logger.Warning("Skipping definition for '%s', the certificate expired at %s", e.name, e.notAfter)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if *dryRunFlag {
+		err = entries[0].DryRun(context.Background(), os.Stdout)
 		if err != nil {
-			logger.Err("Failed to initialize entry: %s", err)
+			logger.Err("Dry run failed: %s", err)
 			os.Exit(1)
 		}
-		entries = append(entries, e)
+		os.Exit(0)
+	}
+	if *importFlag != "" {
+		err = importResponse(entries, *certificateFlag, *importFlag)
+		if err != nil {
+			logger.Err("Failed to import response: %s", err)
+			os.Exit(1)
+		}
+		logger.Info("Imported response from %s", *importFlag)
+		os.Exit(0)
+	}
+	if config.Warmup.Peer != "" {
+		warmupTimeout, err := parsePositiveDuration("warmup timeout", config.Warmup.Timeout, defaultWarmupTimeout)
+		if err != nil {
+			logger.Err("Invalid warmup configuration: %s", err)
+			os.Exit(1)
+		}
+		err = checkPeer(config.Warmup.Peer, config.Warmup.Token)
+		if err != nil {
+			logger.Err("Invalid warmup configuration: %s", err)
+			os.Exit(1)
+		}
+		transport, err := sharedTransports.get(config.Fetcher.Transport, config.Fetcher.Proxy)
+		if err != nil {
+			logger.Err("Failed to create transport for warmup: %s", err)
+			os.Exit(1)
+		}
+		warmFromPeer(logger, transport, config.Warmup.Peer, config.Warmup.Token, warmupTimeout, entries)
+	}
+	for i, err := range initEntries(entries, startupJitter) {
+		if err != nil {
+			if !config.DontDieOnStaleResponse {
+				logger.Err("Failed to initialize entry '%s': %s", entries[i].name, err)
+				os.Exit(1)
+			}
+			logger.Warning("Failed to initialize entry '%s', continuing without a response: %s", entries[i].name, err)
+		}
+	}
+
+	// the TLS certificate is only loaded once it's needed, so that the
+	// one-shot modes above work without it
+	if config.HTTP.TLS.Certificate != "" || config.HTTP.TLS.Key != "" {
+		opts.tlsConfig, opts.tlsKeyPair, err = newTLSConfig(config.HTTP.TLS)
+		if err != nil {
+			logger.Err("Invalid TLS configuration: %s", err)
+			os.Exit(1)
+		}
+		if opts.tlsConfig.MinVersion < tls.VersionTLS12 {
+			logger.Warning("TLS min-version %s is deprecated, consider 1.2 or 1.3", config.HTTP.TLS.MinVersion)
+		}
 	}
 
 	logger.Info("Initializing stapled")
-	s, err := New(
-		logger,
-		clk,
-		config.HTTP.Addr,
-		timeout,
-		baseBackoff,
-		1*time.Minute,
-		config.Fetcher.UpstreamResponders,
-		config.Disk.CacheFolder,
-		config.DontDieOnStaleResponse,
-		config.Definitions.CertWatchFolder,
-		entries,
-	)
+	s, err := New(opts, entries)
 	if err != nil {
 		logger.Err("Failed to initialize stapled: %s", err)
 		os.Exit(1)
 	}
 
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGHUP)
+		for range sigChan {
+			logger.Info("Caught SIGHUP, reloading certificate definitions and TLS certificate")
+			config, err := loadConfig(configFilename)
+			if err != nil {
+				logger.Err("Failed to reload configuration: %s", err)
+				continue
+			}
+			err = logger.SetLevel(config.Syslog.Level)
+			if err != nil {
+				logger.Err("Failed to set log level: %s", err)
+			}
+			s.reloadDefinitions(config.Definitions.all(logger), config.Fetcher.UpstreamResponders, config.Fetcher.Proxy, config.Fetcher.Transport)
+			// other TLS settings can't be changed without restarting
+			if s.tlsKeyPair != nil {
+				err = s.tlsKeyPair.load(config.HTTP.TLS.Certificate, config.HTTP.TLS.Key)
+				if err != nil {
+					logger.Err("Failed to reload TLS certificate, keeping the current one: %s", err)
+				} else {
+					logger.Info("Reloaded TLS certificate")
+				}
+			}
+		}
+	}()
+
+	stopped := make(chan struct{})
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigChan
+		logger.Info("Caught %s, shutting down", sig)
+		err := s.Stop()
+		if err != nil {
+			logger.Err("Failed to cleanly stop stapled: %s", err)
+		}
+		close(stopped)
+	}()
+
 	logger.Info("Running stapled")
 	err = s.Run()
 	if err != nil {
 		logger.Err("stapled failed: %s", err)
 		os.Exit(1)
 	}
+	<-stopped
+	logger.Info("stapled stopped")
 }
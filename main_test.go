@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestOverride(t *testing.T) {
+	os.Unsetenv("STAPLED_TEST_OVERRIDE")
+	if v := override("", "STAPLED_TEST_OVERRIDE", "config"); v != "config" {
+		t.Fatalf("Unexpected value without flag or environment: wanted config, got %s", v)
+	}
+	os.Setenv("STAPLED_TEST_OVERRIDE", "env")
+	defer os.Unsetenv("STAPLED_TEST_OVERRIDE")
+	if v := override("", "STAPLED_TEST_OVERRIDE", "config"); v != "env" {
+		t.Fatalf("Environment didn't override configuration: got %s", v)
+	}
+	if v := override("flag", "STAPLED_TEST_OVERRIDE", "config"); v != "flag" {
+		t.Fatalf("Flag didn't override environment: got %s", v)
+	}
+}
+
+func TestValidateAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:8080", ":http", "[::1]:443"} {
+		if err := validateAddr(addr); err != nil {
+			t.Fatalf("Valid address '%s' was rejected: %s", addr, err)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1", "localhost:notaport", "127.0.0.1:99999"} {
+		if err := validateAddr(addr); err == nil {
+			t.Fatalf("Invalid address '%s' was accepted", addr)
+		}
+	}
+}
+
+func TestDryRunDefinition(t *testing.T) {
+	defs := []CertDefinition{
+		{Name: "example.com", Serial: "01"},
+		{Certificate: "certs/cert.pem", Issuer: "certs/issuer.pem"},
+	}
+	if def := dryRunDefinition(defs, "./certs/cert.pem"); def.Issuer != "certs/issuer.pem" {
+		t.Fatalf("Definition for the certificate wasn't used: %+v", def)
+	}
+	if def := dryRunDefinition(defs, "other.pem"); def.Certificate != "other.pem" || def.Issuer != "" {
+		t.Fatalf("Unexpected definition for a certificate without one: %+v", def)
+	}
+}
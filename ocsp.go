@@ -4,10 +4,20 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	mrand "math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -50,19 +60,344 @@ func humanDuration(d time.Duration) string {
 }
 
 var statusToString = map[int]string{
-	0: "Success",
-	1: "Malformed",
-	2: "InternalError",
-	3: "TryLater",
-	5: "SignatureRequired",
-	6: "Unauthorized",
+	ocsp.Good:    "good",
+	ocsp.Revoked: "revoked",
+	ocsp.Unknown: "unknown",
 }
 
-func (e *Entry) verifyResponse(resp *ocsp.Response) error {
+var revocationReasonToString = map[int]string{
+	ocsp.Unspecified:          "unspecified",
+	ocsp.KeyCompromise:        "keyCompromise",
+	ocsp.CACompromise:         "cACompromise",
+	ocsp.AffiliationChanged:   "affiliationChanged",
+	ocsp.Superseded:           "superseded",
+	ocsp.CessationOfOperation: "cessationOfOperation",
+	ocsp.CertificateHold:      "certificateHold",
+	ocsp.RemoveFromCRL:        "removeFromCRL",
+	ocsp.PrivilegeWithdrawn:   "privilegeWithdrawn",
+	ocsp.AACompromise:         "aACompromise",
+}
+
+// nonceLength is the number of random bytes used for request nonces
+const nonceLength = 16
+
+var idPKIXOCSPNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+// idNextPublish is Microsoft's NextPublish extension, RFC 6960 doesn't
+// define a way for responders to say when they will next publish so
+// this is the one CryptoAPI pre-fetching, which the update scheduling
+// is based on, understands
+var idNextPublish = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 21, 4}
+
+// idPKIXOCSPNoCheck marks a delegated responder certificate as one
+// whose own revocation status shouldn't be checked, RFC 6960 Section
+// 4.2.2.2.1
+var idPKIXOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+// oidSignatureRSAPSS and oidSignatureEd25519 identify the signature
+// algorithms golang.org/x/crypto/ocsp doesn't recognise, RFC 4055
+// Section 3.1 and RFC 8410 Section 3
+var (
+	oidSignatureRSAPSS  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidSignatureEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// pssHashes maps the hash identified in RSASSA-PSS parameters to the
+// matching signature algorithm
+var pssHashes = []struct {
+	oid  asn1.ObjectIdentifier
+	algo x509.SignatureAlgorithm
+}{
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}, x509.SHA256WithRSAPSS},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}, x509.SHA384WithRSAPSS},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}, x509.SHA512WithRSAPSS},
+}
+
+// pssParameters is the RSASSA-PSS-params structure from RFC 4055
+// Section 3.1
+type pssParameters struct {
+	Hash         pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF          pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:1"`
+	SaltLength   int                      `asn1:"optional,explicit,tag:2,default:20"`
+	TrailerField int                      `asn1:"optional,explicit,tag:3,default:1"`
+}
+
+// The following mirror the ASN.1 structures used internally by
+// golang.org/x/crypto/ocsp but also include the request and response
+// extensions, which it doesn't expose. See RFC 6960 section 4.
+
+type extendedRequest struct {
+	TBSRequest extendedTBSRequest
+}
+
+type extendedTBSRequest struct {
+	Version           int              `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName     pkix.RDNSequence `asn1:"explicit,tag:1,optional"`
+	RequestList       []asn1.RawValue
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type extendedResponse struct {
+	Status   asn1.Enumerated
+	Response extendedResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type extendedResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type extendedBasicResponse struct {
+	TBSResponseData    extendedResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type extendedResponseData struct {
+	Version            int           `asn1:"optional,default:1,explicit,tag:0"`
+	RawResponderName   asn1.RawValue `asn1:"optional,explicit,tag:1"`
+	KeyHash            []byte        `asn1:"optional,explicit,tag:2"`
+	ProducedAt         time.Time     `asn1:"generalized"`
+	Responses          []asn1.RawValue
+	ResponseExtensions []pkix.Extension `asn1:"optional,explicit,tag:1"`
+}
+
+// addNonce adds a random nonce extension to a DER encoded OCSP request,
+// replacing any existing extensions, and returns the new request along
+// with the encoded nonce that should be echoed in the response
+func addNonce(request []byte) ([]byte, []byte, error) {
+	var req extendedRequest
+	_, err := asn1.Unmarshal(request, &req)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, nonceLength)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	encodedNonce, err := asn1.Marshal(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.TBSRequest.RequestExtensions = []pkix.Extension{
+		{Id: idPKIXOCSPNonce, Value: encodedNonce},
+	}
+	request, err = asn1.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return request, encodedNonce, nil
+}
+
+// responseExtension extracts the value of the extension id from the
+// responseExtensions of a DER encoded OCSP response, it returns nil
+// if the response doesn't contain the extension
+func responseExtension(response []byte, id asn1.ObjectIdentifier) ([]byte, error) {
+	var resp extendedResponse
+	_, err := asn1.Unmarshal(response, &resp)
+	if err != nil {
+		return nil, err
+	}
+	var basicResp extendedBasicResponse
+	_, err = asn1.Unmarshal(resp.Response.Response, &basicResp)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range basicResp.TBSResponseData.ResponseExtensions {
+		if ext.Id.Equal(id) {
+			return ext.Value, nil
+		}
+	}
+	return nil, nil
+}
+
+// responseSignatureAlgorithm works out which of the RSA-PSS and Ed25519
+// signature algorithms a DER encoded OCSP response was signed with,
+// golang.org/x/crypto/ocsp leaves them as x509.UnknownSignatureAlgorithm
+// but crypto/x509 can still check their signatures
+func responseSignatureAlgorithm(response []byte) (x509.SignatureAlgorithm, error) {
+	var resp extendedResponse
+	_, err := asn1.Unmarshal(response, &resp)
+	if err != nil {
+		return x509.UnknownSignatureAlgorithm, err
+	}
+	var basicResp extendedBasicResponse
+	_, err = asn1.Unmarshal(resp.Response.Response, &basicResp)
+	if err != nil {
+		return x509.UnknownSignatureAlgorithm, err
+	}
+	algo := basicResp.SignatureAlgorithm
+	if algo.Algorithm.Equal(oidSignatureEd25519) {
+		return x509.PureEd25519, nil
+	}
+	if algo.Algorithm.Equal(oidSignatureRSAPSS) {
+		var params pssParameters
+		_, err = asn1.Unmarshal(algo.Parameters.FullBytes, &params)
+		if err != nil {
+			return x509.UnknownSignatureAlgorithm, fmt.Errorf("failed to parse RSA-PSS parameters: %s", err)
+		}
+		for _, h := range pssHashes {
+			if params.Hash.Algorithm.Equal(h.oid) {
+				return h.algo, nil
+			}
+		}
+		return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported RSA-PSS hash %s", params.Hash.Algorithm)
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm %s", algo.Algorithm)
+}
+
+// responseNonce extracts the encoded nonce from a DER encoded OCSP
+// response, it returns nil if the response doesn't contain a nonce
+func responseNonce(response []byte) ([]byte, error) {
+	return responseExtension(response, idPKIXOCSPNonce)
+}
+
+// responseNextPublish extracts the time the responder will publish its
+// next response from a DER encoded OCSP response, it returns the zero
+// time if the response doesn't say
+func responseNextPublish(response []byte) (time.Time, error) {
+	value, err := responseExtension(response, idNextPublish)
+	if err != nil || value == nil {
+		return time.Time{}, err
+	}
+	var nextPublish time.Time
+	_, err = asn1.Unmarshal(value, &nextPublish)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse NextPublish: %s", err)
+	}
+	return nextPublish, nil
+}
+
+// verifyNonce checks that a response echoes the nonce sent in the
+// request it was fetched with
+func (e *Entry) verifyNonce(respBytes []byte) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.nonce == nil {
+		return nil
+	}
+	nonce, err := responseNonce(respBytes)
+	if err != nil {
+		return fmt.Errorf("malformed OCSP response: failed to parse extensions: %s", err)
+	}
+	if nonce == nil {
+		return errors.New("malformed OCSP response: response doesn't contain a nonce")
+	}
+	if !bytes.Equal(nonce, e.nonce) {
+		return fmt.Errorf("malformed OCSP response: nonce doesn't match (wanted %X, got %X)", e.nonce, nonce)
+	}
+	return nil
+}
+
+// regenerateNonce replaces the nonce in the entries request
+func (e *Entry) regenerateNonce() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	request, nonce, err := addNonce(e.request)
+	if err != nil {
+		return fmt.Errorf("failed to add nonce to request: %s", err)
+	}
+	e.request, e.nonce = request, nonce
+	return nil
+}
+
+// parseResponse parses a DER encoded response and checks it was signed
+// either by the issuer directly or by a delegated responder certificate,
+// included in the response, that the issuer has authorized to sign
+// responses on its behalf
+func (e *Entry) parseResponse(respBytes []byte) (*ocsp.Response, error) {
+	// ocsp.ParseResponse checks the signature using the included
+	// certificate if there is one, but expects it to be signed by
+	// the issuer even when it is the issuer, so the signer is
+	// checked here instead
+	resp, err := ocsp.ParseResponse(respBytes, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.SignatureAlgorithm == x509.UnknownSignatureAlgorithm {
+		resp.SignatureAlgorithm, err = responseSignatureAlgorithm(respBytes)
+		if err != nil {
+			return nil, fmt.Errorf("bad OCSP signature: %s", err)
+		}
+	}
+	if e.issuer == nil {
+		return resp, nil
+	}
+	if resp.Certificate == nil || bytes.Equal(resp.Certificate.Raw, e.issuer.Raw) {
+		err = resp.CheckSignatureFrom(e.issuer)
+		if err != nil {
+			return nil, fmt.Errorf("bad OCSP signature: %s", err)
+		}
+		return resp, nil
+	}
+	err = e.verifyDelegatedResponder(resp.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delegated responder certificate: %s", err)
+	}
+	// stapled never checks the revocation status of delegated
+	// responders, which is only safe if the CA has said so
+	if !hasNoCheck(resp.Certificate) {
+		e.warning(
+			"Delegated responder certificate '%s' (serial %X) doesn't have the id-pkix-ocsp-nocheck extension, its revocation status isn't checked",
+			resp.Certificate.Subject.CommonName,
+			resp.Certificate.SerialNumber,
+		)
+	}
+	return resp, nil
+}
+
+// hasNoCheck returns whether cert has the id-pkix-ocsp-nocheck extension
+func hasNoCheck(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(idPKIXOCSPNoCheck) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyDelegatedResponder checks that cert was issued by the issuer,
+// is currently valid, and has the OCSPSigning extended key usage which
+// RFC 6960 Section 4.2.2.2 requires for a certificate to sign responses
+// on the issuer's behalf
+func (e *Entry) verifyDelegatedResponder(cert *x509.Certificate) error {
+	if !bytes.Equal(cert.RawIssuer, e.issuer.RawSubject) {
+		return errors.New("not issued by the issuer")
+	}
+	err := cert.CheckSignatureFrom(e.issuer)
+	if err != nil {
+		return fmt.Errorf("bad signature from the issuer: %s", err)
+	}
+	ocspSigning := false
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			ocspSigning = true
+			break
+		}
+	}
+	if !ocspSigning {
+		return errors.New("missing the OCSPSigning extended key usage")
+	}
+	now := e.clk.Now()
+	if now.Add(e.clockSkew).Before(cert.NotBefore) || now.Add(-e.clockSkew).After(cert.NotAfter) {
+		return fmt.Errorf("not valid at %s (valid from %s to %s)", now, cert.NotBefore, cert.NotAfter)
+	}
+	return nil
+}
+
+func (e *Entry) verifyResponse(resp *ocsp.Response, respBytes []byte) error {
 	now := e.clk.Now()
-	if resp.ThisUpdate.After(now) {
-		return fmt.Errorf("malformed OCSP response: ThisUpdate is in the future (%s after %s)", resp.ThisUpdate, now)
+	// the responder's clock may be a little ahead of ours
+	if resp.ThisUpdate.After(now.Add(e.clockSkew)) {
+		return fmt.Errorf("malformed OCSP response: ThisUpdate is too far in the future (%s after %s)", resp.ThisUpdate, now)
+	}
+	if resp.ProducedAt.After(now.Add(e.clockSkew)) {
+		return fmt.Errorf("malformed OCSP response: ProducedAt is too far in the future (%s after %s)", resp.ProducedAt, now)
 	}
+	// but no allowance is made for NextUpdate since clients with
+	// accurate clocks would reject a response that has expired
 	if resp.NextUpdate.Before(now) {
 		return fmt.Errorf("stale OCSP response: NextUpdate is in the past (%s before %s)", resp.NextUpdate, now)
 	}
@@ -72,96 +407,584 @@ func (e *Entry) verifyResponse(resp *ocsp.Response) error {
 	if e.serial.Cmp(resp.SerialNumber) != 0 {
 		return fmt.Errorf("malformed OCSP response: Serial numbers don't match (wanted %s, got %s)", e.serial, resp.SerialNumber)
 	}
+	if err := e.checkSignatureAlgorithm(resp.SignatureAlgorithm); err != nil {
+		return err
+	}
+	if err := e.verifyNonce(respBytes); err != nil {
+		return err
+	}
+	e.mu.RLock()
+	currentStatus, currentThisUpdate, hasResponse := e.status, e.thisUpdate, e.response != nil
+	e.mu.RUnlock()
+	// a responder behind a stale cache may serve a response that is
+	// still valid but older than the one we already have
+	if hasResponse && resp.ThisUpdate.Before(currentThisUpdate) {
+		return olderResponseError{resp.ThisUpdate, currentThisUpdate}
+	}
+	if e.refuseUnknown && hasResponse && currentStatus == ocsp.Good && resp.Status == ocsp.Unknown {
+		return errors.New("refusing to replace good response with unknown response")
+	}
 	e.info("New response is valid, expires in %s", humanDuration(resp.NextUpdate.Sub(now)))
 	return nil
 }
 
-func randomResponder(responders []string) string {
-	return responders[mrand.Intn(len(responders))]
+// olderResponseError is returned by verifyResponse when a response is
+// valid but older than the one that is already cached, which means the
+// responder is behind a stale cache rather than that it is broken
+type olderResponseError struct {
+	thisUpdate        time.Time
+	currentThisUpdate time.Time
 }
 
-func parseCacheControl(h string) int {
-	maxAge := 0
-	h = strings.Replace(h, " ", "", -1)
-	for _, p := range strings.Split(h, ",") {
-		if strings.HasPrefix(p, "max-age=") {
-			maxAge, _ = strconv.Atoi(p[8:])
+func (o olderResponseError) Error() string {
+	return fmt.Sprintf("refusing to replace response with older response: ThisUpdate is before current ThisUpdate (%s before %s)", o.thisUpdate, o.currentThisUpdate)
+}
+
+// signatureHashes is the hash used by each of the signature algorithms
+// responses can be signed with, MD2 has no crypto.Hash so it's left as
+// zero, the same as unknown algorithms. Ed25519 signs the message
+// itself rather than a digest of it, but uses SHA-512 internally so
+// it's treated as being as strong
+var signatureHashes = map[x509.SignatureAlgorithm]crypto.Hash{
+	x509.MD5WithRSA:       crypto.MD5,
+	x509.SHA1WithRSA:      crypto.SHA1,
+	x509.DSAWithSHA1:      crypto.SHA1,
+	x509.ECDSAWithSHA1:    crypto.SHA1,
+	x509.SHA256WithRSA:    crypto.SHA256,
+	x509.SHA256WithRSAPSS: crypto.SHA256,
+	x509.DSAWithSHA256:    crypto.SHA256,
+	x509.ECDSAWithSHA256:  crypto.SHA256,
+	x509.SHA384WithRSA:    crypto.SHA384,
+	x509.SHA384WithRSAPSS: crypto.SHA384,
+	x509.ECDSAWithSHA384:  crypto.SHA384,
+	x509.SHA512WithRSA:    crypto.SHA512,
+	x509.SHA512WithRSAPSS: crypto.SHA512,
+	x509.ECDSAWithSHA512:  crypto.SHA512,
+	x509.PureEd25519:      crypto.SHA512,
+}
+
+// hashStrength orders the hashes signatures can use from weakest to
+// strongest
+var hashStrength = map[crypto.Hash]int{
+	crypto.MD5:    1,
+	crypto.SHA1:   2,
+	crypto.SHA256: 3,
+	crypto.SHA384: 4,
+	crypto.SHA512: 5,
+}
+
+// parseMinSignatureHash converts the name of the weakest hash response
+// signatures may use into a crypto.Hash, zero if name is empty
+func parseMinSignatureHash(name string) (crypto.Hash, error) {
+	if name == "" {
+		return 0, nil
+	}
+	h, present := hashNames[strings.ToLower(name)]
+	if !present {
+		return 0, fmt.Errorf("unsupported signature hash algorithm '%s'", name)
+	}
+	return h, nil
+}
+
+// checkSignatureAlgorithm checks that a response signed using algo
+// meets the entry's minimum signature hash, if it has one
+func (e *Entry) checkSignatureAlgorithm(algo x509.SignatureAlgorithm) error {
+	if e.minSignatureHash == 0 {
+		return nil
+	}
+	if hashStrength[signatureHashes[algo]] < hashStrength[e.minSignatureHash] {
+		return fmt.Errorf("weak OCSP response signature: signed using %s, the minimum is %s", algo, e.minSignatureHash)
+	}
+	return nil
+}
+
+// filterResponders returns the entry's responders which are on one of
+// the allowed hosts, warning about those that aren't, so that a crafted
+// certificate can't point stapled at arbitrary URLs
+func (e *Entry) filterResponders() []string {
+	allowed := []string{}
+	for _, responder := range e.responders {
+		if responderAllowed(responder, e.allowedResponders) {
+			allowed = append(allowed, responder)
+			continue
 		}
+		e.warning("Ignoring responder '%s', it isn't on a allowed host", responder)
 	}
-	return maxAge
+	return allowed
 }
 
-func (e *Entry) fetchResponse(ctx context.Context, responder string) (*ocsp.Response, []byte, string, int, error) {
-	backoffSeconds := 0
-	for {
-		if backoffSeconds > 0 {
-			e.info("Request failed, backing off for %d seconds", backoffSeconds)
+// responderAllowed returns whether the host of responder is one of hosts
+func responderAllowed(responder string, hosts []string) bool {
+	u, err := url.Parse(responder)
+	if err != nil {
+		return false
+	}
+	for _, host := range hosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return true
 		}
-		select {
-		case <-ctx.Done():
-			return nil, nil, "", 0, ctx.Err()
-		case <-time.NewTimer(time.Duration(backoffSeconds) * time.Second).C:
+	}
+	return false
+}
+
+// randomResponder picks one of responders at random, or returns an
+// empty string if there aren't any
+func randomResponder(rng *mrand.Rand, responders []string) string {
+	if len(responders) == 0 {
+		return ""
+	}
+	return responders[rng.Intn(len(responders))]
+}
+
+// responderSelector picks which of an entry's responders the next
+// request should be sent to, returning an empty string if it has none
+type responderSelector func(e *Entry) string
+
+var responderSelectors = map[string]responderSelector{
+	"random":       selectRandom,
+	"round-robin":  selectRoundRobin,
+	"health-aware": selectHealthiest,
+	"priority":     selectPriority,
+}
+
+func selectRandom(e *Entry) string {
+	return randomResponder(e.random(), e.responders)
+}
+
+// selectPriority always picks the first responder, the rest are only
+// tried, in the order they are listed, if it fails
+func selectPriority(e *Entry) string {
+	if len(e.responders) == 0 {
+		return ""
+	}
+	return e.responders[0]
+}
+
+// selectRoundRobin cycles through the responders in order
+func selectRoundRobin(e *Entry) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.responders) == 0 {
+		return ""
+	}
+	responder := e.responders[e.nextResponder%len(e.responders)]
+	e.nextResponder = (e.nextResponder + 1) % len(e.responders)
+	return responder
+}
+
+// selectHealthiest randomly picks one of the responders that has
+// failed the fewest times in a row
+func selectHealthiest(e *Entry) string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	healthiest := []string{}
+	fewest := -1
+	for _, r := range e.responders {
+		failures := e.responderFailures[r]
+		if fewest == -1 || failures < fewest {
+			fewest = failures
+			healthiest = []string{r}
+		} else if failures == fewest {
+			healthiest = append(healthiest, r)
 		}
-		if backoffSeconds > 0 {
-			backoffSeconds = 0
+	}
+	return randomResponder(e.random(), healthiest)
+}
+
+// recordResponderResult tracks the number of consecutive failures
+// for a responder so selectors can avoid unhealthy ones
+func (e *Entry) recordResponderResult(responder string, failed bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !failed {
+		delete(e.responderFailures, responder)
+		return
+	}
+	e.responderFailures[responder]++
+}
+
+// cacheControl contains the Cache-Control directives from a responder
+// that stapled cares about
+type cacheControl struct {
+	maxAge  int  // seconds
+	noStore bool // the response shouldn't be written to disk
+	noCache bool // the response should be revalidated on every check
+}
+
+func parseCacheControl(h string) cacheControl {
+	cc := cacheControl{}
+	for _, directive := range strings.Split(h, ",") {
+		name, value := strings.TrimSpace(directive), ""
+		if i := strings.Index(name, "="); i != -1 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
 		}
-		req, err := http.NewRequest(
-			"GET",
-			fmt.Sprintf(
-				"%s/%s",
-				responder,
-				url.QueryEscape(base64.StdEncoding.EncodeToString(e.request)),
-			),
-			nil,
-		)
-		if err != nil {
-			return nil, nil, "", 0, err
+		switch strings.ToLower(name) {
+		case "max-age":
+			cc.maxAge, _ = strconv.Atoi(value)
+		case "no-store":
+			cc.noStore = true
+		case "no-cache":
+			cc.noCache = true
 		}
-		if e.eTag != "" {
-			req.Header.Set("If-None-Match", e.eTag)
+	}
+	return cc
+}
+
+// responderOrder returns the order responders should be tried in for
+// a single refresh, the one picked by the entry's selector followed by
+// the rest in the order they were configured. It is empty if the
+// entry has no responders
+func (e *Entry) responderOrder() []string {
+	first := e.selectResponder(e)
+	if first == "" {
+		return nil
+	}
+	order := []string{first}
+	for _, r := range e.responders {
+		if r != first {
+			order = append(order, r)
 		}
-		e.info("Sending request to '%s'", req.URL)
-		resp, err := e.client.Do(req)
-		if err != nil {
-			e.err("Request for '%s' failed: %s", req.URL, err)
-			backoffSeconds = 10
+	}
+	return order
+}
+
+// fetchDetails describes the fetch that returned a response
+type fetchDetails struct {
+	responder string
+	elapsed   time.Duration
+}
+
+// fetchResult is what fetchResponse got from a responder, along with
+// the caching headers it was sent with. resp is nil if the responder
+// said the current response hasn't changed
+type fetchResult struct {
+	resp      *ocsp.Response
+	respBytes []byte
+	eTag      string
+	cc        cacheControl
+	fetched   fetchDetails
+}
+
+// fetchResponse tries each of the entry's responders in turn until one
+// of them returns a valid response or the context expires. If none of
+// them succeed the returned error lists why each of them failed
+func (e *Entry) fetchResponse(ctx context.Context) (fetchResult, error) {
+	order := e.responderOrder()
+	if len(order) == 0 {
+		return fetchResult{}, errors.New("no responders available")
+	}
+	failures := []string{}
+	throttled := 0
+	var retryAfter time.Time
+	for _, responder := range order {
+		if ctx.Err() != nil {
+			failures = append(failures, ctx.Err().Error())
+			break
+		}
+		host := responderHost(responder)
+		if !e.limiter.allow(host) {
+			throttledFetches.inc(host)
+			throttled++
 			continue
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != 200 {
-			if resp.StatusCode == 304 {
-				e.info("Response for '%s' hasn't changed", req.URL)
-				eTag, cacheControl := resp.Header.Get("ETag"), parseCacheControl(resp.Header.Get("Cache-Control"))
-				return nil, nil, eTag, cacheControl, nil
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if e.attemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, e.attemptTimeout)
+		}
+		started := e.clk.Now()
+		resp, respBytes, eTag, cc, err := e.fetchFrom(attemptCtx, responder)
+		fetched := fetchDetails{responder, e.clk.Now().Sub(started)}
+		cancel()
+		if err == nil && resp != nil {
+			err = e.verifyResponse(resp, respBytes)
+			if older, ok := err.(olderResponseError); ok {
+				// the responder answered properly, it just hasn't
+				// caught up yet, so this isn't counted against it
+				return fetchResult{fetched: fetched}, older
 			}
-			e.err("Request for '%s' got a non-200 response: %d", req.URL, resp.StatusCode)
-			backoffSeconds = 10
-			if resp.StatusCode == 503 {
-				if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
-					if seconds, err := strconv.Atoi(retryAfter); err == nil {
-						backoffSeconds = seconds
-					}
-				}
+			if err != nil {
+				err = classifiedError{failureVerify, err}
 			}
-			continue
 		}
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			e.err("Failed to read response body from '%s': %s", req.URL, err)
-			backoffSeconds = 10
-			continue
+		e.recordResponderResult(responder, err != nil)
+		if err == nil {
+			return fetchResult{resp, respBytes, eTag, cc, fetched}, nil
 		}
-		ocspResp, err := ocsp.ParseResponse(body, e.issuer)
-		if err != nil {
-			e.err("Failed to parse response body from '%s': %s", req.URL, err)
-			backoffSeconds = 10
-			continue
+		class := failureClass(err)
+		fetchFailures.inc(responder, class)
+		statusErr, _ := err.(responderStatusError)
+		if statusErr.retryAfter.After(retryAfter) {
+			retryAfter = statusErr.retryAfter
+		}
+		switch {
+		case statusErr.status == http.StatusNotFound:
+			e.responderErr(responder, "Responder '%s' doesn't know about the certificate, it or the definition may be misconfigured: %s", responder, err)
+		case statusErr.temporary():
+			e.responderWarning(responder, "Responder '%s' is unavailable, the request will be retried: %s", responder, err)
+		default:
+			e.responderErr(responder, "Failed to fetch response from '%s' (%s failure): %s", responder, class, err)
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", responder, err))
+	}
+	if throttled > 0 && len(failures) == 0 {
+		return fetchResult{}, errThrottled
+	}
+	return fetchResult{}, &fetchError{failures, retryAfter}
+}
+
+// fetchWithRetries calls fetchResponse, retrying it up to e.retries
+// times if it fails. The wait between attempts starts at baseBackoff and
+// doubles each time, with jitter, and if a wait would run past the
+// deadline the last error is returned instead. The deadline is e.timeout
+// from now on the entry's clock, or sooner if ctx expires first. Fetches
+// that a responder asked not to be retried until later aren't retried
+func (e *Entry) fetchWithRetries(ctx context.Context) (fetchResult, error) {
+	deadline := e.clk.Now().Add(e.timeout)
+	wait := e.baseBackoff
+	for attempt := 1; ; attempt++ {
+		result, err := e.fetchResponse(ctx)
+		if err == nil || err == errThrottled || attempt > e.retries {
+			return result, err
+		}
+		if _, older := err.(olderResponseError); older {
+			return result, err
+		}
+		if fetchErr, ok := err.(*fetchError); ok && !fetchErr.retryAfter.IsZero() {
+			return result, err
+		}
+		delay := wait/2 + time.Duration(e.random().Int63n(int64(wait/2)+1))
+		if e.clk.Now().Add(delay).After(deadline) {
+			return result, err
 		}
-		if ocspResp.Status == int(ocsp.Success) {
-			eTag, cacheControl := resp.Header.Get("ETag"), parseCacheControl(resp.Header.Get("Cache-Control"))
-			return ocspResp, body, eTag, cacheControl, nil
+		e.info("Fetch attempt %d of %d failed, retrying in %s: %s", attempt, e.retries+1, delay, err)
+		if !e.sleep(ctx, delay) {
+			return result, err
 		}
-		e.err("Request for '%s' got a invalid OCSP response status: %s", req.URL, statusToString[ocspResp.Status])
-		backoffSeconds = 10
+		wait *= 2
+	}
+}
+
+// sleep waits for d to pass on the entry's clock, returning false early
+// if ctx is done first. The clock can't be interrupted so in that case
+// the goroutine waiting on it lingers until d has passed
+func (e *Entry) sleep(ctx context.Context, d time.Duration) bool {
+	slept := make(chan struct{})
+	go func() {
+		e.clk.Sleep(d)
+		close(slept)
+	}()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-slept:
+		return true
+	}
+}
+
+// fetchError is returned by fetchResponse when none of the responders
+// returned a valid response
+type fetchError struct {
+	failures   []string
+	retryAfter time.Time // latest time a responder asked not to be retried before, if any did
+}
+
+func (f *fetchError) Error() string {
+	return fmt.Sprintf("all responders failed: %s", strings.Join(f.failures, "; "))
+}
+
+// Classes of fetch failures, used to label logs and metrics so that
+// network problems can be told apart from misbehaving responders
+const (
+	failureDNS        = "dns"        // the responder's host couldn't be resolved
+	failureTCP        = "tcp"        // a connection couldn't be established
+	failureTLS        = "tls"        // the TLS handshake with the responder failed
+	failureTimeout    = "timeout"    // the responder didn't answer in time
+	failureConnection = "connection" // any other network error, e.g. a reset connection
+	failureHTTP       = "http"       // the responder answered with an unexpected status or body
+	failureParse      = "parse"      // the body wasn't a valid OCSP response
+	failureVerify     = "verify"     // the response was valid but not acceptable
+)
+
+// classifiedError is a fetch error along with its class
+type classifiedError struct {
+	class string
+	err   error
+}
+
+func (c classifiedError) Error() string {
+	return c.err.Error()
+}
+
+// failureClass returns the class of an error returned while fetching
+// and verifying a response
+func failureClass(err error) string {
+	switch err := err.(type) {
+	case classifiedError:
+		return err.class
+	case responderStatusError:
+		return failureHTTP
+	}
+	return networkFailureClass(err)
+}
+
+// networkFailureClass works out which stage of connecting to a
+// responder, or reading from it, err came from
+func networkFailureClass(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return failureDNS
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return failureTimeout
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return failureTimeout
+	}
+	var (
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return failureTLS
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return failureTCP
+	}
+	return failureConnection
+}
+
+// responderStatusError is returned when a responder answers with a
+// status other than 200, or 304 to a conditional request
+type responderStatusError struct {
+	status     int
+	retryAfter time.Time // from the Retry-After header of 429 and 503 responses
+}
+
+func (s responderStatusError) Error() string {
+	return fmt.Sprintf("got a non-200 response: %d", s.status)
+}
+
+// temporary returns whether the status means the responder is
+// overloaded or having problems, rather than that the request was
+// wrong, so the same request may succeed if it is retried later
+func (s responderStatusError) temporary() bool {
+	return s.status >= 500 || s.status == http.StatusTooManyRequests
+}
+
+// maxRetryAfter is the longest a responder can ask for requests to be
+// put off for, so a broken responder can't stop an entry from being
+// refreshed indefinitely
+const maxRetryAfter = 12 * time.Hour
+
+// parseRetryAfter parses a Retry-After header, which is either a number
+// of seconds or a HTTP date, returning the zero time if it is missing
+// or invalid
+func parseRetryAfter(header string, now time.Time) time.Time {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return time.Time{}
+	}
+	var after time.Time
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil {
+		if seconds < 0 {
+			return time.Time{}
+		}
+		if seconds > int64(maxRetryAfter/time.Second) {
+			seconds = int64(maxRetryAfter / time.Second)
+		}
+		after = now.Add(time.Duration(seconds) * time.Second)
+	} else if date, err := http.ParseTime(header); err == nil {
+		after = date
+	} else {
+		return time.Time{}
+	}
+	if after.After(now.Add(maxRetryAfter)) {
+		after = now.Add(maxRetryAfter)
+	}
+	return after
+}
+
+// defaultMaxResponseSize is the default largest response body that will
+// be read from a responder, OCSP responses are rarely more than a few
+// kilobytes so this is generous
+const defaultMaxResponseSize = 64 << 10
+
+// fetchFrom sends a single request to responder, if the response hasn't
+// changed since the last request a nil response is returned
+func (e *Entry) fetchFrom(ctx context.Context, responder string) (*ocsp.Response, []byte, string, cacheControl, error) {
+	req, err := http.NewRequest(
+		"GET",
+		fmt.Sprintf(
+			"%s/%s",
+			responder,
+			url.QueryEscape(base64.StdEncoding.EncodeToString(e.request)),
+		),
+		nil,
+	)
+	if err != nil {
+		return nil, nil, "", cacheControl{}, err
+	}
+	req = req.WithContext(ctx)
+	e.mu.RLock()
+	currentETag := e.eTag
+	e.mu.RUnlock()
+	if currentETag != "" {
+		req.Header.Set("If-None-Match", currentETag)
+	}
+	e.responderInfo(responder, "Sending request to '%s'", req.URL)
+	started := time.Now()
+	resp, err := e.client.Do(req)
+	fetchLatency.observe(time.Since(started).Seconds())
+	if err != nil {
+		fetchResults.inc(responder, "failure")
+		return nil, nil, "", cacheControl{}, classifiedError{networkFailureClass(err), err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		// a 304 only makes sense in answer to a conditional request
+		if resp.StatusCode == 304 && currentETag != "" {
+			e.responderInfo(responder, "Response for '%s' hasn't changed", req.URL)
+			fetchResults.inc(responder, "success")
+			eTag, cc := resp.Header.Get("ETag"), parseCacheControl(resp.Header.Get("Cache-Control"))
+			if eTag == "" {
+				// servers aren't required to repeat the ETag
+				eTag = currentETag
+			}
+			return nil, nil, eTag, cc, nil
+		}
+		fetchResults.inc(responder, "failure")
+		statusErr := responderStatusError{status: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			statusErr.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), e.clk.Now())
+		}
+		return nil, nil, "", cacheControl{}, statusErr
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, e.maxResponseSize+1))
+	if err != nil {
+		fetchResults.inc(responder, "failure")
+		return nil, nil, "", cacheControl{}, classifiedError{networkFailureClass(err), fmt.Errorf("failed to read response body: %s", err)}
+	}
+	if int64(len(body)) > e.maxResponseSize {
+		fetchResults.inc(responder, "failure")
+		return nil, nil, "", cacheControl{}, classifiedError{failureHTTP, fmt.Errorf("response body is larger than %d bytes", e.maxResponseSize)}
+	}
+	ocspResp, err := e.parseResponse(body)
+	if err != nil {
+		fetchResults.inc(responder, "failure")
+		return nil, nil, "", cacheControl{}, classifiedError{failureParse, fmt.Errorf("failed to parse response body: %s", err)}
+	}
+	if _, present := statusToString[ocspResp.Status]; !present {
+		fetchResults.inc(responder, "failure")
+		return nil, nil, "", cacheControl{}, classifiedError{failureParse, fmt.Errorf("got a invalid certificate status: %d", ocspResp.Status)}
 	}
+	fetchResults.inc(responder, "success")
+	eTag, cc := resp.Header.Get("ETag"), parseCacheControl(resp.Header.Get("Cache-Control"))
+	return ocspResp, body, eTag, cc, nil
 }
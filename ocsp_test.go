@@ -1 +1,1465 @@
 package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/context"
+)
+
+// testIssuer generates a self-signed issuer that can be used to sign
+// test OCSP responses
+func testIssuer(t *testing.T) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate issuer key: %s", err)
+	}
+	return testIssuerWithKey(t, key), key
+}
+
+// testIssuerWithKey generates a self-signed issuer certificate for key
+func testIssuerWithKey(t *testing.T, key crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stapled test issuer"},
+		NotBefore:             time.Unix(0, 0),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create issuer certificate: %s", err)
+	}
+	issuer, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse issuer certificate: %s", err)
+	}
+	return issuer
+}
+
+// testCertificate generates a leaf certificate with the provided serial
+// signed by issuer
+func testCertificate(t *testing.T, issuer *x509.Certificate, issuerKey crypto.Signer, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "stapled test certificate"},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Now().Add(time.Hour * 24 * 365),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %s", err)
+	}
+	return cert
+}
+
+// testDelegatedResponder generates a responder certificate, and its key,
+// with the provided extended key usages and extensions signed by issuer
+func testDelegatedResponder(t *testing.T, issuer *x509.Certificate, issuerKey crypto.Signer, usages []x509.ExtKeyUsage, notAfter time.Time, extensions []pkix.Extension) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		Subject:         pkix.Name{CommonName: "stapled test responder"},
+		NotBefore:       time.Unix(0, 0),
+		NotAfter:        notAfter,
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     usages,
+		ExtraExtensions: extensions,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatalf("Failed to create responder certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse responder certificate: %s", err)
+	}
+	return cert, key
+}
+
+// testOCSPServer starts a OCSP responder that answers GET requests for
+// any serial with a good response signed by issuer that is valid for an
+// hour either side of the current time on clk
+func testOCSPServer(t *testing.T, issuer *x509.Certificate, key crypto.Signer, clk clock.Clock) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(testResponse(t, issuer, key, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   clk.Now().Add(-time.Hour),
+			NextUpdate:   clk.Now().Add(time.Hour),
+		}, nil))
+	}))
+}
+
+// testResponse creates a OCSP response signed by issuer, if extensions
+// are provided they are added to the responseExtensions field. ProducedAt
+// is taken from the template, or ThisUpdate if it isn't set
+func testResponse(t *testing.T, issuer *x509.Certificate, key crypto.Signer, template ocsp.Response, extensions []pkix.Extension) []byte {
+	// golang.org/x/crypto/ocsp can't sign using RSA-PSS or Ed25519 so
+	// those responses are created using a throwaway key and re-signed
+	created, signer := template, key
+	if _, _, unsupported := testSignatureAlgorithm(t, template.SignatureAlgorithm); unsupported {
+		created.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+		var err error
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %s", err)
+		}
+	}
+	respBytes, err := ocsp.CreateResponse(issuer, issuer, created, signer)
+	if err != nil {
+		t.Fatalf("Failed to create response: %s", err)
+	}
+
+	// golang.org/x/crypto/ocsp always sets ProducedAt to the current
+	// time, which is in the future for tests using a fake clock, and
+	// can't create responses with response extensions so fix up the
+	// tbsResponseData and re-sign it
+	var resp extendedResponse
+	_, err = asn1.Unmarshal(respBytes, &resp)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %s", err)
+	}
+	var basicResp extendedBasicResponse
+	_, err = asn1.Unmarshal(resp.Response.Response, &basicResp)
+	if err != nil {
+		t.Fatalf("Failed to parse basic response: %s", err)
+	}
+	producedAt := template.ProducedAt
+	if producedAt.IsZero() {
+		producedAt = template.ThisUpdate
+	}
+	basicResp.TBSResponseData.ProducedAt = producedAt.UTC()
+	basicResp.TBSResponseData.ResponseExtensions = extensions
+	tbs, err := asn1.Marshal(basicResp.TBSResponseData)
+	if err != nil {
+		t.Fatalf("Failed to marshal tbsResponseData: %s", err)
+	}
+	opts, algorithmID, unsupported := testSignatureAlgorithm(t, template.SignatureAlgorithm)
+	if unsupported {
+		basicResp.SignatureAlgorithm = algorithmID
+	}
+	signed := tbs
+	if hash := opts.HashFunc(); hash != 0 {
+		h := hash.New()
+		h.Write(tbs)
+		signed = h.Sum(nil)
+	}
+	signature, err := key.Sign(rand.Reader, signed, opts)
+	if err != nil {
+		t.Fatalf("Failed to sign response: %s", err)
+	}
+	basicResp.Signature = asn1.BitString{Bytes: signature, BitLength: len(signature) * 8}
+	resp.Response.Response, err = asn1.Marshal(basicResp)
+	if err != nil {
+		t.Fatalf("Failed to marshal basic response: %s", err)
+	}
+	respBytes, err = asn1.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Failed to marshal response: %s", err)
+	}
+	return respBytes
+}
+
+// testSignatureAlgorithm returns the options to sign a response using
+// algo with, SHA-256 if it isn't set. For the RSA-PSS and Ed25519
+// algorithms golang.org/x/crypto/ocsp doesn't support it also returns
+// the AlgorithmIdentifier the response must use
+func testSignatureAlgorithm(t *testing.T, algo x509.SignatureAlgorithm) (crypto.SignerOpts, pkix.AlgorithmIdentifier, bool) {
+	if algo == x509.PureEd25519 {
+		return crypto.Hash(0), pkix.AlgorithmIdentifier{Algorithm: oidSignatureEd25519}, true
+	}
+	hash := crypto.SHA256
+	if algo != x509.UnknownSignatureAlgorithm {
+		hash = signatureHashes[algo]
+	}
+	for _, pss := range pssHashes {
+		if pss.algo != algo {
+			continue
+		}
+		hashID := pkix.AlgorithmIdentifier{Algorithm: pss.oid, Parameters: asn1.NullRawValue}
+		mgfParams, err := asn1.Marshal(hashID)
+		if err != nil {
+			t.Fatalf("Failed to marshal MGF parameters: %s", err)
+		}
+		params, err := asn1.Marshal(pssParameters{
+			Hash:         hashID,
+			MGF:          pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}, Parameters: asn1.RawValue{FullBytes: mgfParams}},
+			SaltLength:   hash.Size(),
+			TrailerField: 1,
+		})
+		if err != nil {
+			t.Fatalf("Failed to marshal RSA-PSS parameters: %s", err)
+		}
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+		return opts, pkix.AlgorithmIdentifier{Algorithm: oidSignatureRSAPSS, Parameters: asn1.RawValue{FullBytes: params}}, true
+	}
+	return hash, pkix.AlgorithmIdentifier{}, false
+}
+
+func TestResponderSelection(t *testing.T) {
+	clk := clock.NewFake()
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	e.responders = []string{"a", "b", "c"}
+
+	for i, expected := range []string{"a", "b", "c", "a", "b"} {
+		if r := selectRoundRobin(e); r != expected {
+			t.Fatalf("Unexpected responder on round-robin selection %d: wanted %s, got %s", i, expected, r)
+		}
+	}
+
+	e.recordResponderResult("a", true)
+	e.recordResponderResult("b", true)
+	e.recordResponderResult("b", true)
+	for i := 0; i < 10; i++ {
+		if r := selectHealthiest(e); r != "c" {
+			t.Fatalf("Health-aware selection picked unhealthy responder %s", r)
+		}
+	}
+	e.recordResponderResult("c", true)
+	e.recordResponderResult("c", true)
+	for i := 0; i < 10; i++ {
+		if r := selectHealthiest(e); r != "a" {
+			t.Fatalf("Health-aware selection picked unhealthy responder %s", r)
+		}
+	}
+	e.recordResponderResult("b", false)
+	for i := 0; i < 10; i++ {
+		if r := selectHealthiest(e); r != "b" {
+			t.Fatalf("Health-aware selection didn't pick recovered responder, got %s", r)
+		}
+	}
+
+	// entries with the same seed make the same random choices
+	other := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	other.responders = e.responders
+	e.rand, other.rand = newRand(42), newRand(42)
+	for i := 0; i < 20; i++ {
+		if a, b := selectRandom(e), selectRandom(other); a != b {
+			t.Fatalf("Random selection %d differed with the same seed: %s and %s", i, a, b)
+		}
+	}
+}
+
+func TestSelectionWithoutResponders(t *testing.T) {
+	if r := randomResponder(newRand(1), []string{}); r != "" {
+		t.Fatalf("randomResponder picked a responder from an empty list: %s", r)
+	}
+	if r := randomResponder(newRand(1), nil); r != "" {
+		t.Fatalf("randomResponder picked a responder from a nil list: %s", r)
+	}
+
+	clk := clock.NewFake()
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	for name, selector := range responderSelectors {
+		if r := selector(e); r != "" {
+			t.Fatalf("%s selection picked a responder for a entry without any: %s", name, r)
+		}
+		e.selectResponder = selector
+		if order := e.responderOrder(); len(order) != 0 {
+			t.Fatalf("Unexpected responder order using %s selection: %v", name, order)
+		}
+	}
+	_, err := e.fetchResponse(context.Background())
+	if err == nil || err.Error() != "no responders available" {
+		t.Fatalf("Unexpected error fetching without responders: %v", err)
+	}
+}
+
+func TestAllowedResponders(t *testing.T) {
+	clk := clock.NewFake()
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	e.request = []byte{1}
+	e.responders = []string{
+		"http://ocsp.example.com",
+		"http://OCSP.example.com:8080/path/",
+		"http://ocsp.example.com.evil.com",
+		"http://169.254.169.254/latest",
+		"::not a url",
+	}
+	e.allowedResponders = []string{"ocsp.example.com"}
+	allowed := e.filterResponders()
+	if len(allowed) != 2 || allowed[0] != e.responders[0] || allowed[1] != e.responders[1] {
+		t.Fatalf("Unexpected responders allowed: %s", allowed)
+	}
+
+	e.responders = []string{"http://169.254.169.254/latest"}
+	err := e.Init()
+	if err == nil {
+		t.Fatal("Init didn't fail when none of the responders are allowed")
+	}
+}
+
+func TestNonce(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	e.name = "nonce"
+	e.issuer = issuer
+	e.serial = big.NewInt(1337)
+	e.useNonce = true
+
+	request, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: e.serial}, issuer, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	e.request = request
+	err = e.regenerateNonce()
+	if err != nil {
+		t.Fatalf("Failed to add nonce to request: %s", err)
+	}
+	parsed, err := ocsp.ParseRequest(e.request)
+	if err != nil {
+		t.Fatalf("Failed to parse request with nonce: %s", err)
+	}
+	if parsed.SerialNumber.Cmp(e.serial) != 0 {
+		t.Fatalf("Request with nonce has wrong serial: wanted %s, got %s", e.serial, parsed.SerialNumber)
+	}
+	var extReq extendedRequest
+	_, err = asn1.Unmarshal(e.request, &extReq)
+	if err != nil {
+		t.Fatalf("Failed to parse request extensions: %s", err)
+	}
+	if len(extReq.TBSRequest.RequestExtensions) != 1 || !bytes.Equal(extReq.TBSRequest.RequestExtensions[0].Value, e.nonce) {
+		t.Fatal("Request doesn't contain the expected nonce")
+	}
+
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: e.serial,
+		ThisUpdate:   clk.Now().Add(-time.Hour),
+		NextUpdate:   clk.Now().Add(time.Hour),
+	}
+	for _, tc := range []struct {
+		extensions []pkix.Extension
+		valid      bool
+	}{
+		{[]pkix.Extension{{Id: idPKIXOCSPNonce, Value: e.nonce}}, true},
+		{[]pkix.Extension{{Id: idPKIXOCSPNonce, Value: []byte{4, 1, 0}}}, false},
+		{nil, false},
+	} {
+		respBytes := testResponse(t, issuer, key, template, tc.extensions)
+		resp, err := ocsp.ParseResponse(respBytes, issuer)
+		if err != nil {
+			t.Fatalf("Failed to parse response: %s", err)
+		}
+		err = e.verifyResponse(resp, respBytes)
+		if tc.valid && err != nil {
+			t.Fatalf("Failed to verify response with matching nonce: %s", err)
+		} else if !tc.valid && err == nil {
+			t.Fatal("verifyResponse didn't fail for response with mismatched nonce")
+		}
+	}
+
+	// responses fetched with a nonce shouldn't be written to disk
+	tmpDir, err := ioutil.TempDir("", "stapled")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	e.generateResponseFilename(tmpDir)
+	respBytes := testResponse(t, issuer, key, template, []pkix.Extension{{Id: idPKIXOCSPNonce, Value: e.nonce}})
+	resp, err := ocsp.ParseResponse(respBytes, issuer)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %s", err)
+	}
+	err = e.updateResponse("", cacheControl{}, resp, respBytes, true)
+	if err != nil {
+		t.Fatalf("Failed to update response: %s", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmpDir, "*")); len(files) != 0 {
+		t.Fatalf("Response fetched with nonce was written to disk: %s", files)
+	}
+}
+
+func TestNextPublish(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	e.name = "next-publish"
+
+	nextPublish := clk.Now().Add(time.Hour)
+	encoded, err := asn1.Marshal(nextPublish)
+	if err != nil {
+		t.Fatalf("Failed to marshal NextPublish: %s", err)
+	}
+	respBytes := testResponse(t, issuer, key, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1337),
+		ThisUpdate:   clk.Now(),
+		NextUpdate:   clk.Now().Add(time.Hour * 24 * 4),
+	}, []pkix.Extension{{Id: idNextPublish, Value: encoded}})
+	resp, err := ocsp.ParseResponse(respBytes, issuer)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %s", err)
+	}
+	err = e.updateResponse("", cacheControl{}, resp, respBytes, false)
+	if err != nil {
+		t.Fatalf("Failed to update response: %s", err)
+	}
+	if !e.nextPublish.Equal(nextPublish) {
+		t.Fatalf("Unexpected NextPublish: wanted %s, got %s", nextPublish, e.nextPublish)
+	}
+	if e.timeToUpdate() {
+		t.Fatal("Entry was refreshed before NextPublish")
+	}
+
+	// well before the update window but after NextPublish
+	clk.Add(time.Hour * 2)
+	if !e.timeToUpdate() {
+		t.Fatal("Entry wasn't refreshed after NextPublish")
+	}
+
+	// once the entry has synced after NextPublish it goes back to
+	// using the update window
+	err = e.updateResponse("", cacheControl{}, nil, nil, false)
+	if err != nil {
+		t.Fatalf("Failed to update response: %s", err)
+	}
+	if e.timeToUpdate() {
+		t.Fatal("Entry was refreshed again after syncing past NextPublish")
+	}
+
+	// responses without the extension use the update window
+	respBytes = testResponse(t, issuer, key, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1337),
+		ThisUpdate:   clk.Now(),
+		NextUpdate:   clk.Now().Add(time.Hour * 24 * 4),
+	}, nil)
+	resp, err = ocsp.ParseResponse(respBytes, issuer)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %s", err)
+	}
+	err = e.updateResponse("", cacheControl{}, resp, respBytes, false)
+	if err != nil {
+		t.Fatalf("Failed to update response: %s", err)
+	}
+	if !e.nextPublish.IsZero() {
+		t.Fatalf("Response without NextPublish set it to %s", e.nextPublish)
+	}
+}
+
+func TestFetchResponseFallback(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	good := testOCSPServer(t, issuer, key, clk)
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, time.Second, 0)
+	e.name = "fallback"
+	e.issuer = issuer
+	e.serial = big.NewInt(1337)
+	request, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: e.serial}, issuer, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	e.request = request
+	e.client = new(http.Client)
+	e.selectResponder = selectRoundRobin
+	e.responders = []string{bad.URL, good.URL}
+
+	err = e.refreshResponse(context.Background())
+	if err != nil {
+		t.Fatalf("Refresh failed even though one responder was working: %s", err)
+	}
+	if e.response == nil {
+		t.Fatal("Response wasn't set after refresh")
+	}
+	if e.responderFailures[bad.URL] != 1 || e.responderFailures[good.URL] != 0 {
+		t.Fatalf("Unexpected responder failures: %v", e.responderFailures)
+	}
+
+	e.responders = []string{bad.URL, bad.URL + "/other"}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_, err = e.fetchResponse(ctx)
+	if err == nil {
+		t.Fatal("fetchResponse didn't fail when all responders were broken")
+	}
+	for _, r := range e.responders {
+		if !strings.Contains(err.Error(), r+": ") {
+			t.Fatalf("Error doesn't mention failure of %s: %s", r, err)
+		}
+	}
+}
+
+func TestPriorityFallback(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	good := testOCSPServer(t, issuer, key, clk)
+	defer good.Close()
+	// each responder counts the requests it gets and fails while its
+	// broken flag is set
+	hits := make([]int64, 3)
+	broken := make([]int32, 3)
+	responders := []string{}
+	for i := range hits {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&hits[i], 1)
+			if atomic.LoadInt32(&broken[i]) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			good.Config.Handler.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		responders = append(responders, srv.URL)
+	}
+
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, time.Second, 0)
+	e.issuer = issuer
+	e.serial = big.NewInt(1337)
+	request, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: e.serial}, issuer, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	e.request = request
+	e.client = new(http.Client)
+	e.selectResponder = responderSelectors["priority"]
+	e.responders = responders
+
+	fetch := func() {
+		_, err := e.fetchResponse(context.Background())
+		if err != nil {
+			t.Fatalf("fetchResponse failed: %s", err)
+		}
+	}
+	checkHits := func(expected ...int64) {
+		for i := range hits {
+			if atomic.LoadInt64(&hits[i]) != expected[i] {
+				t.Fatalf("Unexpected requests to responders: wanted %v, got %v", expected, hits)
+			}
+		}
+	}
+
+	// the primary is always used while it's working
+	for i := 0; i < 5; i++ {
+		fetch()
+	}
+	checkHits(5, 0, 0)
+
+	// the fallbacks are tried in order
+	atomic.StoreInt32(&broken[0], 1)
+	fetch()
+	checkHits(6, 1, 0)
+	atomic.StoreInt32(&broken[1], 1)
+	fetch()
+	checkHits(7, 2, 1)
+
+	// and the primary is preferred again once it recovers
+	atomic.StoreInt32(&broken[0], 0)
+	fetch()
+	checkHits(8, 2, 1)
+}
+
+func TestWrongSerialRejected(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testResponse(t, issuer, key, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(7),
+			ThisUpdate:   clk.Now().Add(-time.Hour),
+			NextUpdate:   clk.Now().Add(time.Hour),
+		}, nil))
+	}))
+	defer srv.Close()
+
+	tmpDir, err := ioutil.TempDir("", "stapled")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, time.Second, 0)
+	e.name = "wrong-serial"
+	e.issuer = issuer
+	e.serial = big.NewInt(1337)
+	request, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: e.serial}, issuer, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	e.request = request
+	e.client = new(http.Client)
+	e.responders = []string{srv.URL}
+	e.generateResponseFilename(tmpDir)
+
+	err = e.refreshResponse(context.Background())
+	if err == nil {
+		t.Fatal("Refresh didn't fail for response with the wrong serial")
+	}
+	if !strings.Contains(err.Error(), "Serial numbers don't match") {
+		t.Fatalf("Unexpected error for response with the wrong serial: %s", err)
+	}
+	if e.response != nil {
+		t.Fatal("Response with the wrong serial was stored")
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmpDir, "*")); len(files) != 0 {
+		t.Fatalf("Response with the wrong serial was written to disk: %s", files)
+	}
+}
+
+func TestOversizedResponseRejected(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	respBytes := testResponse(t, issuer, key, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1),
+		ThisUpdate:   clk.Now().Add(-time.Hour),
+		NextUpdate:   clk.Now().Add(time.Hour),
+	}, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(respBytes)
+	}))
+	defer srv.Close()
+	hugeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, defaultMaxResponseSize*4))
+	}))
+	defer hugeSrv.Close()
+
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, time.Second, 0)
+	e.issuer = issuer
+	e.serial = big.NewInt(1)
+	e.client = new(http.Client)
+	_, _, _, _, err := e.fetchFrom(context.Background(), hugeSrv.URL)
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("Oversized response wasn't rejected: %v", err)
+	}
+
+	// the limit is configurable
+	e.maxResponseSize = int64(len(respBytes) - 1)
+	_, _, _, _, err = e.fetchFrom(context.Background(), srv.URL)
+	if err == nil {
+		t.Fatal("Response over the configured limit wasn't rejected")
+	}
+	e.maxResponseSize = int64(len(respBytes))
+	resp, _, _, _, err := e.fetchFrom(context.Background(), srv.URL)
+	if err != nil || resp == nil {
+		t.Fatalf("Response within the configured limit was rejected: %v", err)
+	}
+}
+
+func TestResponderStatusCodes(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	respBytes := testResponse(t, issuer, key, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1),
+		ThisUpdate:   clk.Now().Add(-time.Hour),
+		NextUpdate:   clk.Now().Add(time.Hour),
+	}, nil)
+	var status int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := int(atomic.LoadInt64(&status))
+		w.WriteHeader(code)
+		if code == http.StatusOK {
+			w.Write(respBytes)
+		}
+	}))
+	defer srv.Close()
+
+	log := NewLogger("", "", 10, clk)
+	err := log.SetFormat("json")
+	if err != nil {
+		t.Fatalf("Failed to set JSON format: %s", err)
+	}
+	err = log.SetLevel("warning")
+	if err != nil {
+		t.Fatalf("Failed to set log level: %s", err)
+	}
+	buf := new(bytes.Buffer)
+	log.stdout = buf
+	e := NewEntry(log, clk, time.Second*5, time.Second, 0)
+	e.issuer = issuer
+	e.serial = big.NewInt(1)
+	e.client = new(http.Client)
+	e.responders = []string{srv.URL}
+
+	for _, tc := range []struct {
+		status    int
+		temporary bool
+		level     string
+	}{
+		{http.StatusServiceUnavailable, true, "warning"},
+		{http.StatusTooManyRequests, true, "warning"},
+		{http.StatusNotFound, false, "err"},
+		{http.StatusNotModified, false, "err"}, // not a conditional request
+	} {
+		atomic.StoreInt64(&status, int64(tc.status))
+		buf.Reset()
+		_, err := e.fetchResponse(context.Background())
+		if err == nil {
+			t.Fatalf("fetchResponse didn't fail with status %d", tc.status)
+		}
+		_, _, _, _, err = e.fetchFrom(context.Background(), srv.URL)
+		statusErr, ok := err.(responderStatusError)
+		if !ok || statusErr.status != tc.status {
+			t.Fatalf("Unexpected error for status %d: %v", tc.status, err)
+		}
+		if statusErr.temporary() != tc.temporary {
+			t.Fatalf("Status %d has the wrong retry semantics", tc.status)
+		}
+		var line map[string]string
+		err = json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &line)
+		if err != nil {
+			t.Fatalf("Failed to parse log line %q: %s", buf.String(), err)
+		}
+		if line["level"] != tc.level {
+			t.Fatalf("Status %d logged at the wrong level: wanted %s, got %s", tc.status, tc.level, line["level"])
+		}
+	}
+
+	atomic.StoreInt64(&status, http.StatusOK)
+	result, err := e.fetchResponse(context.Background())
+	if err != nil || result.resp == nil {
+		t.Fatalf("fetchResponse failed with status 200: %v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		header   string
+		expected time.Time
+	}{
+		{"", time.Time{}},
+		{"120", now.Add(2 * time.Minute)},
+		{" 0 ", now},
+		{"-5", time.Time{}},
+		{"Sun, 01 Jan 2017 13:30:00 GMT", now.Add(90 * time.Minute)},
+		{"Sunday, 01-Jan-17 13:30:00 GMT", now.Add(90 * time.Minute)},
+		{"soon", time.Time{}},
+		// responders can't put refreshes off forever
+		{"9999999999", now.Add(maxRetryAfter)},
+		{"Fri, 01 Jan 2100 00:00:00 GMT", now.Add(maxRetryAfter)},
+	} {
+		if after := parseRetryAfter(tc.header, now); !after.Equal(tc.expected) {
+			t.Fatalf("Unexpected time for Retry-After %q: wanted %s, got %s", tc.header, tc.expected, after)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	var retryAfter atomic.Value
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Retry-After", retryAfter.Load().(string))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	for _, header := range []func() string{
+		func() string { return "7200" },
+		func() string { return clk.Now().Add(2 * time.Hour).UTC().Format(http.TimeFormat) },
+	} {
+		retryAfter.Store(header())
+		atomic.StoreInt64(&requests, 0)
+		e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, time.Second, 0)
+		e.serial = big.NewInt(1)
+		e.client = new(http.Client)
+		e.responders = []string{srv.URL}
+
+		err := e.refreshResponse(context.Background())
+		if err == nil {
+			t.Fatal("Refresh didn't fail with a 503 response")
+		}
+		if expected := clk.Now().Add(2 * time.Hour); !e.nextRetry.Equal(expected) {
+			t.Fatalf("Retry-After %q wasn't used for the next retry: wanted %s, got %s", retryAfter.Load(), expected, e.nextRetry)
+		}
+		// the normal backoff would have allowed a retry by now
+		clk.Add(time.Hour)
+		e.refreshResponse(context.Background())
+		if atomic.LoadInt64(&requests) != 1 {
+			t.Fatalf("Entry was refreshed before the Retry-After time for %q", retryAfter.Load())
+		}
+		clk.Add(time.Hour)
+		e.refreshResponse(context.Background())
+		if atomic.LoadInt64(&requests) != 2 {
+			t.Fatalf("Entry wasn't refreshed after the Retry-After time for %q", retryAfter.Load())
+		}
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	var requests, failFirst int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) <= atomic.LoadInt64(&failFirst) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(testResponse(t, issuer, key, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(1),
+			ThisUpdate:   clk.Now().Add(-time.Hour),
+			NextUpdate:   clk.Now().Add(time.Hour),
+		}, nil))
+	}))
+	defer srv.Close()
+	newEntry := func(retries int, backoff time.Duration) *Entry {
+		atomic.StoreInt64(&requests, 0)
+		e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, backoff, 0)
+		e.issuer = issuer
+		e.serial = big.NewInt(1)
+		e.client = new(http.Client)
+		e.responders = []string{srv.URL}
+		e.retries = retries
+		return e
+	}
+
+	// a responder that fails twice then succeeds
+	atomic.StoreInt64(&failFirst, 2)
+	e := newEntry(2, time.Millisecond)
+	err := e.refreshResponse(context.Background())
+	if err != nil {
+		t.Fatalf("Refresh failed with enough retries: %s", err)
+	}
+	if e.response == nil || atomic.LoadInt64(&requests) != 3 {
+		t.Fatalf("Unexpected result after retries: %d requests, response set %t", requests, e.response != nil)
+	}
+	if e.failures != 0 {
+		t.Fatal("Refresh that succeeded on a retry was counted as a failure")
+	}
+
+	e = newEntry(1, time.Millisecond)
+	err = e.refreshResponse(context.Background())
+	if err == nil {
+		t.Fatal("Refresh didn't fail when it ran out of retries")
+	}
+	if atomic.LoadInt64(&requests) != 2 {
+		t.Fatalf("Unexpected number of requests: wanted 2, got %d", requests)
+	}
+
+	// retries that would run past the deadline aren't attempted
+	e = newEntry(5, time.Hour)
+	started := time.Now()
+	err = e.refreshResponse(context.Background())
+	if err == nil {
+		t.Fatal("Refresh didn't fail")
+	}
+	if atomic.LoadInt64(&requests) != 1 || time.Since(started) > time.Second {
+		t.Fatalf("Retry was attempted past the deadline: %d requests in %s", requests, time.Since(started))
+	}
+
+	// waits between attempts are on the entry's clock
+	atomic.StoreInt64(&failFirst, 1)
+	e = newEntry(1, time.Second*2)
+	before := clk.Now()
+	started = time.Now()
+	err = e.refreshResponse(context.Background())
+	if err != nil {
+		t.Fatalf("Refresh failed with enough retries: %s", err)
+	}
+	if !clk.Now().After(before) || time.Since(started) > time.Second {
+		t.Fatalf("Retry didn't wait on the entry's clock: clock moved %s in %s", clk.Now().Sub(before), time.Since(started))
+	}
+
+	// a responder that hangs only uses up the attempt timeout
+	hang := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer slow.Close()
+	defer close(hang)
+	atomic.StoreInt64(&failFirst, 0)
+	e = newEntry(0, time.Millisecond)
+	e.selectResponder = selectPriority
+	e.responders = []string{slow.URL, srv.URL}
+	e.attemptTimeout = 50 * time.Millisecond
+	err = e.refreshResponse(context.Background())
+	if err != nil {
+		t.Fatalf("Refresh failed despite attempt timeout: %s", err)
+	}
+}
+
+func TestFetchFailureClasses(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	respond := func(serial int64) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Write(testResponse(t, issuer, key, ocsp.Response{
+				Status:       ocsp.Good,
+				SerialNumber: big.NewInt(serial),
+				ThisUpdate:   clk.Now().Add(-time.Hour),
+				NextUpdate:   clk.Now().Add(time.Hour),
+			}, nil))
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	refused := "http://" + l.Addr().String()
+	l.Close()
+	untrusted := httptest.NewTLSServer(respond(1))
+	defer untrusted.Close()
+	hang := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer slow.Close()
+	defer close(hang)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not a response"))
+	}))
+	defer garbage.Close()
+	wrongSerial := httptest.NewServer(respond(2))
+	defer wrongSerial.Close()
+
+	for _, tc := range []struct {
+		responder string
+		class     string
+	}{
+		{"http://stapled-test.invalid", failureDNS},
+		{refused, failureTCP},
+		{untrusted.URL, failureTLS},
+		{slow.URL, failureTimeout},
+		{failing.URL, failureHTTP},
+		{garbage.URL, failureParse},
+		{wrongSerial.URL, failureVerify},
+	} {
+		e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, time.Second, 0)
+		e.issuer = issuer
+		e.serial = big.NewInt(1)
+		e.client = new(http.Client)
+		e.responders = []string{tc.responder}
+		if tc.class == failureTimeout {
+			e.attemptTimeout = 100 * time.Millisecond
+		}
+		before := fetchFailures.value(tc.responder, tc.class)
+		_, err := e.fetchResponse(context.Background())
+		if err == nil {
+			t.Fatalf("Fetch from %s didn't fail", tc.responder)
+		}
+		if fetchFailures.value(tc.responder, tc.class) != before+1 {
+			t.Fatalf("Fetch failure from %s wasn't counted as %s: %s", tc.responder, tc.class, err)
+		}
+	}
+}
+
+func TestOlderResponseRejected(t *testing.T) {
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	e.serial = big.NewInt(1337)
+	e.response = []byte{5, 0, 1}
+	e.thisUpdate = clk.Now().Add(-time.Hour)
+
+	for _, tc := range []struct {
+		thisUpdate time.Time
+		valid      bool
+	}{
+		{clk.Now().Add(-time.Hour * 2), false},
+		{clk.Now().Add(-time.Hour), true},
+		{clk.Now(), true},
+	} {
+		resp := &ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: e.serial,
+			ThisUpdate:   tc.thisUpdate,
+			NextUpdate:   clk.Now().Add(time.Hour),
+		}
+		err := e.verifyResponse(resp, nil)
+		if tc.valid && err != nil {
+			t.Fatalf("Failed to verify response with ThisUpdate %s: %s", tc.thisUpdate, err)
+		} else if !tc.valid && err == nil {
+			t.Fatalf("verifyResponse didn't reject response with ThisUpdate %s older than the current response", tc.thisUpdate)
+		}
+	}
+}
+
+func TestDelegatedResponder(t *testing.T) {
+	issuer, issuerKey := testIssuer(t)
+	otherIssuer, otherKey := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	e.issuer = issuer
+
+	ocspSigning := []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}
+	delegate, delegateKey := testDelegatedResponder(t, issuer, issuerKey, ocspSigning, time.Now().Add(time.Hour), nil)
+	noEKU, noEKUKey := testDelegatedResponder(t, issuer, issuerKey, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, time.Now().Add(time.Hour), nil)
+	expired, expiredKey := testDelegatedResponder(t, issuer, issuerKey, ocspSigning, clk.Now().Add(-time.Hour), nil)
+	foreign, foreignKey := testDelegatedResponder(t, otherIssuer, otherKey, ocspSigning, time.Now().Add(time.Hour), nil)
+
+	for _, tc := range []struct {
+		name     string
+		signer   *x509.Certificate
+		key      crypto.Signer
+		included *x509.Certificate
+		valid    bool
+	}{
+		{"signed by the issuer", issuer, issuerKey, nil, true},
+		{"signed by the issuer, which is included", issuer, issuerKey, issuer, true},
+		{"signed by a delegated responder", delegate, delegateKey, delegate, true},
+		{"signed by a delegated responder without OCSPSigning", noEKU, noEKUKey, noEKU, false},
+		{"signed by a expired delegated responder", expired, expiredKey, expired, false},
+		{"signed by another issuer's delegated responder", foreign, foreignKey, foreign, false},
+		{"signed by another issuer", otherIssuer, otherKey, nil, false},
+		{"signed by a delegated responder that isn't included", delegate, delegateKey, nil, false},
+	} {
+		respBytes, err := ocsp.CreateResponse(issuer, tc.signer, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(1337),
+			ThisUpdate:   clk.Now().Add(-time.Hour),
+			NextUpdate:   clk.Now().Add(time.Hour),
+			Certificate:  tc.included,
+		}, tc.key)
+		if err != nil {
+			t.Fatalf("Failed to create response %s: %s", tc.name, err)
+		}
+		_, err = e.parseResponse(respBytes)
+		if tc.valid && err != nil {
+			t.Errorf("Failed to parse response %s: %s", tc.name, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("parseResponse accepted response %s", tc.name)
+		}
+	}
+}
+
+func TestDelegatedResponderNoCheck(t *testing.T) {
+	issuer, issuerKey := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	log := NewLogger("", "", 10, clk)
+	logged := new(bytes.Buffer)
+	log.stdout = logged
+	e := NewEntry(log, clk, time.Second, time.Second, 0)
+	e.issuer = issuer
+
+	// the extension value is a ASN.1 NULL
+	noCheck := []pkix.Extension{{Id: idPKIXOCSPNoCheck, Value: []byte{5, 0}}}
+	for _, tc := range []struct {
+		extensions []pkix.Extension
+		flagged    bool
+	}{
+		{noCheck, false},
+		{nil, true},
+	} {
+		logged.Reset()
+		delegate, delegateKey := testDelegatedResponder(t, issuer, issuerKey, []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}, time.Now().Add(time.Hour), tc.extensions)
+		respBytes, err := ocsp.CreateResponse(issuer, delegate, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(1337),
+			ThisUpdate:   clk.Now().Add(-time.Hour),
+			NextUpdate:   clk.Now().Add(time.Hour),
+			Certificate:  delegate,
+		}, delegateKey)
+		if err != nil {
+			t.Fatalf("Failed to create response: %s", err)
+		}
+		_, err = e.parseResponse(respBytes)
+		if err != nil {
+			t.Fatalf("Failed to parse response from delegated responder: %s", err)
+		}
+		if flagged := strings.Contains(logged.String(), "id-pkix-ocsp-nocheck"); flagged != tc.flagged {
+			t.Fatalf("Expected delegated responder with extensions %v to be flagged: %t, log: %q", tc.extensions, tc.flagged, logged.String())
+		}
+	}
+}
+
+func TestOlderResponseIgnored(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testResponse(t, issuer, key, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(1),
+			ThisUpdate:   clk.Now().Add(-time.Hour),
+			NextUpdate:   clk.Now().Add(time.Hour),
+		}, nil))
+	}))
+	defer srv.Close()
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	e.issuer = issuer
+	e.serial = big.NewInt(1)
+	e.responders = []string{srv.URL}
+	e.retries = 2
+	e.response = []byte{5, 0, 1}
+	e.thisUpdate = clk.Now()
+	e.nextUpdate = clk.Now().Add(time.Hour)
+
+	// a responder serving an older response is behind, not failing
+	err := e.fetchAndUpdate(context.Background())
+	if err != nil {
+		t.Fatalf("Older response was treated as a failure: %s", err)
+	}
+	if e.failures != 0 || e.backingOff() {
+		t.Fatal("Older response caused the entry to back off")
+	}
+	if e.responderFailures[srv.URL] != 0 {
+		t.Fatal("Older response was counted against the responder")
+	}
+	if !bytes.Equal(e.response, []byte{5, 0, 1}) {
+		t.Fatal("Older response replaced the current one")
+	}
+}
+
+func TestVerifyResponseTimes(t *testing.T) {
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, time.Minute*5)
+	e.serial = big.NewInt(1337)
+	now := clk.Now()
+
+	for _, tc := range []struct {
+		thisUpdate time.Time
+		nextUpdate time.Time
+		producedAt time.Time
+		valid      bool
+	}{
+		{now.Add(-time.Hour), now.Add(time.Hour), now.Add(-time.Hour), true},
+		{now.Add(time.Minute), now.Add(time.Hour), now.Add(time.Minute), true},
+		{now.Add(time.Minute * 10), now.Add(time.Hour), now.Add(-time.Hour), false},
+		{now.Add(-time.Hour * 2), now.Add(-time.Hour), now.Add(-time.Hour), false},
+		{now.Add(time.Minute * 2), now.Add(time.Minute), now.Add(-time.Hour), false},
+		{now.Add(-time.Hour), now.Add(time.Hour), now.Add(time.Minute * 4), true},
+		{now.Add(-time.Hour), now.Add(time.Hour), now.Add(time.Minute * 6), false},
+	} {
+		resp := &ocsp.Response{SerialNumber: e.serial, ThisUpdate: tc.thisUpdate, NextUpdate: tc.nextUpdate, ProducedAt: tc.producedAt}
+		err := e.verifyResponse(resp, nil)
+		if tc.valid && err != nil {
+			t.Fatalf("verifyResponse failed for thisUpdate %s, nextUpdate %s, producedAt %s: %s", tc.thisUpdate, tc.nextUpdate, tc.producedAt, err)
+		} else if !tc.valid && err == nil {
+			t.Fatalf("verifyResponse didn't fail for thisUpdate %s, nextUpdate %s, producedAt %s", tc.thisUpdate, tc.nextUpdate, tc.producedAt)
+		}
+	}
+}
+
+func TestFetchNotModified(t *testing.T) {
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") != `"abc"` {
+			t.Errorf("Request didn't include expected If-None-Match header: %q", r.Header.Get("If-None-Match"))
+		}
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, time.Second, 0)
+	e.name = "not-modified"
+	e.serial = big.NewInt(1337)
+	e.request = []byte{1, 2, 3}
+	e.responders = []string{srv.URL}
+	e.eTag = `"abc"`
+	e.response = []byte{5, 0, 1}
+	e.thisUpdate = clk.Now().Add(-time.Hour)
+	e.nextUpdate = clk.Now().Add(time.Minute)
+	// force the entry into its update window
+	e.maxAge = time.Second
+	e.lastSync = clk.Now().Add(-time.Hour)
+
+	err := e.refreshResponse(context.Background())
+	if err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+	if requests != 1 {
+		t.Fatalf("Unexpected number of requests: wanted 1, got %d", requests)
+	}
+	if bytes.Compare(e.response, []byte{5, 0, 1}) != 0 {
+		t.Fatalf("Response was modified after a 304: %X", e.response)
+	}
+	if e.eTag != `"abc"` {
+		t.Fatalf("Stored eTag was lost after a 304: %q", e.eTag)
+	}
+	if e.maxAge != time.Minute*5 || !e.lastSync.Equal(clk.Now()) {
+		t.Fatalf("Caching metadata wasn't updated after a 304: maxAge %s, lastSync %s", e.maxAge, e.lastSync)
+	}
+}
+
+func TestStatusTransitions(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	log := NewLogger("", "", 10, clk)
+	logged := new(bytes.Buffer)
+	log.stdout = logged
+
+	for _, tc := range []struct {
+		from, to      int
+		refuseUnknown bool
+		accepted      bool
+	}{
+		{ocsp.Good, ocsp.Good, true, true},
+		{ocsp.Good, ocsp.Revoked, true, true},
+		{ocsp.Good, ocsp.Unknown, false, true},
+		{ocsp.Good, ocsp.Unknown, true, false},
+		{ocsp.Unknown, ocsp.Good, true, true},
+		{ocsp.Unknown, ocsp.Unknown, true, true},
+		{ocsp.Unknown, ocsp.Revoked, true, true},
+		{ocsp.Revoked, ocsp.Unknown, true, true},
+		{ocsp.Revoked, ocsp.Good, true, true},
+	} {
+		name := fmt.Sprintf("%s -> %s (refuse-unknown: %t)", statusToString[tc.from], statusToString[tc.to], tc.refuseUnknown)
+		e := NewEntry(log, clk, time.Second, time.Second, 0)
+		e.name = "status"
+		e.issuer = issuer
+		e.serial = big.NewInt(1337)
+		e.refuseUnknown = tc.refuseUnknown
+		template := ocsp.Response{
+			SerialNumber:     e.serial,
+			ThisUpdate:       clk.Now().Add(-time.Hour),
+			NextUpdate:       clk.Now().Add(time.Hour),
+			RevokedAt:        clk.Now().Add(-time.Hour * 2),
+			RevocationReason: ocsp.KeyCompromise,
+		}
+		for i, status := range []int{tc.from, tc.to} {
+			template.Status = status
+			respBytes := testResponse(t, issuer, key, template, nil)
+			resp, err := ocsp.ParseResponse(respBytes, issuer)
+			if err != nil {
+				t.Fatalf("%s: Failed to parse response: %s", name, err)
+			}
+			logged.Reset()
+			err = e.verifyResponse(resp, respBytes)
+			if i == 1 && !tc.accepted {
+				if err == nil {
+					t.Fatalf("%s: verifyResponse didn't reject response", name)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: verifyResponse failed: %s", name, err)
+			}
+			err = e.updateResponse("", cacheControl{}, resp, respBytes, false)
+			if err != nil {
+				t.Fatalf("%s: Failed to update response: %s", name, err)
+			}
+			revocationLogged := strings.Contains(logged.String(), "revoked") && strings.Contains(logged.String(), "keyCompromise")
+			if wanted := status == ocsp.Revoked; revocationLogged != wanted {
+				t.Fatalf("%s: Unexpected revocation logging: wanted %t, got %q", name, wanted, logged.String())
+			}
+		}
+		expected := tc.to
+		if !tc.accepted {
+			expected = tc.from
+		}
+		if e.status != expected {
+			t.Fatalf("%s: Unexpected status after update: wanted %s, got %s", name, statusToString[expected], statusToString[e.status])
+		}
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	for h, expected := range map[string]cacheControl{
+		"":                               {},
+		"max-age=300":                    {maxAge: 300},
+		"public, max-age=300":            {maxAge: 300},
+		`max-age="60", must-revalidate`:  {maxAge: 60},
+		"Max-Age=10":                     {maxAge: 10},
+		"max-age=bad":                    {},
+		"no-store":                       {noStore: true},
+		"no-cache":                       {noCache: true},
+		"max-age=0, no-cache, no-store":  {noStore: true, noCache: true},
+		`no-cache="Set-Cookie", private`: {noCache: true},
+	} {
+		if cc := parseCacheControl(h); cc != expected {
+			t.Fatalf("Unexpected result parsing %q: wanted %+v, got %+v", h, expected, cc)
+		}
+	}
+}
+
+func TestCacheControlDirectives(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	tmpDir, err := ioutil.TempDir("", "stapled")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	respBytes := testResponse(t, issuer, key, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1337),
+		ThisUpdate:   clk.Now().Add(-time.Hour),
+		NextUpdate:   clk.Now().Add(time.Hour * 24),
+	}, nil)
+	resp, err := ocsp.ParseResponse(respBytes, issuer)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %s", err)
+	}
+
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	e.name = "cache-control"
+	e.serial = big.NewInt(1337)
+	e.generateResponseFilename(tmpDir)
+
+	// no-store responses are served but not written to disk
+	err = e.updateResponse("", parseCacheControl("no-store"), resp, respBytes, true)
+	if err != nil {
+		t.Fatalf("Failed to update response: %s", err)
+	}
+	if bytes.Compare(e.response, respBytes) != 0 {
+		t.Fatal("no-store response wasn't kept in memory")
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmpDir, "*")); len(files) != 0 {
+		t.Fatalf("no-store response was written to disk: %s", files)
+	}
+	if e.timeToUpdate() {
+		t.Fatal("Fresh response without no-cache was revalidated")
+	}
+
+	// no-cache responses are revalidated every time they're checked
+	err = e.updateResponse("", parseCacheControl("no-cache"), resp, respBytes, true)
+	if err != nil {
+		t.Fatalf("Failed to update response: %s", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmpDir, "*.resp")); len(files) != 1 {
+		t.Fatalf("no-cache response wasn't written to disk: %s", files)
+	}
+	if !e.timeToUpdate() {
+		t.Fatal("no-cache response wasn't revalidated")
+	}
+}
+
+func TestSignatureAlgorithmPolicy(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate ECDSA key: %s", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %s", err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %s", err)
+	}
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	log := NewLogger("", "", 10, clk)
+	log.stdout = ioutil.Discard
+	e := NewEntry(log, clk, time.Second, time.Second, 0)
+	e.serial = big.NewInt(1)
+
+	for _, tc := range []struct {
+		key      crypto.Signer
+		policy   string
+		accepted []x509.SignatureAlgorithm
+		rejected []x509.SignatureAlgorithm
+	}{
+		{ecdsaKey, "", []x509.SignatureAlgorithm{x509.ECDSAWithSHA1, x509.ECDSAWithSHA256, x509.ECDSAWithSHA384}, nil},
+		{ecdsaKey, "sha256", []x509.SignatureAlgorithm{x509.ECDSAWithSHA256, x509.ECDSAWithSHA384}, []x509.SignatureAlgorithm{x509.ECDSAWithSHA1}},
+		{ecdsaKey, "SHA384", []x509.SignatureAlgorithm{x509.ECDSAWithSHA384}, []x509.SignatureAlgorithm{x509.ECDSAWithSHA1, x509.ECDSAWithSHA256}},
+		// golang.org/x/crypto/ocsp doesn't know about RSA-PSS or Ed25519
+		// but they're as strong as the hashes they use
+		{rsaKey, "sha256", []x509.SignatureAlgorithm{x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS}, []x509.SignatureAlgorithm{x509.SHA1WithRSA}},
+		{rsaKey, "sha512", []x509.SignatureAlgorithm{x509.SHA512WithRSA, x509.SHA512WithRSAPSS}, []x509.SignatureAlgorithm{x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS}},
+		{ed25519Key, "", []x509.SignatureAlgorithm{x509.PureEd25519}, nil},
+		{ed25519Key, "sha512", []x509.SignatureAlgorithm{x509.PureEd25519}, nil},
+	} {
+		issuer := testIssuerWithKey(t, tc.key)
+		e.issuer = issuer
+		e.minSignatureHash, err = parseMinSignatureHash(tc.policy)
+		if err != nil {
+			t.Fatalf("Failed to parse policy '%s': %s", tc.policy, err)
+		}
+		verify := func(algo x509.SignatureAlgorithm) error {
+			respBytes := testResponse(t, issuer, tc.key, ocsp.Response{
+				Status:             ocsp.Good,
+				SerialNumber:       e.serial,
+				ThisUpdate:         clk.Now().Add(-time.Hour),
+				NextUpdate:         clk.Now().Add(time.Hour),
+				SignatureAlgorithm: algo,
+			}, nil)
+			resp, err := e.parseResponse(respBytes)
+			if err != nil {
+				t.Fatalf("Failed to parse response signed using %s: %s", algo, err)
+			}
+			if resp.SignatureAlgorithm != algo {
+				t.Fatalf("Response signed using %s instead of %s", resp.SignatureAlgorithm, algo)
+			}
+			return e.verifyResponse(resp, respBytes)
+		}
+		for _, algo := range tc.accepted {
+			if err := verify(algo); err != nil {
+				t.Fatalf("Response signed using %s rejected with policy '%s': %s", algo, tc.policy, err)
+			}
+		}
+		for _, algo := range tc.rejected {
+			if err := verify(algo); err == nil || !strings.Contains(err.Error(), "weak OCSP response signature") {
+				t.Fatalf("Response signed using %s wasn't rejected with policy '%s': %v", algo, tc.policy, err)
+			}
+		}
+	}
+
+	if _, err := parseMinSignatureHash("md4"); err == nil {
+		t.Fatal("Unsupported signature hash was accepted")
+	}
+}
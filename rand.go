@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+// lockedSource is a math/rand source that is safe for concurrent
+// use, unlike the sources returned by mrand.NewSource
+type lockedSource struct {
+	mu  sync.Mutex
+	src mrand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// newRand returns a generator seeded with seed that is safe for
+// concurrent use, tests can use a fixed seed to get reproducible
+// responder selection and jitter
+func newRand(seed int64) *mrand.Rand {
+	return mrand.New(&lockedSource{src: mrand.NewSource(seed)})
+}
+
+// randomSeed returns a seed read from crypto/rand so separate
+// processes don't make the same choices, falling back to the
+// current time if it can't be read
+func randomSeed() int64 {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.BigEndian.Uint64(b[:]))
+}
+
+// processRand seeds the generators given to each entry and is used
+// by entries that haven't been given their own
+var processRand = newRand(randomSeed())
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmhodges/clock"
+)
+
+// errThrottled is returned when a fetch wasn't attempted because all of
+// the entry's responders are on hosts that are being rate limited
+var errThrottled = errors.New("all responders are rate limited")
+
+// tokenBucket tracks the requests that can be sent to a single host
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// hostLimiter limits how many requests are sent to each responder host
+// across all entries using a token bucket per host, so that a large
+// number of certificates from the same CA don't overwhelm its responder
+type hostLimiter struct {
+	clk   clock.Clock
+	rate  float64 // requests per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newHostLimiter creates a limiter allowing rate requests per second to
+// each host, with bursts of up to burst requests. If burst is less than
+// one it defaults to rate rounded up
+func newHostLimiter(clk clock.Clock, rate float64, burst int) *hostLimiter {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &hostLimiter{
+		clk:     clk,
+		rate:    rate,
+		burst:   b,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow returns whether a request can be sent to host now, taking a
+// token if it can. A nil limiter allows everything
+func (l *hostLimiter) allow(host string) bool {
+	if l == nil {
+		return true
+	}
+	host = strings.ToLower(host)
+	now := l.clk.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, present := l.buckets[host]
+	if !present {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[host] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed.Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// interval returns how long it takes for a host to be allowed another
+// request once it has been limited
+func (l *hostLimiter) interval() time.Duration {
+	return time.Duration(float64(time.Second) / l.rate)
+}
+
+// responderHost returns the host requests to responder are sent to, or
+// responder itself if it can't be parsed
+func responderHost(responder string) string {
+	u, err := url.Parse(responder)
+	if err != nil || u.Hostname() == "" {
+		return responder
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/context"
+)
+
+func TestHostLimiter(t *testing.T) {
+	clk := clock.NewFake()
+	l := newHostLimiter(clk, 2, 3)
+
+	for i := 0; i < 3; i++ {
+		if !l.allow("ocsp.example.com") {
+			t.Fatalf("Request %d of the burst wasn't allowed", i)
+		}
+	}
+	if l.allow("OCSP.example.com") {
+		t.Fatal("Request over the burst was allowed")
+	}
+	if !l.allow("other.example.com") {
+		t.Fatal("Limit on one host affected another host")
+	}
+	clk.Add(time.Second / 2)
+	if !l.allow("ocsp.example.com") {
+		t.Fatal("Request wasn't allowed once a token had been added")
+	}
+	if l.allow("ocsp.example.com") {
+		t.Fatal("More requests allowed than tokens added")
+	}
+	// tokens don't accumulate past the burst
+	clk.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		l.allow("ocsp.example.com")
+	}
+	if l.allow("ocsp.example.com") {
+		t.Fatal("Tokens accumulated past the burst")
+	}
+
+	var nilLimiter *hostLimiter
+	if !nilLimiter.allow("ocsp.example.com") {
+		t.Fatal("nil limiter didn't allow request")
+	}
+	if d := newHostLimiter(clk, 0.5, 0).burst; d != 1 {
+		t.Fatalf("Unexpected default burst for a rate below one: %g", d)
+	}
+}
+
+func TestRefreshThrottled(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Write(testResponse(t, issuer, key, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(1),
+			ThisUpdate:   clk.Now().Add(-time.Hour),
+			NextUpdate:   clk.Now().Add(time.Hour),
+		}, nil))
+	}))
+	defer srv.Close()
+
+	limiter := newHostLimiter(clk, 1, 1)
+	newEntry := func() *Entry {
+		e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, time.Second, 0)
+		e.issuer = issuer
+		e.serial = big.NewInt(1)
+		request, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: e.serial}, issuer, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %s", err)
+		}
+		e.request = request
+		e.client = new(http.Client)
+		e.responders = []string{srv.URL}
+		e.limiter = limiter
+		return e
+	}
+
+	a, b := newEntry(), newEntry()
+	err := a.refreshResponse(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to refresh response: %s", err)
+	}
+	err = b.refreshResponse(context.Background())
+	if err != errThrottled {
+		t.Fatalf("Refresh of second entry for the same host wasn't throttled: %v", err)
+	}
+	if atomic.LoadInt64(&requests) != 1 {
+		t.Fatalf("Throttled refresh sent a request, %d requests sent", requests)
+	}
+	if b.backingOff() {
+		t.Fatal("Throttled refresh was treated as a failure")
+	}
+
+	// the initial fetch waits for the limit rather than failing
+	c := newEntry()
+	err = c.Init()
+	if err != nil {
+		t.Fatalf("Init failed while throttled: %s", err)
+	}
+	if c.response == nil {
+		t.Fatal("Init didn't fetch a response once the limit allowed it")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisStorage stores each key in a Redis server shared between
+// multiple stapled instances, keys expire when the response stored
+// under them does. Only the handful of commands needed are implemented
+// so the protocol is spoken directly rather than pulling in a client
+// library. A single connection is used and if anything goes wrong
+// with it it is thrown away and a new one dialed for the next command
+type redisStorage struct {
+	addr    string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisStorage(addr string, timeout time.Duration) *redisStorage {
+	return &redisStorage{addr: addr, timeout: timeout}
+}
+
+// errRedisNil is returned by do when the server replies with a
+// nil bulk string
+var errRedisNil = errors.New("nil reply")
+
+// redisError is a error reply sent by the server, the connection is
+// still usable after one of these
+type redisError string
+
+func (r redisError) Error() string {
+	return string(r)
+}
+
+// do sends a command to the server and returns the reply, simple
+// strings and integers are returned as their textual form
+func (r *redisStorage) do(args ...[]byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		conn, err := net.DialTimeout("tcp", r.addr, r.timeout)
+		if err != nil {
+			return nil, err
+		}
+		r.conn, r.reader = conn, bufio.NewReader(conn)
+	}
+	reply, err := r.roundTrip(args)
+	if _, isReply := err.(redisError); err != nil && !isReply && err != errRedisNil {
+		r.conn.Close()
+		r.conn, r.reader = nil, nil
+	}
+	return reply, err
+}
+
+func (r *redisStorage) roundTrip(args [][]byte) ([]byte, error) {
+	err := r.conn.SetDeadline(time.Now().Add(r.timeout))
+	if err != nil {
+		return nil, err
+	}
+	cmd := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		cmd = append(cmd, fmt.Sprintf("$%d\r\n", len(arg))...)
+		cmd = append(append(cmd, arg...), "\r\n"...)
+	}
+	_, err = r.conn.Write(cmd)
+	if err != nil {
+		return nil, err
+	}
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("malformed bulk string length: %s", err)
+		}
+		if size < 0 {
+			return nil, errRedisNil
+		}
+		if size > maxStoredSize {
+			return nil, fmt.Errorf("reply is larger than %d bytes", maxStoredSize)
+		}
+		value := make([]byte, size+2)
+		_, err = io.ReadFull(r.reader, value)
+		if err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	default:
+		return nil, fmt.Errorf("unexpected reply type '%c'", line[0])
+	}
+}
+
+// readLine reads a CRLF terminated line from the server, without
+// the CRLF
+func (r *redisStorage) readLine() ([]byte, error) {
+	line, err := r.reader.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed reply")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (r *redisStorage) read(key string) ([]byte, error) {
+	value, err := r.do([]byte("GET"), []byte(key))
+	if err == errRedisNil {
+		return nil, os.ErrNotExist
+	}
+	return value, err
+}
+
+func (r *redisStorage) write(key string, contents []byte, ttl time.Duration) error {
+	args := [][]byte{[]byte("SET"), []byte(key), contents}
+	if ttl > 0 {
+		if ttl < time.Millisecond {
+			ttl = time.Millisecond
+		}
+		args = append(args, []byte("PX"), []byte(strconv.FormatInt(int64(ttl/time.Millisecond), 10)))
+	}
+	_, err := r.do(args...)
+	return err
+}
@@ -1,25 +1,105 @@
 package main
 
 import (
+	"crypto"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	cflog "github.com/cloudflare/cfssl/log"
-	cfocsp "github.com/cloudflare/cfssl/ocsp"
 	"golang.org/x/crypto/ocsp"
 )
 
+// maxGETRequestLength is the longest base64 encoded request that will be
+// accepted via GET, RFC 5019 suggests clients should use POST for anything
+// longer than 255 bytes
+const maxGETRequestLength = 255
+
+// defaultMaxRequestSize is the largest POST body that will be read
+// if a size isn't explicitly configured
+const defaultMaxRequestSize = 4096
+
+// missResponses maps the configurable cache miss behaviours to the
+// pre-signed OCSP error response that should be sent, a nil response
+// means a plain 404 should be sent instead
+var missResponses = map[string][]byte{
+	"unauthorized": ocsp.UnauthorizedErrorResponse,
+	"try-later":    ocsp.TryLaterErrorResponse,
+	"not-found":    nil,
+}
+
+// Response returns the DER encoded OCSP response for r and whether one
+// was found. It first checks the cache and, if there is no matching
+// entry and upstream responders are configured, creates a new entry by
+// fetching a response from upstream, which blocks for up to the client
+// timeout. The returned slice is shared with the cache and must not be
+// modified.
+//
+// Response is safe to call from multiple goroutines, including from
+// a tls.Config.GetCertificate callback while the responder is serving
+// requests and entries are being refreshed, since the lookup table and
+// each entry are protected by their own locks.
 func (s *stapled) Response(r *ocsp.Request) ([]byte, bool) {
-	if response, present := s.c.lookupResponse(r); present {
-		return response, present
+	e, present := s.entry(r)
+	if !present {
+		return nil, false
+	}
+	e.mu.RLock()
+	response, nextUpdate := e.response, e.nextUpdate
+	e.mu.RUnlock()
+	if response == nil || !s.servable(e, nextUpdate) {
+		return nil, false
+	}
+	return response, true
+}
+
+// servable checks whether the response for e, which expires at
+// nextUpdate, can be served. Stale responses are still signed, and
+// clients may prefer them to nothing, so they are served until they
+// are replaced unless staleGrace is set, in which case they're only
+// served for that long past their NextUpdate. Every request for a
+// stale response is counted but it is only logged once per response
+func (s *stapled) servable(e *Entry, nextUpdate time.Time) bool {
+	now := s.clk.Now()
+	if nextUpdate.After(now) {
+		return true
+	}
+	if s.staleGrace > 0 && now.Sub(nextUpdate) > s.staleGrace {
+		staleResponses.inc("refused")
+		if e.firstStale(true, nextUpdate) {
+			s.log.Warning("[responder] Not serving response for '%s', it went stale at %s, more than %s ago", e.name, nextUpdate, s.staleGrace)
+		}
+		return false
+	}
+	staleResponses.inc("served")
+	if e.firstStale(false, nextUpdate) {
+		s.log.Warning("[responder] Serving stale response for '%s', it went stale at %s", e.name, nextUpdate)
+	}
+	return true
+}
+
+// entry returns the cache entry for r, creating one using the upstream
+// responders if there isn't one and any are configured
+func (s *stapled) entry(r *ocsp.Request) (*Entry, bool) {
+	if e, present := s.c.lookupEntry(r); present {
+		return e, present
 	}
 	if len(s.upstreamResponders) == 0 {
 		return nil, false
 	}
 
 	// this should live somewhere else
-	e := NewEntry(s.log, s.clk, s.clientTimeout, s.clientBackoff)
+	e := s.newEntry()
 	e.serial = r.SerialNumber
 	var err error
 	e.request, err = r.Marshal()
@@ -28,24 +108,369 @@ func (s *stapled) Response(r *ocsp.Request) ([]byte, bool) {
 		return nil, false
 	}
 	e.responders = s.upstreamResponders
-	serialHash := sha256.Sum256(e.serial.Bytes())
-	key := sha256.Sum256(append(append(r.IssuerNameHash, r.IssuerKeyHash...), serialHash[:]...))
-	e.name = fmt.Sprintf("%X", key)
-	if s.cacheFolder != "" {
-		e.generateResponseFilename(s.cacheFolder)
-	}
+	key, name := requestKey(r)
+	e.name = name
+	e.generateResponseFilename(s.cacheFolder)
 	err = e.Init()
 	if err != nil {
 		s.log.Err("Failed to initialize new entry: %s", err)
 		return nil, false
 	}
-	s.c.addSingle(e, key)
-	return e.response, true
+	err = s.c.addSingle(e, key)
+	if err != nil {
+		// the entry still has a response that can be served
+		s.log.Warning("Failed to add new entry to cache: %s", err)
+	}
+	return e, true
+}
+
+// requestKey returns the lookup key for r, and the entry name derived
+// from it, used for entries created for a request rather than from a
+// definition. Both include the issuer so that certificates with the same
+// serial from different issuers get separate entries
+func requestKey(r *ocsp.Request) ([32]byte, string) {
+	serialHash := sha256.Sum256(r.SerialNumber.Bytes())
+	material := append(append(append([]byte{}, r.IssuerNameHash...), r.IssuerKeyHash...), serialHash[:]...)
+	key := sha256.Sum256(material)
+	return key, fmt.Sprintf("%X", key)
+}
+
+// Staple returns a OCSP response for leaf, which was issued by issuer,
+// that can be used as tls.Certificate.OCSPStaple. If there isn't already
+// a cache entry for leaf one is created, using the responders from its
+// AIA extension or the upstream responders if it doesn't have any, and a
+// response is fetched before returning, which blocks for up to the client
+// timeout. The same happens if the entry Staple created earlier doesn't
+// have a response or its response is too stale to serve, see servable.
+// Once created the entry is kept up to date by the cache like any other
+// so Staple can be called again to get the latest response.
+func (s *stapled) Staple(leaf, issuer *x509.Certificate) ([]byte, error) {
+	nameHash, keyHash, err := hashNameAndPKI(crypto.SHA1.New(), issuer.RawSubject, issuer.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash issuer: %s", err)
+	}
+	request := &ocsp.Request{
+		HashAlgorithm:  crypto.SHA1,
+		IssuerNameHash: nameHash,
+		IssuerKeyHash:  keyHash,
+		SerialNumber:   leaf.SerialNumber,
+	}
+	_, name := requestKey(request)
+	existing, present := s.c.lookupEntry(request)
+	if present {
+		existing.mu.RLock()
+		response, nextUpdate := existing.response, existing.nextUpdate
+		existing.mu.RUnlock()
+		if response != nil && s.servable(existing, nextUpdate) {
+			return response, nil
+		}
+		// entries created from definitions are refreshed by the cache,
+		// only those created by Staple or the responder are replaced
+		if existing.name != name {
+			return nil, fmt.Errorf("entry '%s' doesn't have a servable response", existing.name)
+		}
+	}
+
+	e := s.newEntry()
+	e.name = name
+	e.serial = leaf.SerialNumber
+	e.issuer = issuer
+	e.responders = leaf.OCSPServer
+	if len(e.responders) == 0 {
+		e.responders = s.upstreamResponders
+	}
+	if len(e.responders) == 0 {
+		return nil, fmt.Errorf("no responders available for certificate with serial %X", leaf.SerialNumber)
+	}
+	e.generateResponseFilename(s.cacheFolder)
+	err = e.Init()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize entry: %s", err)
+	}
+	if present {
+		err = s.c.replace(e)
+	} else {
+		err = s.c.add(e)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to add entry to cache: %s", err)
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.response, nil
+}
+
+// decodeGETRequest extracts a DER encoded OCSP request from the path of
+// a GET request as described in RFC 6960 Appendix A.1
+func decodeGETRequest(r *http.Request) ([]byte, error) {
+	b64Request, err := url.QueryUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unescape request path: %s", err)
+	}
+	// url.QueryUnescape decodes '+' as a space, which makes base64
+	// decoding fail, so turn them back into '+'
+	b64Request = strings.Replace(b64Request, " ", "+", -1)
+	if len(b64Request) > maxGETRequestLength {
+		return nil, fmt.Errorf("request is longer than %d bytes", maxGETRequestLength)
+	}
+	return base64.StdEncoding.DecodeString(b64Request)
 }
 
-func (s *stapled) initResponder(httpAddr string, logger *Logger) {
-	cflog.SetLogger(&responderLogger{logger})
-	m := http.StripPrefix("/", cfocsp.NewResponder(s))
+// serveOCSP handles a OCSP request sent via either GET or POST
+func (s *stapled) serveOCSP(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	var err error
+	switch r.Method {
+	case "GET":
+		body, err = decodeGETRequest(r)
+		if err != nil {
+			s.log.Err("[responder] Failed to decode GET request '%s': %s", r.URL.Path, err)
+			w.Header().Set("Content-Type", "application/ocsp-response")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(ocsp.MalformedRequestErrorResponse)
+			return
+		}
+	case "POST":
+		if ct := r.Header.Get("Content-Type"); ct != "application/ocsp-request" {
+			s.log.Err("[responder] POST request has invalid Content-Type '%s'", ct)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.ContentLength > s.maxRequestSize {
+			s.log.Err("[responder] POST body is larger than %d bytes", s.maxRequestSize)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, s.maxRequestSize+1))
+		if err != nil {
+			s.log.Err("[responder] Failed to read POST body: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > s.maxRequestSize {
+			s.log.Err("[responder] POST body is larger than %d bytes", s.maxRequestSize)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		s.log.Err("[responder] Failed to parse request: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	var response []byte
+	var thisUpdate, nextUpdate time.Time
+	e, present := s.entry(request)
+	if present {
+		e.mu.RLock()
+		response, thisUpdate, nextUpdate = e.response, e.thisUpdate, e.nextUpdate
+		e.mu.RUnlock()
+		present = response != nil && s.servable(e, nextUpdate)
+	}
+	if !present {
+		s.log.Info("[responder] No response found for request for serial %X", request.SerialNumber)
+		if s.missResponse == nil {
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(s.missResponse)
+		return
+	}
+	setCachingHeaders(w.Header(), response, thisUpdate, nextUpdate, s.clk.Now())
+	if r.Method == "GET" && notModified(r, responseETag(response), thisUpdate) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// responseETag returns the ETag a response is served with
+func responseETag(response []byte) string {
+	hash := sha256.Sum256(response)
+	return fmt.Sprintf("\"%X\"", hash)
+}
+
+// setCachingHeaders sets the headers RFC 5019 Section 6.2 recommends so
+// that HTTP caches in front of the responder cache a response until
+// its NextUpdate
+func setCachingHeaders(header http.Header, response []byte, thisUpdate, nextUpdate, now time.Time) {
+	maxAge := int(nextUpdate.Sub(now).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	header.Set("Last-Modified", thisUpdate.UTC().Format(http.TimeFormat))
+	header.Set("Expires", nextUpdate.UTC().Format(http.TimeFormat))
+	header.Set("ETag", responseETag(response))
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%d, public, no-transform, must-revalidate", maxAge))
+}
+
+// notModified checks whether a conditional GET is for a response the
+// client already has. As described in RFC 7232 Section 6 If-None-Match
+// is used if present, otherwise If-Modified-Since is compared against
+// ThisUpdate
+func notModified(r *http.Request, eTag string, thisUpdate time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == eTag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		// HTTP dates only have second precision
+		return !thisUpdate.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// unhealthyEntry describes why a entry is unhealthy
+type unhealthyEntry struct {
+	Name       string    `json:"name"`
+	Reason     string    `json:"reason"`
+	NextUpdate time.Time `json:"next-update"`
+	CRLStatus  string    `json:"crl-status,omitempty"` // informational only
+}
+
+// healthReport is the body returned by the health endpoint
+type healthReport struct {
+	Healthy        bool             `json:"healthy"`
+	Total          int              `json:"total"`
+	HealthyEntries int              `json:"healthy-entries"`
+	Unhealthy      []unhealthyEntry `json:"unhealthy,omitempty"`
+}
+
+// health checks each of the entries in the cache, entries are unhealthy
+// if they have no responders, their response has expired, or their last
+// refresh failed. Unless dontDieOnStaleResponse is set any unhealthy
+// entry makes stapled as a whole unhealthy
+func (s *stapled) health() healthReport {
+	now := s.clk.Now()
+	entries := s.c.snapshot()
+	sort.Sort(entriesByName(entries))
+	report := healthReport{Total: len(entries)}
+	for _, e := range entries {
+		e.mu.RLock()
+		nextUpdate, failures, crlStatus := e.nextUpdate, e.failures, e.crlStatusString()
+		noResponders := len(e.responders) == 0
+		e.mu.RUnlock()
+		reason := ""
+		if noResponders {
+			reason = "no responders configured"
+		} else if !nextUpdate.After(now) {
+			reason = "response has expired"
+		} else if failures > 0 {
+			reason = fmt.Sprintf("last %d refreshes failed", failures)
+		}
+		if reason == "" {
+			report.HealthyEntries++
+			continue
+		}
+		report.Unhealthy = append(report.Unhealthy, unhealthyEntry{e.name, reason, nextUpdate, crlStatus})
+	}
+	report.Healthy = len(report.Unhealthy) == 0 || s.dontDieOnStaleResponse
+	return report
+}
+
+// serveHealth writes a JSON health report, returning a 503 if stapled
+// is unhealthy so it can be used by load balancers and liveness probes
+func (s *stapled) serveHealth(w http.ResponseWriter, r *http.Request) {
+	report := s.health()
+	body, err := json.Marshal(report)
+	if err != nil {
+		s.log.Err("[responder] Failed to marshal health report: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+// readinessReport is the body returned by the ready endpoint
+type readinessReport struct {
+	Ready   bool     `json:"ready"`
+	Total   int      `json:"total"`
+	Synced  int      `json:"synced"`
+	Pending []string `json:"pending,omitempty"`
+}
+
+// readiness checks whether every entry has had a valid response, either
+// fetched or read from the cache, so that stapled can actually staple
+// something for each of them. Entries without responders are ignored
+// since they'll never get a response. Once stapled has been ready it
+// stays ready, entries added later don't take it back out of rotation,
+// problems after that point are reported by the health endpoint
+func (s *stapled) readiness() readinessReport {
+	entries := s.c.snapshot()
+	sort.Sort(entriesByName(entries))
+	report := readinessReport{Total: len(entries)}
+	for _, e := range entries {
+		e.mu.RLock()
+		synced, noResponders := e.synced, len(e.responders) == 0
+		e.mu.RUnlock()
+		if synced {
+			report.Synced++
+		} else if !noResponders {
+			report.Pending = append(report.Pending, e.name)
+		}
+	}
+	if len(report.Pending) == 0 {
+		atomic.StoreInt32(&s.ready, 1)
+	}
+	report.Ready = atomic.LoadInt32(&s.ready) == 1
+	return report
+}
+
+// serveReady writes a JSON readiness report, returning a 503 until
+// every entry has had a valid response so load balancers don't send
+// requests to an instance that is still warming up
+func (s *stapled) serveReady(w http.ResponseWriter, r *http.Request) {
+	report := s.readiness()
+	body, err := json.Marshal(report)
+	if err != nil {
+		s.log.Err("[responder] Failed to marshal readiness report: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+func (s *stapled) initResponder(httpAddr string, maxRequestSize int64, missBehaviour string) error {
+	s.maxRequestSize = maxRequestSize
+	if s.maxRequestSize <= 0 {
+		s.maxRequestSize = defaultMaxRequestSize
+	}
+	if missBehaviour == "" {
+		missBehaviour = "unauthorized"
+	}
+	missResponse, present := missResponses[missBehaviour]
+	if !present {
+		return fmt.Errorf("invalid cache miss response '%s'", missBehaviour)
+	}
+	s.missResponse = missResponse
 	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// hack to make monitors that just check / returns a 200 are satisfied
 		if r.Method == "GET" && r.URL.Path == "/" {
@@ -53,10 +478,27 @@ func (s *stapled) initResponder(httpAddr string, logger *Logger) {
 			w.WriteHeader(200)
 			return
 		}
-		m.ServeHTTP(w, r)
+		// "health" and "ready" aren't valid padded base64 so they
+		// can't be confused with a OCSP request
+		if r.Method == "GET" && r.URL.Path == "/health" {
+			s.serveHealth(w, r)
+			return
+		}
+		if r.Method == "GET" && r.URL.Path == "/ready" {
+			s.serveReady(w, r)
+			return
+		}
+		// base64 encoded OCSP requests always start with 'M' so they
+		// can't be confused with the admin endpoints
+		if s.adminToken != "" && strings.HasPrefix(r.URL.Path, "/admin/") {
+			s.serveAdmin(w, r)
+			return
+		}
+		s.serveOCSP(w, r)
 	})
 	s.responder = &http.Server{
 		Addr:    httpAddr,
 		Handler: h,
 	}
+	return nil
 }
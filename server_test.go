@@ -1 +1,573 @@
 package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"golang.org/x/crypto/ocsp"
+)
+
+func testResponder(t *testing.T) (*stapled, *Entry) {
+	clk := clock.NewFake()
+	logger := NewLogger("", "", 10, clk)
+	issuer, err := ReadCertificate("testdata/test-issuer.der")
+	if err != nil {
+		t.Fatalf("Failed to read test issuer: %s", err)
+	}
+	e := &Entry{
+		mu:       new(sync.RWMutex),
+		name:     "test.der",
+		serial:   big.NewInt(1337),
+		issuer:   issuer,
+		response: []byte{5, 0, 1},
+	}
+	s := &stapled{Options: Options{log: logger, clk: clk}, c: newCache(logger, time.Minute, nil, 0)}
+	err = s.initResponder("", 0, "")
+	if err != nil {
+		t.Fatalf("Failed to initialize responder: %s", err)
+	}
+	err = s.c.add(e)
+	if err != nil {
+		t.Fatalf("Failed to add entry to cache: %s", err)
+	}
+	return s, e
+}
+
+func testRequest(t *testing.T, e *Entry, serial *big.Int) []byte {
+	nameHash, pkHash, err := hashNameAndPKI(crypto.SHA1.New(), e.issuer.RawSubject, e.issuer.RawSubjectPublicKeyInfo)
+	if err != nil {
+		t.Fatalf("Failed to hash subject and public key info: %s", err)
+	}
+	req := &ocsp.Request{HashAlgorithm: crypto.SHA1, IssuerNameHash: nameHash, IssuerKeyHash: pkHash, SerialNumber: serial}
+	der, err := req.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %s", err)
+	}
+	return der
+}
+
+func newTestRequest(t *testing.T, method, path string, body io.Reader) *http.Request {
+	r, err := http.NewRequest(method, path, body)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	return r
+}
+
+func TestServeOCSPGet(t *testing.T) {
+	s, e := testResponder(t)
+	path := "/" + url.QueryEscape(base64.StdEncoding.EncodeToString(testRequest(t, e, e.serial)))
+
+	w := httptest.NewRecorder()
+	s.serveOCSP(w, newTestRequest(t, "GET", path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code: wanted %d, got %d", http.StatusOK, w.Code)
+	}
+	if bytes.Compare(w.Body.Bytes(), e.response) != 0 {
+		t.Fatalf("Responder returned wrong response: wanted %X, got %X", e.response, w.Body.Bytes())
+	}
+
+	for _, path := range []string{
+		"/not-base64!",
+		"/" + strings.Repeat("A", maxGETRequestLength+1),
+	} {
+		w = httptest.NewRecorder()
+		s.serveOCSP(w, newTestRequest(t, "GET", path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Unexpected status code for '%s': wanted %d, got %d", path, http.StatusBadRequest, w.Code)
+		}
+		body, _ := ioutil.ReadAll(w.Body)
+		if bytes.Compare(body, ocsp.MalformedRequestErrorResponse) != 0 {
+			t.Fatalf("Responder didn't return malformedRequest response for '%s': got %X", path, body)
+		}
+	}
+}
+
+func TestServeOCSPCachingHeaders(t *testing.T) {
+	s, e := testResponder(t)
+	clk := s.clk.(clock.FakeClock)
+	clk.Add(time.Hour * 24 * 365)
+	e.thisUpdate = clk.Now().Add(-time.Hour).Add(time.Millisecond * 300)
+	e.nextUpdate = clk.Now().Add(time.Hour * 2)
+	path := "/" + url.QueryEscape(base64.StdEncoding.EncodeToString(testRequest(t, e, e.serial)))
+
+	w := httptest.NewRecorder()
+	s.serveOCSP(w, newTestRequest(t, "GET", path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code: wanted %d, got %d", http.StatusOK, w.Code)
+	}
+	for header, expected := range map[string]string{
+		"Last-Modified": e.thisUpdate.UTC().Format(http.TimeFormat),
+		"Expires":       e.nextUpdate.UTC().Format(http.TimeFormat),
+		"Cache-Control": "max-age=7200, public, no-transform, must-revalidate",
+		"ETag":          responseETag(e.response),
+	} {
+		if actual := w.Header().Get(header); actual != expected {
+			t.Fatalf("Unexpected %s header: wanted %q, got %q", header, expected, actual)
+		}
+	}
+	lastModified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	if err != nil || !lastModified.Equal(e.thisUpdate.Truncate(time.Second)) {
+		t.Fatalf("Last-Modified doesn't match ThisUpdate %s: %s, %v", e.thisUpdate, lastModified, err)
+	}
+
+	// a expired response shouldn't be cached at all
+	clk.Add(time.Hour * 3)
+	w = httptest.NewRecorder()
+	s.serveOCSP(w, newTestRequest(t, "GET", path, nil))
+	if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "max-age=0,") {
+		t.Fatalf("Unexpected Cache-Control for expired response: %q", cc)
+	}
+}
+
+func TestServeOCSPConditionalGet(t *testing.T) {
+	s, e := testResponder(t)
+	clk := s.clk.(clock.FakeClock)
+	clk.Add(time.Hour * 24 * 365)
+	e.thisUpdate = clk.Now().Add(-time.Hour)
+	e.nextUpdate = clk.Now().Add(time.Hour)
+	path := "/" + url.QueryEscape(base64.StdEncoding.EncodeToString(testRequest(t, e, e.serial)))
+	eTag := responseETag(e.response)
+	thisUpdate := e.thisUpdate.UTC().Format(http.TimeFormat)
+
+	for _, tc := range []struct {
+		header   string
+		value    string
+		expected int
+	}{
+		{"If-None-Match", eTag, http.StatusNotModified},
+		{"If-None-Match", `"other", ` + eTag, http.StatusNotModified},
+		{"If-None-Match", "W/" + eTag, http.StatusNotModified},
+		{"If-None-Match", "*", http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusOK},
+		{"If-Modified-Since", thisUpdate, http.StatusNotModified},
+		{"If-Modified-Since", clk.Now().UTC().Format(http.TimeFormat), http.StatusNotModified},
+		{"If-Modified-Since", e.thisUpdate.Add(-time.Second).UTC().Format(http.TimeFormat), http.StatusOK},
+		{"If-Modified-Since", "yesterday", http.StatusOK},
+	} {
+		r := newTestRequest(t, "GET", path, nil)
+		r.Header.Set(tc.header, tc.value)
+		w := httptest.NewRecorder()
+		s.serveOCSP(w, r)
+		if w.Code != tc.expected {
+			t.Fatalf("Unexpected status code for %s: %s: wanted %d, got %d", tc.header, tc.value, tc.expected, w.Code)
+		}
+		if tc.expected == http.StatusNotModified {
+			if w.Body.Len() != 0 {
+				t.Fatalf("304 for %s: %s had a body", tc.header, tc.value)
+			}
+			if w.Header().Get("ETag") != eTag {
+				t.Fatalf("304 for %s: %s didn't include the ETag", tc.header, tc.value)
+			}
+		}
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	r := newTestRequest(t, "GET", path, nil)
+	r.Header.Set("If-None-Match", `"other"`)
+	r.Header.Set("If-Modified-Since", thisUpdate)
+	w := httptest.NewRecorder()
+	s.serveOCSP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code with a mismatched If-None-Match: wanted %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestServeOCSPPost(t *testing.T) {
+	s, e := testResponder(t)
+	request := testRequest(t, e, e.serial)
+
+	r := newTestRequest(t, "POST", "/", bytes.NewReader(request))
+	r.Header.Set("Content-Type", "application/ocsp-request")
+	w := httptest.NewRecorder()
+	s.serveOCSP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code: wanted %d, got %d", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/ocsp-response" {
+		t.Fatalf("Unexpected Content-Type: %s", ct)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(e.response)) {
+		t.Fatalf("Unexpected Content-Length: wanted %d, got %s", len(e.response), cl)
+	}
+	if bytes.Compare(w.Body.Bytes(), e.response) != 0 {
+		t.Fatalf("Responder returned wrong response: wanted %X, got %X", e.response, w.Body.Bytes())
+	}
+
+	r = newTestRequest(t, "POST", "/", bytes.NewReader(request))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	w = httptest.NewRecorder()
+	s.serveOCSP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Unexpected status code for wrong Content-Type: wanted %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	r = newTestRequest(t, "POST", "/", bytes.NewReader(make([]byte, s.maxRequestSize+1)))
+	r.Header.Set("Content-Type", "application/ocsp-request")
+	w = httptest.NewRecorder()
+	s.serveOCSP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Unexpected status code for oversized body: wanted %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	// hide the length so the body limit is hit while reading
+	r = newTestRequest(t, "POST", "/", ioutil.NopCloser(bytes.NewReader(make([]byte, s.maxRequestSize+1))))
+	r.Header.Set("Content-Type", "application/ocsp-request")
+	w = httptest.NewRecorder()
+	s.serveOCSP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Unexpected status code for oversized body without length: wanted %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestServeOCSPMiss(t *testing.T) {
+	s, e := testResponder(t)
+	path := "/" + url.QueryEscape(base64.StdEncoding.EncodeToString(testRequest(t, e, big.NewInt(7))))
+
+	for _, tc := range []struct {
+		behaviour string
+		code      int
+		status    byte
+	}{
+		{"", http.StatusOK, byte(ocsp.Unauthorized)},
+		{"unauthorized", http.StatusOK, byte(ocsp.Unauthorized)},
+		{"try-later", http.StatusOK, byte(ocsp.TryLater)},
+		{"not-found", http.StatusNotFound, 0},
+	} {
+		err := s.initResponder("", 0, tc.behaviour)
+		if err != nil {
+			t.Fatalf("Failed to initialize responder with '%s': %s", tc.behaviour, err)
+		}
+		w := httptest.NewRecorder()
+		s.serveOCSP(w, newTestRequest(t, "GET", path, nil))
+		if w.Code != tc.code {
+			t.Fatalf("Unexpected status code for '%s': wanted %d, got %d", tc.behaviour, tc.code, w.Code)
+		}
+		body := w.Body.Bytes()
+		if tc.code == http.StatusNotFound {
+			if len(body) != 0 {
+				t.Fatalf("Unexpected body for '%s': %X", tc.behaviour, body)
+			}
+			continue
+		}
+		if len(body) != 5 || body[4] != tc.status {
+			t.Fatalf("Unexpected OCSP response status for '%s': wanted %d, got %X", tc.behaviour, tc.status, body)
+		}
+	}
+
+	err := s.initResponder("", 0, "bad")
+	if err == nil {
+		t.Fatal("initResponder didn't fail with invalid cache miss response")
+	}
+}
+
+func TestServeOCSPStale(t *testing.T) {
+	s, e := testResponder(t)
+	clk := s.clk.(clock.FakeClock)
+	clk.Add(time.Hour * 24 * 365)
+	buf := new(bytes.Buffer)
+	s.log.stdout = buf
+	e.nextUpdate = clk.Now().Add(-time.Hour)
+	request := testRequest(t, e, e.serial)
+	path := "/" + url.QueryEscape(base64.StdEncoding.EncodeToString(request))
+	parsed, err := ocsp.ParseRequest(request)
+	if err != nil {
+		t.Fatalf("Failed to parse request: %s", err)
+	}
+
+	for _, tc := range []struct {
+		grace  time.Duration
+		served bool
+	}{
+		{0, true},                 // served until it's replaced
+		{time.Hour * 2, true},     // in grace
+		{time.Minute * 30, false}, // past grace
+	} {
+		s.staleGrace = tc.grace
+		w := httptest.NewRecorder()
+		s.serveOCSP(w, newTestRequest(t, "GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status code with grace %s: wanted %d, got %d", tc.grace, http.StatusOK, w.Code)
+		}
+		if served := bytes.Equal(w.Body.Bytes(), e.response); served != tc.served {
+			t.Fatalf("Stale response with grace %s: wanted served %t, got %t", tc.grace, tc.served, served)
+		}
+		if !tc.served && !bytes.Equal(w.Body.Bytes(), ocsp.UnauthorizedErrorResponse) {
+			t.Fatalf("Unexpected response past grace: %X", w.Body.Bytes())
+		}
+		if _, served := s.Response(parsed); served != tc.served {
+			t.Fatalf("Response with grace %s: wanted served %t, got %t", tc.grace, tc.served, served)
+		}
+	}
+	if n := strings.Count(buf.String(), "Serving stale response for 'test.der'"); n != 1 {
+		t.Fatalf("Serving stale response wasn't logged exactly once, logged %d times: %s", n, buf.String())
+	}
+	if n := strings.Count(buf.String(), "Not serving response for 'test.der'"); n != 1 {
+		t.Fatalf("Refusing stale response wasn't logged exactly once, logged %d times: %s", n, buf.String())
+	}
+}
+
+func TestAdminEntries(t *testing.T) {
+	s, e := testResponder(t)
+	e.status = ocsp.Good
+	e.responders = []string{"http://responder.example.com"}
+
+	request := func(handler http.Handler, remoteAddr, token, query string) *httptest.ResponseRecorder {
+		r := newTestRequest(t, "GET", "/admin/entries"+query, nil)
+		r.RemoteAddr = remoteAddr
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	get := func(remoteAddr, token, query string) *httptest.ResponseRecorder {
+		return request(http.HandlerFunc(s.serveStats), remoteAddr, token, query)
+	}
+
+	// without a token the responder doesn't serve the admin endpoints,
+	// requests from a reverse proxy on the same host look like loopback
+	if w := request(s.responder.Handler, "127.0.0.1:1234", "", ""); w.Code == http.StatusOK {
+		t.Fatal("Responder served admin endpoint without a token")
+	}
+	// and the stats listener only allows loopback requests
+	if w := get("192.0.2.1:1234", "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Unexpected status code for remote request: wanted %d, got %d", http.StatusForbidden, w.Code)
+	}
+	w := get("127.0.0.1:1234", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code for loopback request: wanted %d, got %d", http.StatusOK, w.Code)
+	}
+	var infos []entryInfo
+	err := json.Unmarshal(w.Body.Bytes(), &infos)
+	if err != nil {
+		t.Fatalf("Failed to parse entries: %s", err)
+	}
+	if len(infos) != 1 || infos[0].Name != e.name || infos[0].Serial != "539" || infos[0].Status != "good" {
+		t.Fatalf("Unexpected entries: %s", w.Body.String())
+	}
+	if infos[0].Response != nil {
+		t.Fatal("Response was included without being requested")
+	}
+
+	w = get("[::1]:1234", "", "?responses=true")
+	infos = nil
+	err = json.Unmarshal(w.Body.Bytes(), &infos)
+	if err != nil {
+		t.Fatalf("Failed to parse entries: %s", err)
+	}
+	if len(infos) != 1 || !bytes.Equal(infos[0].Response, e.response) {
+		t.Fatalf("Response wasn't included when requested: %s", w.Body.String())
+	}
+
+	// with a token it's required regardless of where the request is from
+	s.adminToken = "secret"
+	for _, token := range []string{"", "wrong"} {
+		if w := get("127.0.0.1:1234", token, ""); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Unexpected status code with token '%s': wanted %d, got %d", token, http.StatusUnauthorized, w.Code)
+		}
+	}
+	if w := get("192.0.2.1:1234", "secret", ""); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code with correct token: wanted %d, got %d", http.StatusOK, w.Code)
+	}
+	if w := request(s.responder.Handler, "192.0.2.1:1234", "secret", ""); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code from responder with correct token: wanted %d, got %d", http.StatusOK, w.Code)
+	}
+	if w := request(s.responder.Handler, "127.0.0.1:1234", "", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Unexpected status code from responder without token: wanted %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestAdminRefresh(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	srv := testOCSPServer(t, issuer, key, clk)
+	defer srv.Close()
+	s, err := New(Options{log: NewLogger("", "", 10, clk), clk: clk, clientTimeout: time.Second * 5, clientBackoff: time.Second, monitorTick: time.Minute}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create stapled: %s", err)
+	}
+	leaf := testCertificate(t, issuer, key, 1337)
+	leaf.OCSPServer = []string{srv.URL}
+	_, err = s.Staple(leaf, issuer)
+	if err != nil {
+		t.Fatalf("Staple failed: %s", err)
+	}
+	e := s.c.snapshot()[0]
+
+	refresh := func(name string, code int) refreshResult {
+		r := newTestRequest(t, "POST", "/admin/refresh?name="+name, nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		s.serveStats(w, r)
+		if w.Code != code {
+			t.Fatalf("Unexpected status code refreshing '%s': wanted %d, got %d", name, code, w.Code)
+		}
+		var result refreshResult
+		if code != http.StatusNotFound {
+			err := json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				t.Fatalf("Failed to parse refresh result: %s", err)
+			}
+		}
+		return result
+	}
+
+	refresh("unknown", http.StatusNotFound)
+
+	// the response is fresh so wouldn't normally be refreshed
+	clk.Add(time.Minute)
+	result := refresh(e.name, http.StatusOK)
+	if result.Entry == nil || !result.Entry.ThisUpdate.Equal(clk.Now().Add(-time.Hour)) {
+		t.Fatalf("Entry wasn't refreshed: %+v", result)
+	}
+
+	atomic.StoreInt32(&e.refreshing, 1)
+	refresh(e.name, http.StatusConflict)
+	atomic.StoreInt32(&e.refreshing, 0)
+
+	srv.Close()
+	result = refresh(e.name, http.StatusBadGateway)
+	if result.Error == "" {
+		t.Fatal("Failed refresh didn't return an error")
+	}
+}
+
+func TestServeHealth(t *testing.T) {
+	s, e := testResponder(t)
+	e.nextUpdate = s.clk.Now().Add(time.Hour)
+	e.responders = []string{"http://ocsp.example.com"}
+
+	var report healthReport
+	check := func(code int, healthy, total int, unhealthy ...string) {
+		w := httptest.NewRecorder()
+		s.responder.Handler.ServeHTTP(w, newTestRequest(t, "GET", "/health", nil))
+		if w.Code != code {
+			t.Fatalf("Unexpected status code: wanted %d, got %d", code, w.Code)
+		}
+		report = healthReport{}
+		err := json.Unmarshal(w.Body.Bytes(), &report)
+		if err != nil {
+			t.Fatalf("Failed to parse health report: %s", err)
+		}
+		if report.Total != total || report.HealthyEntries != healthy || len(report.Unhealthy) != len(unhealthy) {
+			t.Fatalf("Unexpected health report: %s", w.Body.String())
+		}
+		for i, name := range unhealthy {
+			if report.Unhealthy[i].Name != name {
+				t.Fatalf("Unexpected unhealthy entry: wanted %s, got %s", name, report.Unhealthy[i].Name)
+			}
+		}
+	}
+	check(http.StatusOK, 1, 1)
+
+	failing := &Entry{
+		mu:         new(sync.RWMutex),
+		name:       "failing.der",
+		serial:     big.NewInt(1),
+		issuer:     e.issuer,
+		response:   []byte{5, 0, 1},
+		nextUpdate: s.clk.Now().Add(time.Hour),
+		failures:   2,
+		responders: e.responders,
+	}
+	stale := &Entry{
+		mu:         new(sync.RWMutex),
+		name:       "stale.der",
+		serial:     big.NewInt(2),
+		issuer:     e.issuer,
+		response:   []byte{5, 0, 1},
+		nextUpdate: s.clk.Now().Add(-time.Hour),
+		responders: e.responders,
+	}
+	unconfigured := &Entry{
+		mu:         new(sync.RWMutex),
+		name:       "unconfigured.der",
+		serial:     big.NewInt(3),
+		issuer:     e.issuer,
+		response:   []byte{5, 0, 1},
+		nextUpdate: s.clk.Now().Add(time.Hour),
+	}
+	for _, entry := range []*Entry{failing, stale, unconfigured} {
+		err := s.c.add(entry)
+		if err != nil {
+			t.Fatalf("Failed to add entry to cache: %s", err)
+		}
+	}
+	check(http.StatusServiceUnavailable, 1, 4, "failing.der", "stale.der", "unconfigured.der")
+	if reason := report.Unhealthy[2].Reason; reason != "no responders configured" {
+		t.Fatalf("Unexpected reason for entry without responders: %s", reason)
+	}
+
+	s.dontDieOnStaleResponse = true
+	check(http.StatusOK, 1, 4, "failing.der", "stale.der", "unconfigured.der")
+}
+
+func TestServeReady(t *testing.T) {
+	s, e := testResponder(t)
+	e.responders = []string{"http://ocsp.example.com"}
+
+	var report readinessReport
+	check := func(code int, synced int, pending ...string) {
+		w := httptest.NewRecorder()
+		s.responder.Handler.ServeHTTP(w, newTestRequest(t, "GET", "/ready", nil))
+		if w.Code != code {
+			t.Fatalf("Unexpected status code: wanted %d, got %d", code, w.Code)
+		}
+		report = readinessReport{}
+		err := json.Unmarshal(w.Body.Bytes(), &report)
+		if err != nil {
+			t.Fatalf("Failed to parse readiness report: %s", err)
+		}
+		if report.Synced != synced || strings.Join(report.Pending, " ") != strings.Join(pending, " ") {
+			t.Fatalf("Unexpected readiness report: %s", w.Body.String())
+		}
+	}
+	check(http.StatusServiceUnavailable, 0, e.name)
+
+	unconfigured := &Entry{
+		mu:     new(sync.RWMutex),
+		name:   "unconfigured.der",
+		serial: big.NewInt(3),
+		issuer: e.issuer,
+	}
+	err := s.c.add(unconfigured)
+	if err != nil {
+		t.Fatalf("Failed to add entry to cache: %s", err)
+	}
+	e.mu.Lock()
+	e.synced = true
+	e.mu.Unlock()
+	check(http.StatusOK, 1)
+
+	// once ready, entries added later don't make stapled unready
+	cold := &Entry{
+		mu:         new(sync.RWMutex),
+		name:       "cold.der",
+		serial:     big.NewInt(4),
+		issuer:     e.issuer,
+		responders: e.responders,
+	}
+	err = s.c.add(cold)
+	if err != nil {
+		t.Fatalf("Failed to add entry to cache: %s", err)
+	}
+	check(http.StatusOK, 1, "cold.der")
+}
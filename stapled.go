@@ -1,50 +1,212 @@
 package main
 
 import (
+	"crypto"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmhodges/clock"
+	"golang.org/x/net/context"
 )
 
+// Options are the settings stapled is created with. The client
+// settings are used for every entry, whether it is created from a
+// definition or for a request, see newEntry
+type Options struct {
+	log *Logger
+	clk clock.Clock
+
+	// responder and stats server
+	httpAddr               string
+	statsAddr              string
+	maxRequestSize         int64
+	missBehaviour          string
+	adminToken             string        // bearer token for the admin endpoints, only served on the stats listener to loopback if empty
+	socketPath             string        // Unix domain socket to serve the responder on as well as, or instead of, httpAddr
+	additionalAddrs        []string      // addresses to serve the responder on as well as httpAddr
+	tlsConfig              *tls.Config   // serve the responder over TLS, except on socketPath, if set
+	tlsKeyPair             *keyPair      // certificate served if tlsConfig is set
+	staleGrace             time.Duration // how long past NextUpdate responses are served, until they're replaced if zero
+	dontDieOnStaleResponse bool
+	certFolder             string // directory watched for certificates to add entries for
+
+	// entries
+	clientTimeout      time.Duration
+	clientBackoff      time.Duration
+	clientClockSkew    time.Duration
+	refuseUnknown      bool
+	upstreamResponders []string
+	allowedResponders  []string
+	limiter            *hostLimiter
+	maxResponseSize    int64 // defaultMaxResponseSize if zero
+	minSignatureHash   crypto.Hash
+	expiryWarning      time.Duration
+	expired            expiredPolicy
+	retries            int
+	attemptTimeout     time.Duration
+	cacheFolder        string
+	shardResponses     bool
+	base64Responses    bool
+	store              storage
+	hook               *responseHook
+
+	// cache
+	monitorTick  time.Duration
+	lookupHashes []crypto.Hash
+	maxEntries   int
+	maxRefreshes int
+	duplicates   duplicatePolicy
+}
+
 type stapled struct {
-	log               *Logger
-	clk               clock.Clock
+	Options
+
 	c                 *cache
 	responder         *http.Server
+	statsServer       *http.Server
+	missResponse      []byte
 	certFolderWatcher *dirWatcher
 
-	clientTimeout          time.Duration
-	clientBackoff          time.Duration
-	entryMonitorTick       time.Duration
-	upstreamResponders     []string
-	cacheFolder            string
-	dontDieOnStaleResponse bool
+	// cancelled when stapled is stopped, tells background
+	// goroutines to exit
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+
+	stopOnce sync.Once
+	stopErr  error // returned by every call to Stop
+
+	ready int32 // set once every entry has had a valid response, accessed atomically
 }
 
-func New(log *Logger, clk clock.Clock, httpAddr string, timeout, backoff, monitorTick time.Duration, responders []string, cacheFolder string, dontDieOnStale bool, certFolder string, entries []*Entry) (*stapled, error) {
-	c := newCache(log, monitorTick)
+// defaultMonitorTick is how often the cache checks whether entries need
+// refreshing by default
+const defaultMonitorTick = time.Minute
+
+func New(opts Options, entries []*Entry) (*stapled, error) {
+	// the tick is only how often entries are checked, when they are
+	// actually refreshed is decided by each entry's update window
+	if opts.monitorTick <= 0 {
+		return nil, fmt.Errorf("monitor tick must be greater than zero, got %s", opts.monitorTick)
+	}
+	// refuse to start with stale responses unless told otherwise
+	stale := staleEntries(opts.clk.Now(), entries)
+	if len(stale) > 0 {
+		if !opts.dontDieOnStaleResponse {
+			return nil, fmt.Errorf("entries have missing or stale responses: %s", strings.Join(stale, ", "))
+		}
+		opts.log.Warning("Starting with missing or stale responses for entries: %s", strings.Join(stale, ", "))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &stapled{
-		log:                    log,
-		clk:                    clk,
-		c:                      c,
-		clientTimeout:          timeout,
-		clientBackoff:          backoff,
-		cacheFolder:            cacheFolder,
-		dontDieOnStaleResponse: dontDieOnStale,
-		upstreamResponders:     responders,
-		certFolderWatcher:      newDirWatcher(certFolder),
-	}
-	// add entries to cache
-	for _, e := range entries {
-		c.addMulti(e)
+		Options:           opts,
+		ctx:               ctx,
+		cancel:            cancel,
+		certFolderWatcher: newDirWatcher(opts.certFolder),
 	}
 	// initialize OCSP repsonder
-	s.initResponder(httpAddr, log)
+	err := s.initResponder(opts.httpAddr, opts.maxRequestSize, opts.missBehaviour)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if opts.statsAddr != "" {
+		s.statsServer = &http.Server{
+			Addr:    opts.statsAddr,
+			Handler: http.HandlerFunc(s.serveStats),
+		}
+	}
+	// the cache starts its monitor straight away so it's only created
+	// once nothing else can fail, other than adding the entries
+	s.c = newCache(opts.log, opts.monitorTick, opts.lookupHashes, opts.maxEntries)
+	s.c.setRefreshLimit(opts.maxRefreshes)
+	s.c.setDuplicatePolicy(opts.duplicates)
+	failed := []string{}
+	for _, e := range entries {
+		err := s.c.add(e)
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		s.c.stop()
+		cancel()
+		return nil, fmt.Errorf("failed to add entries to cache: %s", strings.Join(failed, ", "))
+	}
 	return s, nil
 }
 
+// newEntry creates a entry using the client settings in opts, every
+// entry is created this way whether it's for a definition or a request
+func (opts Options) newEntry() *Entry {
+	e := NewEntry(opts.log, opts.clk, opts.clientTimeout, opts.clientBackoff, opts.clientClockSkew)
+	e.refuseUnknown = opts.refuseUnknown
+	e.allowedResponders = opts.allowedResponders
+	e.limiter = opts.limiter
+	if opts.maxResponseSize > 0 {
+		e.maxResponseSize = opts.maxResponseSize
+	}
+	e.minSignatureHash = opts.minSignatureHash
+	e.expiryWarning = opts.expiryWarning
+	e.expired = opts.expired
+	e.retries = opts.retries
+	e.attemptTimeout = opts.attemptTimeout
+	e.shardResponses = opts.shardResponses
+	e.base64Responses = opts.base64Responses
+	e.store = opts.store
+	e.hook = opts.hook
+	return e
+}
+
+// initEntries initializes entries, returning the error from each. If
+// jitter is set the entries are initialized concurrently with the
+// initial fetches for entries without a cached response spread
+// randomly over it, rather than all being sent at once, entries with
+// a cached response are ready straight away
+func initEntries(entries []*Entry, jitter time.Duration) []error {
+	errs := make([]error, len(entries))
+	if jitter <= 0 {
+		for i, e := range entries {
+			errs[i] = e.Init()
+		}
+		return errs
+	}
+	wg := new(sync.WaitGroup)
+	for i, e := range entries {
+		e.startupDelay = time.Duration(e.random().Int63n(int64(jitter)))
+		wg.Add(1)
+		go func(i int, e *Entry) {
+			defer wg.Done()
+			errs[i] = e.Init()
+		}(i, e)
+	}
+	wg.Wait()
+	return errs
+}
+
+// staleEntries returns the names of the entries that don't have
+// a response or whose response has expired, other than those that
+// only check CRLs and so never have one
+func staleEntries(now time.Time, entries []*Entry) []string {
+	stale := []string{}
+	for _, e := range entries {
+		e.mu.RLock()
+		if !e.crlOnly() && (e.response == nil || !e.nextUpdate.After(now)) {
+			stale = append(stale, e.name)
+		}
+		e.mu.RUnlock()
+	}
+	return stale
+}
+
 func (s *stapled) checkCertDirectory() {
 	added, removed, err := s.certFolderWatcher.check()
 	if err != nil {
@@ -54,21 +216,19 @@ func (s *stapled) checkCertDirectory() {
 	}
 	for _, a := range added {
 		// create entry + add to cache
-		e := NewEntry(s.log, s.clk, s.clientTimeout, s.clientBackoff)
-		err = e.loadCertificate(a)
+		e := s.newEntry()
+		err = e.loadCertificate(a, nil)
 		if err != nil {
 			s.log.Err("Failed to load new certificate '%s': %s", a, err)
 			continue
 		}
-		if s.cacheFolder != "" {
-			e.generateResponseFilename(s.cacheFolder)
-		}
+		e.generateResponseFilename(s.cacheFolder)
 		err = e.Init()
 		if err != nil {
 			s.log.Err("Failed to initialize entry for new certificate '%s': %s", a, err)
 			continue
 		}
-		err = s.c.addMulti(e)
+		err = s.c.add(e)
 		if err != nil {
 			s.log.Err("Failed to add entry to cache for new certificate '%s': %s", a, err)
 		}
@@ -78,21 +238,269 @@ func (s *stapled) checkCertDirectory() {
 	}
 }
 
+// transportRotated returns whether the transport e would be given if it
+// were created from def now differs from the one it has, which happens
+// when the client certificate, key, or root CAs files are rotated
+func transportRotated(e *Entry, def CertDefinition, globalProxy string, globalTransport TransportConfig) bool {
+	transport, err := def.transportFrom(sharedTransports, globalProxy, globalTransport)
+	if err != nil {
+		// recreating the entry will surface the error
+		return true
+	}
+	return e.client.Transport != transport
+}
+
+// reloadDefinitions brings the entries created from the configuration
+// in line with a new set of definitions. Entries for new or modified
+// definitions are created, entries whose definitions have been removed
+// are removed, and entries whose definitions haven't changed are left
+// alone so they keep their current response. A definition counts as
+// modified if the global fetcher settings it was used with have changed
+func (s *stapled) reloadDefinitions(defs []CertDefinition, globalUpstream []string, globalProxy string, globalTransport TransportConfig) {
+	current := make(map[string]*Entry)
+	for _, e := range s.c.snapshot() {
+		if e.definition != nil {
+			current[e.name] = e
+		}
+	}
+	globals := fetcherGlobals{globalUpstream, globalProxy, globalTransport}
+	added, updated, removed, unchanged, failed := 0, 0, 0, 0, 0
+	seen := make(map[string]struct{})
+	for _, def := range defs {
+		name := def.entryName()
+		seen[name] = struct{}{}
+		existing, present := current[name]
+		if present && reflect.DeepEqual(*existing.definition, def) && reflect.DeepEqual(existing.globals, globals) &&
+			!transportRotated(existing, def, globalProxy, globalTransport) {
+			unchanged++
+			continue
+		}
+		e := s.newEntry()
+		err := e.FromCertDef(def, globalUpstream, globalProxy, globalTransport, s.cacheFolder)
+		if err != nil {
+			s.log.Err("Failed to populate entry for '%s': %s", name, err)
+			failed++
+			continue
+		}
+		err = e.Init()
+		if err != nil {
+			s.log.Err("Failed to initialize entry for '%s': %s", e.name, err)
+			failed++
+			continue
+		}
+		// a modified entry is swapped for its replacement rather than
+		// removed first so requests for it never miss the cache
+		if present {
+			err = s.c.replace(e)
+		} else {
+			err = s.c.add(e)
+		}
+		if err != nil {
+			s.log.Err("Failed to add entry for '%s' to cache: %s", e.name, err)
+			failed++
+			continue
+		}
+		if present {
+			updated++
+		} else {
+			added++
+		}
+	}
+	for name := range current {
+		if _, present := seen[name]; present {
+			continue
+		}
+		err := s.c.remove(name)
+		if err != nil {
+			s.log.Err("Failed to remove entry for '%s' from cache: %s", name, err)
+			continue
+		}
+		removed++
+	}
+	inUse := make(map[http.RoundTripper]bool)
+	for _, e := range s.c.snapshot() {
+		inUse[e.client.Transport] = true
+	}
+	sharedTransports.prune(inUse)
+	s.log.Info(
+		"Reloaded definitions: %d added, %d updated, %d removed, %d unchanged, %d failed",
+		added,
+		updated,
+		removed,
+		unchanged,
+		failed,
+	)
+}
+
 func (s *stapled) watchCertDirectory() {
+	defer s.workers.Done()
 	ticker := time.NewTicker(time.Second * 15)
-	for _ = range ticker.C {
-		s.checkCertDirectory()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkCertDirectory()
+		}
 	}
 }
 
+// Run starts the OCSP responder and blocks until it exits, it
+// returns nil if the responder was stopped using Stop
 func (s *stapled) Run() error {
 	if s.certFolderWatcher != nil {
 		s.checkCertDirectory()
+		s.workers.Add(1)
 		go s.watchCertDirectory()
 	}
-	err := s.responder.ListenAndServe()
+	if s.statsServer != nil {
+		go func() {
+			err := s.statsServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				s.log.Err("Stats server died: %s", err)
+			}
+		}()
+	}
+	listeners := []net.Listener{}
+	if s.socketPath != "" {
+		l, err := listenUnix(s.socketPath)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	// listen separately from serving so a port that is already in use
+	// is reported clearly
+	tcpListeners, err := listenTCP(s.listenAddrs())
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return err
+	}
+	for _, l := range tcpListeners {
+		if s.tlsConfig != nil {
+			l = tls.NewListener(l, s.tlsConfig)
+		}
+		listeners = append(listeners, l)
+	}
+	return s.serve(listeners)
+}
+
+// serve serves the responder on each of the listeners until they have
+// all exited. If serving on one of them fails the rest are shut down,
+// rather than being left serving after Run has returned, and the error
+// is returned
+func (s *stapled) serve(listeners []net.Listener) error {
+	// the same server is used for every listener so Shutdown stops
+	// all of them
+	died := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			err := s.responder.Serve(l)
+			if err != nil && err != http.ErrServerClosed {
+				err = fmt.Errorf("HTTP server on '%s' died: %s", l.Addr(), err)
+			}
+			died <- err
+		}(l)
+	}
+	var firstErr error
+	for range listeners {
+		err := <-died
+		if err == nil || err == http.ErrServerClosed || firstErr != nil {
+			continue
+		}
+		firstErr = err
+		shutdownErr := s.responder.Shutdown(context.Background())
+		if shutdownErr != nil {
+			s.log.Err("Failed to shutdown HTTP server: %s", shutdownErr)
+		}
+	}
+	return firstErr
+}
+
+// listenAddrs returns the TCP addresses the responder should listen on,
+// if none are configured and there isn't a socket to listen on instead
+// the default HTTP port is used
+func (s *stapled) listenAddrs() []string {
+	addrs := []string{}
+	if s.responder.Addr != "" {
+		addrs = append(addrs, s.responder.Addr)
+	}
+	addrs = append(addrs, s.additionalAddrs...)
+	if len(addrs) == 0 && s.socketPath == "" {
+		addrs = append(addrs, ":http")
+	}
+	return addrs
+}
+
+// listenTCP listens on each of addrs, if any of them fail the rest are
+// closed and the errors for all of the failures are returned
+func listenTCP(addrs []string) ([]net.Listener, error) {
+	listeners := []net.Listener{}
+	problems := []string{}
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("failed to listen on '%s': %s", addr, err))
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	if len(problems) > 0 {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, errors.New(strings.Join(problems, ", "))
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on the Unix domain socket path, removing any socket
+// left behind by a previous instance that wasn't cleanly stopped. The
+// socket is removed when the listener is closed
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket '%s': %s", path, err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on '%s': %s", path, err)
+	}
+	return l, nil
+}
+
+// Stop gracefully shuts down the OCSP responder, waiting for in-flight
+// requests to be answered, and stops the stats server, cache monitor,
+// and certificate directory watcher. It blocks until all of them have
+// exited. It is safe to call more than once, later calls return the
+// same result as the first
+func (s *stapled) Stop() error {
+	s.stopOnce.Do(func() {
+		s.stopErr = s.stop()
+	})
+	return s.stopErr
+}
+
+func (s *stapled) stop() error {
+	s.cancel()
+	if s.statsServer != nil {
+		err := s.statsServer.Shutdown(context.Background())
+		if err != nil {
+			s.log.Err("Failed to shutdown stats server: %s", err)
+		}
+	}
+	err := s.responder.Shutdown(context.Background())
+	s.c.stop()
+	s.workers.Wait()
+	// once the cache has stopped nothing else fires the hook
+	s.hook.stop()
 	if err != nil {
-		return fmt.Errorf("HTTP server died: %s", err)
+		return fmt.Errorf("failed to shutdown HTTP server: %s", err)
 	}
 	return nil
 }
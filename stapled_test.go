@@ -1 +1,749 @@
 package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/context"
+)
+
+func TestStop(t *testing.T) {
+	clk := clock.NewFake()
+	s, err := New(Options{log: NewLogger("", "", 10, clk), clk: clk, httpAddr: "127.0.0.1:0", statsAddr: "127.0.0.1:0", clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: time.Minute}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create stapled: %s", err)
+	}
+	ran := make(chan error, 1)
+	go func() {
+		ran <- s.Run()
+	}()
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop stapled: %s", err)
+	}
+	select {
+	case err = <-ran:
+		if err != nil {
+			t.Fatalf("Run returned an error after being stopped: %s", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Run didn't return after stapled was stopped")
+	}
+	select {
+	case <-s.c.monitorDone:
+	default:
+		t.Fatal("Cache monitor still running after stapled was stopped")
+	}
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("Stopping stapled a second time failed: %s", err)
+	}
+}
+
+// brokenListener is a listener that fails to accept any connections
+type brokenListener struct {
+	net.Listener
+}
+
+func (brokenListener) Accept() (net.Conn, error) {
+	return nil, errors.New("broken")
+}
+
+func TestServeShutsDownOnFailure(t *testing.T) {
+	clk := clock.NewFake()
+	s, err := New(Options{log: NewLogger("", "", 10, clk), clk: clk, httpAddr: "127.0.0.1:0", clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: time.Minute}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create stapled: %s", err)
+	}
+	defer s.Stop()
+	working, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	broken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer broken.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve([]net.Listener{working, brokenListener{broken}})
+	}()
+	select {
+	case err = <-served:
+		if err == nil || !strings.Contains(err.Error(), "broken") {
+			t.Fatalf("Unexpected error from serve: %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("serve didn't return after a listener failed")
+	}
+	conn, err := net.Dial("tcp", working.Addr().String())
+	if err == nil {
+		conn.Close()
+		t.Fatal("Working listener was left serving after serve returned")
+	}
+}
+
+func TestAddressInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+	clk := clock.NewFake()
+	s, err := New(Options{log: NewLogger("", "", 10, clk), clk: clk, httpAddr: l.Addr().String(), clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: time.Minute}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create stapled: %s", err)
+	}
+	err = s.Run()
+	if err == nil || !strings.Contains(err.Error(), "failed to listen on") {
+		t.Fatalf("Run didn't fail clearly when the address was in use: %v", err)
+	}
+	s.Stop()
+}
+
+func TestMultipleAddresses(t *testing.T) {
+	// find a free port on each loopback address
+	addrs := []string{}
+	for _, host := range []string{"127.0.0.1", "[::1]"} {
+		l, err := net.Listen("tcp", host+":0")
+		if err != nil {
+			t.Skipf("Can't listen on %s: %s", host, err)
+		}
+		addrs = append(addrs, l.Addr().String())
+		l.Close()
+	}
+
+	s, _ := testResponder(t)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.responder.Addr = addrs[0]
+	s.additionalAddrs = addrs[1:]
+	ran := make(chan error, 1)
+	go func() {
+		ran <- s.Run()
+	}()
+
+	request := url.QueryEscape(base64.StdEncoding.EncodeToString(testRequest(t, s.c.snapshot()[0], big.NewInt(1337))))
+	for _, addr := range addrs {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			resp, err = http.Get("http://" + addr + "/" + request)
+			if err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		if err != nil {
+			t.Fatalf("Failed to send request to '%s': %s", addr, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status from '%s': %d", addr, resp.StatusCode)
+		}
+	}
+
+	err := s.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop stapled: %s", err)
+	}
+	err = <-ran
+	if err != nil {
+		t.Fatalf("Run returned an error after being stopped: %s", err)
+	}
+	for _, addr := range addrs {
+		if _, err := http.Get("http://" + addr + "/"); err == nil {
+			t.Fatalf("'%s' is still being served after stapled was stopped", addr)
+		}
+	}
+}
+
+func TestMultipleAddressesInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+	clk := clock.NewFake()
+	s, err := New(Options{log: NewLogger("", "", 10, clk), clk: clk, httpAddr: "127.0.0.1:0", clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: time.Minute}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create stapled: %s", err)
+	}
+	s.additionalAddrs = []string{l.Addr().String(), "invalid:address"}
+	err = s.Run()
+	if err == nil {
+		t.Fatal("Run didn't fail when a address was in use")
+	}
+	for _, addr := range s.additionalAddrs {
+		if !strings.Contains(err.Error(), fmt.Sprintf("failed to listen on '%s'", addr)) {
+			t.Fatalf("Error doesn't mention '%s': %s", addr, err)
+		}
+	}
+	s.Stop()
+}
+
+func TestUnixSocket(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stapled")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, "stapled.sock")
+
+	// a socket left behind by a previous instance should be replaced
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %s", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s, _ := testResponder(t)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.socketPath = socketPath
+	ran := make(chan error, 1)
+	go func() {
+		ran <- s.Run()
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+	}
+	path := "http://stapled/" + url.QueryEscape(base64.StdEncoding.EncodeToString(testRequest(t, s.c.snapshot()[0], big.NewInt(1337))))
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get(path)
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err != nil {
+		t.Fatalf("Failed to send request over socket: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to read response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, []byte{5, 0, 1}) {
+		t.Fatalf("Unexpected response over socket: %d %X", resp.StatusCode, body)
+	}
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop stapled: %s", err)
+	}
+	err = <-ran
+	if err != nil {
+		t.Fatalf("Run returned an error after being stopped: %s", err)
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Fatal("Socket wasn't removed when stapled was stopped")
+	}
+}
+
+func TestReloadDefinitions(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	srv := testOCSPServer(t, issuer, key, clk)
+	defer srv.Close()
+
+	tmpDir, err := ioutil.TempDir("", "stapled")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	issuerPath := filepath.Join(tmpDir, "issuer.der")
+	err = ioutil.WriteFile(issuerPath, issuer.Raw, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write issuer: %s", err)
+	}
+	defs := []CertDefinition{}
+	for i, name := range []string{"a", "b", "c"} {
+		certPath := filepath.Join(tmpDir, name+".der")
+		err = ioutil.WriteFile(certPath, testCertificate(t, issuer, key, int64(i+1)).Raw, 0644)
+		if err != nil {
+			t.Fatalf("Failed to write certificate: %s", err)
+		}
+		defs = append(defs, CertDefinition{Certificate: certPath, Issuer: issuerPath, Responders: []string{srv.URL}})
+	}
+
+	s, err := New(Options{log: NewLogger("", "", 10, clk), clk: clk, clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: time.Minute}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create stapled: %s", err)
+	}
+	s.reloadDefinitions(defs[:2], nil, "", TransportConfig{})
+	if s.c.size() != 2 {
+		t.Fatalf("Unexpected number of entries after initial load: wanted 2, got %d", s.c.size())
+	}
+	a, b := s.c.entries[defs[0].Certificate], s.c.entries[defs[1].Certificate]
+
+	// a is unchanged, b is removed, and c is added
+	s.reloadDefinitions([]CertDefinition{defs[0], defs[2]}, nil, "", TransportConfig{})
+	if s.c.size() != 2 {
+		t.Fatalf("Unexpected number of entries after reload: wanted 2, got %d", s.c.size())
+	}
+	if s.c.entries[defs[0].Certificate] != a {
+		t.Fatal("Unchanged entry was replaced during reload")
+	}
+	if _, present := s.c.entries[defs[1].Certificate]; present {
+		t.Fatal("Removed entry still in cache after reload")
+	}
+	// a refresh of the removed entry may still be running, so it has
+	// to be left unlocked
+	unlocked := make(chan struct{})
+	go func() {
+		b.mu.Lock()
+		b.mu.Unlock()
+		close(unlocked)
+	}()
+	select {
+	case <-unlocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Removed entry was left locked")
+	}
+	if _, present := s.c.entries[defs[2].Certificate]; !present {
+		t.Fatal("Added entry not in cache after reload")
+	}
+
+	// modifying a definition replaces the entry
+	defs[0].ResponderSelection = "round-robin"
+	s.reloadDefinitions([]CertDefinition{defs[0], defs[2]}, nil, "", TransportConfig{})
+	if s.c.entries[defs[0].Certificate] == a {
+		t.Fatal("Modified entry wasn't replaced during reload")
+	}
+
+	// changing the global fetcher settings replaces entries as well,
+	// even if duplicates would otherwise be rejected
+	s.c.setDuplicatePolicy(duplicatesReject)
+	before := s.c.entries[defs[2].Certificate]
+	s.reloadDefinitions([]CertDefinition{defs[0], defs[2]}, nil, "", TransportConfig{DialTimeout: "5s"})
+	if s.c.size() != 2 {
+		t.Fatalf("Unexpected number of entries after reload: wanted 2, got %d", s.c.size())
+	}
+	if s.c.entries[defs[2].Certificate] == before {
+		t.Fatal("Entry wasn't replaced when the global transport changed")
+	}
+	for _, e := range s.c.lookupMap {
+		if e == before {
+			t.Fatal("Lookup key left pointing at replaced entry")
+		}
+	}
+}
+
+func TestStaple(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	requests := 0
+	srv := testOCSPServer(t, issuer, key, clk)
+	defer srv.Close()
+	counter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Redirect(w, r, srv.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer counter.Close()
+
+	s, err := New(Options{log: NewLogger("", "", 10, clk), clk: clk, clientTimeout: time.Second * 5, clientBackoff: time.Second, monitorTick: time.Minute}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create stapled: %s", err)
+	}
+	leaf := testCertificate(t, issuer, key, 1337)
+	_, err = s.Staple(leaf, issuer)
+	if err == nil {
+		t.Fatal("Staple didn't fail for certificate without any responders")
+	}
+
+	leaf.OCSPServer = []string{counter.URL}
+	staple, err := s.Staple(leaf, issuer)
+	if err != nil {
+		t.Fatalf("Staple failed: %s", err)
+	}
+	resp, err := ocsp.ParseResponse(staple, issuer)
+	if err != nil {
+		t.Fatalf("Failed to parse staple: %s", err)
+	}
+	if resp.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Fatalf("Staple has wrong serial: wanted %s, got %s", leaf.SerialNumber, resp.SerialNumber)
+	}
+
+	// the second call should be answered from the cache
+	cached, err := s.Staple(leaf, issuer)
+	if err != nil {
+		t.Fatalf("Staple failed for cached certificate: %s", err)
+	}
+	if bytes.Compare(cached, staple) != 0 {
+		t.Fatal("Staple returned a different response for cached certificate")
+	}
+	if requests != 1 {
+		t.Fatalf("Unexpected number of upstream requests: wanted 1, got %d", requests)
+	}
+
+	// a certificate with the same serial from another issuer gets its
+	// own entry rather than replacing the first one
+	otherIssuer, otherKey := testIssuer(t)
+	otherSrv := testOCSPServer(t, otherIssuer, otherKey, clk)
+	defer otherSrv.Close()
+	otherLeaf := testCertificate(t, otherIssuer, otherKey, 1337)
+	otherLeaf.OCSPServer = []string{otherSrv.URL}
+	_, err = s.Staple(otherLeaf, otherIssuer)
+	if err != nil {
+		t.Fatalf("Staple failed for certificate from another issuer: %s", err)
+	}
+	if n := s.c.size(); n != 2 {
+		t.Fatalf("Certificates with the same serial from different issuers share an entry, %d entries", n)
+	}
+	cached, err = s.Staple(leaf, issuer)
+	if err != nil || !bytes.Equal(cached, staple) {
+		t.Fatalf("First certificate's entry was replaced: %v", err)
+	}
+
+	// responses past the stale grace period aren't stapled, a new one
+	// is fetched instead
+	s.staleGrace = time.Minute * 30
+	clk.Add(time.Hour * 2)
+	fresh, err := s.Staple(leaf, issuer)
+	if err != nil {
+		t.Fatalf("Staple failed for certificate with a stale response: %s", err)
+	}
+	if bytes.Equal(fresh, staple) {
+		t.Fatal("Staple returned a response past the stale grace period")
+	}
+	if requests != 2 {
+		t.Fatalf("Unexpected number of upstream requests: wanted 2, got %d", requests)
+	}
+}
+
+func TestStapleWithoutResponse(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	srv := testOCSPServer(t, issuer, key, clk)
+	defer srv.Close()
+	s, err := New(Options{log: NewLogger("", "", 10, clk), clk: clk, clientTimeout: time.Second * 5, clientBackoff: time.Second, monitorTick: time.Minute}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create stapled: %s", err)
+	}
+	leaf := testCertificate(t, issuer, key, 1337)
+	leaf.OCSPServer = []string{srv.URL}
+	nameHash, keyHash, err := hashNameAndPKI(crypto.SHA1.New(), issuer.RawSubject, issuer.RawSubjectPublicKeyInfo)
+	if err != nil {
+		t.Fatalf("Failed to hash issuer: %s", err)
+	}
+	_, name := requestKey(&ocsp.Request{IssuerNameHash: nameHash, IssuerKeyHash: keyHash, SerialNumber: leaf.SerialNumber})
+
+	// an entry that was added but never got a response is fetched
+	// again rather than stapling nothing
+	e := s.newEntry()
+	e.name = name
+	e.serial = leaf.SerialNumber
+	e.issuer = issuer
+	err = s.c.add(e)
+	if err != nil {
+		t.Fatalf("Failed to add entry: %s", err)
+	}
+	staple, err := s.Staple(leaf, issuer)
+	if err != nil {
+		t.Fatalf("Staple failed for entry without a response: %s", err)
+	}
+	if staple == nil {
+		t.Fatal("Staple returned no response for entry without a response")
+	}
+	if current, _ := s.c.get(name); current == e {
+		t.Fatal("Entry without a response wasn't replaced")
+	}
+
+	// entries from definitions are left to the cache to refresh
+	s.c.remove(name)
+	e = s.newEntry()
+	e.name = "definition"
+	e.serial = leaf.SerialNumber
+	e.issuer = issuer
+	err = s.c.add(e)
+	if err != nil {
+		t.Fatalf("Failed to add entry: %s", err)
+	}
+	staple, err = s.Staple(leaf, issuer)
+	if err == nil {
+		t.Fatal("Staple didn't fail for definition entry without a response")
+	}
+	if staple != nil {
+		t.Fatal("Staple returned a response for definition entry without a response")
+	}
+
+	// or with a response past the stale grace period
+	s.staleGrace = time.Minute * 30
+	e.mu.Lock()
+	e.response, e.nextUpdate = []byte{5, 0, 1}, clk.Now().Add(-time.Hour)
+	e.mu.Unlock()
+	staple, err = s.Staple(leaf, issuer)
+	if err == nil || staple != nil {
+		t.Fatal("Staple returned a response past the stale grace period for definition entry")
+	}
+}
+
+func TestNewStaleResponses(t *testing.T) {
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	log := NewLogger("", "", 10, clk)
+	issuer, _ := testIssuer(t)
+	newEntry := func(name string, serial int64) *Entry {
+		e := NewEntry(log, clk, time.Second, time.Second, 0)
+		e.name = name
+		e.issuer = issuer
+		e.serial = big.NewInt(serial)
+		return e
+	}
+	fresh := newEntry("fresh", 1)
+	fresh.response = []byte{5, 0, 1}
+	fresh.nextUpdate = clk.Now().Add(time.Hour)
+	stale := newEntry("stale", 2)
+	stale.response = []byte{5, 0, 1}
+	stale.nextUpdate = clk.Now().Add(-time.Hour)
+	missing := newEntry("missing", 3)
+
+	_, err := New(Options{log: log, clk: clk, clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: time.Minute}, []*Entry{fresh})
+	if err != nil {
+		t.Fatalf("New failed with only fresh responses: %s", err)
+	}
+	for _, e := range []*Entry{stale, missing} {
+		_, err = New(Options{log: log, clk: clk, clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: time.Minute}, []*Entry{fresh, e})
+		if err == nil {
+			t.Fatalf("New didn't fail with %s response", e.name)
+		}
+	}
+	s, err := New(Options{log: log, clk: clk, clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: time.Minute, dontDieOnStaleResponse: true}, []*Entry{fresh, stale, missing})
+	if err != nil {
+		t.Fatalf("New failed with stale responses when told not to: %s", err)
+	}
+	if s.c.size() != 3 {
+		t.Fatalf("Unexpected number of entries: wanted 3, got %d", s.c.size())
+	}
+}
+
+func TestNewAddFailure(t *testing.T) {
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	log := NewLogger("", "", 10, clk)
+	issuer, _ := testIssuer(t)
+	good := NewEntry(log, clk, time.Second, time.Second, 0)
+	good.name = "good"
+	good.issuer = issuer
+	good.serial = big.NewInt(1)
+	// without a issuer the entry's lookup keys can't be computed
+	broken := NewEntry(log, clk, time.Second, time.Second, 0)
+	broken.name = "broken"
+	broken.serial = big.NewInt(2)
+
+	_, err := New(Options{log: log, clk: clk, clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: time.Minute, dontDieOnStaleResponse: true}, []*Entry{good, broken})
+	if err == nil {
+		t.Fatal("New didn't fail when a entry couldn't be added to the cache")
+	}
+	if !strings.Contains(err.Error(), "'broken'") {
+		t.Fatalf("Error doesn't mention the entry that couldn't be added: %s", err)
+	}
+}
+
+func TestNewEntriesRefreshed(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.Default()
+	srv := testOCSPServer(t, issuer, key, clk)
+	defer srv.Close()
+	log := NewLogger("", "", 10, clk)
+	e := NewEntry(log, clk, time.Second, time.Second, 0)
+	e.name = "monitored"
+	e.issuer = issuer
+	e.serial = big.NewInt(1)
+	request, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: e.serial}, issuer, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	e.request = request
+	e.responders = []string{srv.URL}
+
+	// the entry starts without a response so the first tick of the
+	// monitor started by New should fetch one
+	s, err := New(Options{log: log, clk: clk, clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: 10 * time.Millisecond, dontDieOnStaleResponse: true}, []*Entry{e})
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	defer s.c.stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Response() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Entry passed to New wasn't refreshed by the cache monitor")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOptionsNewEntry(t *testing.T) {
+	clk := clock.NewFake()
+	opts := Options{
+		log:             NewLogger("", "", 10, clk),
+		clk:             clk,
+		clientTimeout:   time.Second * 5,
+		clientBackoff:   time.Second,
+		refuseUnknown:   true,
+		retries:         2,
+		shardResponses:  true,
+		base64Responses: true,
+	}
+	e := opts.newEntry()
+	if e.timeout != opts.clientTimeout || !e.refuseUnknown || e.retries != 2 || !e.shardResponses || !e.base64Responses {
+		t.Fatalf("Entry wasn't created with the options' client settings: %+v", e)
+	}
+	if e.maxResponseSize != defaultMaxResponseSize {
+		t.Fatalf("Unexpected max response size without one set: wanted %d, got %d", defaultMaxResponseSize, e.maxResponseSize)
+	}
+	opts.maxResponseSize = 1024
+	if e := opts.newEntry(); e.maxResponseSize != 1024 {
+		t.Fatalf("Unexpected max response size: wanted 1024, got %d", e.maxResponseSize)
+	}
+
+	s, err := New(opts, nil)
+	if err == nil {
+		t.Fatal("New didn't fail without a monitor tick")
+	}
+	opts.monitorTick = time.Minute
+	opts.duplicates = duplicatesReject
+	s, err = New(opts, nil)
+	if err != nil {
+		t.Fatalf("Failed to create stapled: %s", err)
+	}
+	defer s.c.stop()
+	if s.c.duplicates != duplicatesReject {
+		t.Fatal("Cache wasn't created with the options' duplicate policy")
+	}
+}
+
+func TestNewMonitorTick(t *testing.T) {
+	clk := clock.NewFake()
+	log := NewLogger("", "", 10, clk)
+	for _, tick := range []time.Duration{0, -time.Minute} {
+		_, err := New(Options{log: log, clk: clk, clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: tick}, nil)
+		if err == nil {
+			t.Fatalf("New didn't fail with monitor tick %s", tick)
+		}
+	}
+}
+
+func TestNewFailureDoesntLeakMonitor(t *testing.T) {
+	clk := clock.NewFake()
+	log := NewLogger("", "", 10, clk)
+	missing := &Entry{mu: new(sync.RWMutex), name: "missing.der"}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		_, err := New(Options{log: log, clk: clk, missBehaviour: "bad", clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: time.Minute}, nil)
+		if err == nil {
+			t.Fatal("New didn't fail with invalid miss response")
+		}
+		_, err = New(Options{log: log, clk: clk, clientTimeout: time.Second, clientBackoff: time.Second, monitorTick: time.Minute}, []*Entry{missing})
+		if err == nil {
+			t.Fatal("New didn't fail with a missing response")
+		}
+	}
+	// allow for unrelated goroutines starting or stopping
+	if after := runtime.NumGoroutine(); after >= before+20 {
+		t.Fatalf("Failed calls to New leaked goroutines: %d before, %d after", before, after)
+	}
+}
+
+func TestStartupJitter(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.Default()
+	good := testOCSPServer(t, issuer, key, clk)
+	defer good.Close()
+	mu := new(sync.Mutex)
+	fetches := []time.Time{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches = append(fetches, time.Now())
+		mu.Unlock()
+		good.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	tmpDir, err := ioutil.TempDir("", "stapled-jitter")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	newEntry := func(serial int64) *Entry {
+		e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+		e.name = fmt.Sprintf("%d", serial)
+		e.serial = big.NewInt(serial)
+		e.issuer = issuer
+		e.responders = []string{srv.URL}
+		e.generateResponseFilename(tmpDir)
+		return e
+	}
+	// the first entry has a response cached on disk
+	warm := newEntry(1)
+	resp := testResponse(t, issuer, key, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1),
+		ThisUpdate:   clk.Now().Add(-time.Hour),
+		NextUpdate:   clk.Now().Add(time.Hour * 24),
+	}, nil)
+	err = writeFile(warm.responseFilename, resp)
+	if err != nil {
+		t.Fatalf("Failed to write response: %s", err)
+	}
+	entries := []*Entry{warm}
+	for i := int64(2); i < 10; i++ {
+		entries = append(entries, newEntry(i))
+	}
+
+	jitter := 500 * time.Millisecond
+	started := time.Now()
+	for i, err := range initEntries(entries, jitter) {
+		if err != nil {
+			t.Fatalf("Failed to initialize entry %d: %s", i, err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed > jitter+time.Second {
+		t.Fatalf("Entries were initialized one after another, took %s", elapsed)
+	}
+	if len(fetches) != len(entries)-1 {
+		t.Fatalf("Expected %d fetches, got %d", len(entries)-1, len(fetches))
+	}
+	first, last := fetches[0], fetches[0]
+	for _, fetched := range fetches {
+		if fetched.Before(first) {
+			first = fetched
+		}
+		if fetched.After(last) {
+			last = fetched
+		}
+	}
+	if last.Sub(first) < jitter/5 {
+		t.Fatalf("Fetches weren't spread out, all happened within %s", last.Sub(first))
+	}
+}
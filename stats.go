@@ -1,177 +1,390 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
 	"sort"
+	"strings"
 	"sync"
-	"sync/atomic"
-	"time"
+
+	"golang.org/x/crypto/ocsp"
 )
 
-// this entire thing is only really needed if we don't want to
-// use some push framework like StatsD (or i guess there could
-// do both...)
+// Minimal implementations of the Prometheus metric types and text
+// exposition format, enough to expose what's going on inside stapled
+// without pulling in the whole client library
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
 
-type timing struct {
-	interval     time.Duration
-	times        map[int64]time.Duration
-	currentIndex int64
-	mu           *sync.RWMutex
+// formatLabels renders a set of label names and values in the form
+// {name="value",...}
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, names[i], labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
 }
 
-func sumDurations(durs []time.Duration) time.Duration {
-	sum := time.Duration(0)
-	for _, d := range durs {
-		sum += d
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
 	}
-	return sum
+	return fmt.Sprintf("%g", v)
 }
 
-func (t *timing) rate() int64 {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-	return int64(len(t.times))
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
 }
 
-func (t *timing) mean() float64 {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-	times := []time.Duration{}
-	for _, d := range t.times {
-		times = append(times, d)
+// metric is something that can write itself in the text exposition
+// format
+type metric interface {
+	write(w io.Writer)
+}
+
+// counterVec is a set of monotonically increasing counters partitioned
+// by a set of labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	mu     sync.Mutex
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
 	}
-	sum := sumDurations(times)
-	return (sum.Seconds() / 1000) / float64(len(t.times))
 }
 
-type durations []time.Duration
+// inc increments the counter for the provided label values, which must
+// be in the same order as the labels the counter was created with
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\xff")] += v
+}
 
-func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
-func (d durations) Less(i, j int) bool { return i < j }
-func (d durations) Len() int           { return len(d) }
+// value returns the current value of the counter for the provided
+// label values
+func (c *counterVec) value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(labelValues, "\xff")]
+}
 
-func (t *timing) percentile(p float64) float64 {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-	times := durations{}
-	for _, d := range t.times {
-		times = append(times, d)
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	keys := []string{}
+	for k := range c.values {
+		keys = append(keys, k)
 	}
-	sort.Sort(times)
-	index := (p / 100.0) * float64(len(times))
-	percentile := float64(0)
-	i := int(index)
-	if index == float64(int64(index)) {
-		percentile = float64(sumDurations(times[i-1:i+1]).Seconds()/1000) / 2.0
-	} else {
-		percentile = times[i-1].Seconds() / 1000.0
+	sort.Strings(keys)
+	for _, k := range keys {
+		labelValues := []string{}
+		if len(c.labels) > 0 {
+			labelValues = strings.Split(k, "\xff")
+		}
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, labelValues), formatValue(c.values[k]))
 	}
-	return percentile
 }
 
-func (t *timing) remove(index int64) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	delete(t.times, index)
+// histogram counts observations into a set of cumulative buckets
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+	mu      sync.Mutex
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
 }
 
-func (t *timing) add(d time.Duration) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	index := t.currentIndex
-	t.times[index] = d
-	t.currentIndex++
-	go func() {
-		time.Sleep(t.interval)
-		t.remove(index)
-	}()
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
 }
 
-type counter struct {
-	interval time.Duration
-	counter  int64
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
 }
 
-func (c *counter) decrease(v int64) {
-	atomic.AddInt64(&c.counter, -v)
-	go func() {
-		time.Sleep(c.interval)
-		c.increase(v)
-	}()
+// gaugeSample is a single value of a gaugeFunc
+type gaugeSample struct {
+	labelValues []string
+	value       float64
 }
 
-func (c *counter) increase(v int64) {
-	atomic.AddInt64(&c.counter, v)
-	go func() {
-		time.Sleep(c.interval)
-		c.decrease(v)
-	}()
+// gaugeFunc is a gauge whose values are computed when it is collected
+type gaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func() []gaugeSample
 }
 
-func (c *counter) value() int64 {
-	return atomic.LoadInt64(&c.counter)
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, sample := range g.collect() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, sample.labelValues), formatValue(sample.value))
+	}
 }
 
-type stats struct {
-	timings  map[string]*timing
-	tMu      *sync.RWMutex
-	counters map[string]*counter
-	cMu      *sync.RWMutex
-	interval time.Duration
+// counterFunc is a counter whose value is kept elsewhere, such as by
+// the cache, and read when it is collected
+type counterFunc struct {
+	name    string
+	help    string
+	collect func() float64
 }
 
-func newStats(interval time.Duration) *stats {
-	return &stats{
-		timings:  make(map[string]*timing),
-		tMu:      new(sync.RWMutex),
-		counters: make(map[string]*counter),
-		cMu:      new(sync.RWMutex),
-		interval: interval,
-	}
+func (c *counterFunc) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %s\n", c.name, formatValue(c.collect()))
 }
 
-func (s *stats) addTiming(key string, d time.Duration) {
-	s.tMu.RLock()
-	t, present := s.timings[key]
-	if !present {
-		t = &timing{times: make(map[int64]time.Duration), mu: new(sync.RWMutex), interval: s.interval}
-		s.tMu.RUnlock()
-		s.tMu.Lock()
-		s.timings[key] = t
-		s.tMu.Unlock()
-		s.tMu.RLock()
+var (
+	lookupHits = newCounterVec(
+		"stapled_cache_lookup_hits_total",
+		"Number of requests answered from the cache.",
+	)
+	lookupMisses = newCounterVec(
+		"stapled_cache_lookup_misses_total",
+		"Number of requests that didn't match a cache entry.",
+	)
+	fetchResults = newCounterVec(
+		"stapled_fetches_total",
+		"Number of requests sent to upstream responders by result.",
+		"responder",
+		"result",
+	)
+	fetchFailures = newCounterVec(
+		"stapled_fetch_failures_total",
+		"Number of failed requests to upstream responders by class of failure, e.g. dns, tls, http, or parse.",
+		"responder",
+		"class",
+	)
+	throttledFetches = newCounterVec(
+		"stapled_fetches_throttled_total",
+		"Number of requests not sent to upstream responders because their host was rate limited.",
+		"host",
+	)
+	fetchLatency = newHistogram(
+		"stapled_fetch_duration_seconds",
+		"Time taken by upstream responders to answer requests.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	)
+	refreshResults = newCounterVec(
+		"stapled_refreshes_total",
+		"Number of entry refreshes by result.",
+		"result",
+	)
+	responseStatuses = newCounterVec(
+		"stapled_responses_total",
+		"Number of new responses cached by certificate status, good, revoked, or unknown.",
+		"status",
+	)
+	staleResponses = newCounterVec(
+		"stapled_stale_responses_total",
+		"Number of requests for responses past their NextUpdate by whether the response was served or refused.",
+		"result",
+	)
+	certificateExpiryWarnings = newCounterVec(
+		"stapled_certificate_expiry_warnings_total",
+		"Number of warnings logged about entries whose certificate is about to expire.",
+		"entry",
+	)
+
+	// metrics that aren't tied to a specific stapled instance
+	globalMetrics = []metric{lookupHits, lookupMisses, fetchResults, fetchFailures, throttledFetches, fetchLatency, refreshResults, responseStatuses, staleResponses, certificateExpiryWarnings}
+)
+
+type entriesByName []*Entry
+
+func (e entriesByName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e entriesByName) Less(i, j int) bool { return e[i].name < e[j].name }
+func (e entriesByName) Len() int           { return len(e) }
+
+// instanceMetrics returns the metrics that are computed from the
+// current state of the cache
+func (s *stapled) instanceMetrics() []metric {
+	return []metric{
+		&gaugeFunc{
+			name: "stapled_cache_entries",
+			help: "Number of entries in the cache.",
+			collect: func() []gaugeSample {
+				return []gaugeSample{{value: float64(s.c.size())}}
+			},
+		},
+		&counterFunc{
+			name: "stapled_cache_evictions_total",
+			help: "Number of entries evicted from the cache to make room for new ones.",
+			collect: func() float64 {
+				return float64(s.c.evicted())
+			},
+		},
+		&gaugeFunc{
+			name: "stapled_refresh_queue_depth",
+			help: "Number of entries waiting for a free refresh slot.",
+			collect: func() []gaugeSample {
+				return []gaugeSample{{value: float64(s.c.refreshQueueDepth())}}
+			},
+		},
+		&gaugeFunc{
+			name:   "stapled_entry_last_sync_age_seconds",
+			help:   "Time since each entry was last successfully refreshed, omitted for entries that never have been.",
+			labels: []string{"entry", "serial"},
+			collect: func() []gaugeSample {
+				now := s.clk.Now()
+				return s.entrySamples(func(e *Entry) (float64, bool) {
+					// entries that have never been synced have no age
+					if e.lastSync.IsZero() {
+						return 0, false
+					}
+					return now.Sub(e.lastSync).Seconds(), true
+				})
+			},
+		},
+		&gaugeFunc{
+			name:   "stapled_entry_next_update_seconds",
+			help:   "Time until the NextUpdate of each entry's response, negative once it has expired.",
+			labels: []string{"entry", "serial"},
+			collect: func() []gaugeSample {
+				now := s.clk.Now()
+				return s.entrySamples(func(e *Entry) (float64, bool) {
+					if e.response == nil {
+						return 0, false
+					}
+					return e.nextUpdate.Sub(now).Seconds(), true
+				})
+			},
+		},
+		&gaugeFunc{
+			name:   "stapled_entry_status",
+			help:   "Certificate status of each entry's current response, always 1 with the status as a label.",
+			labels: []string{"entry", "serial", "status"},
+			collect: func() []gaugeSample {
+				samples := []gaugeSample{}
+				for _, sample := range s.entrySamples(func(e *Entry) (float64, bool) {
+					return float64(e.status), e.response != nil
+				}) {
+					status := statusToString[int(sample.value)]
+					samples = append(samples, gaugeSample{append(sample.labelValues, status), 1})
+				}
+				return samples
+			},
+		},
+		&gaugeFunc{
+			name:   "stapled_entry_crl_revoked",
+			help:   "Whether the CRL fallback found each entry to be revoked, informational only.",
+			labels: []string{"entry"},
+			collect: func() []gaugeSample {
+				samples := []gaugeSample{}
+				entries := s.c.snapshot()
+				sort.Sort(entriesByName(entries))
+				for _, e := range entries {
+					e.mu.RLock()
+					checked, revoked := !e.crlChecked.IsZero(), e.crlStatus == ocsp.Revoked
+					e.mu.RUnlock()
+					if !checked {
+						continue
+					}
+					value := 0.0
+					if revoked {
+						value = 1
+					}
+					samples = append(samples, gaugeSample{[]string{e.name}, value})
+				}
+				return samples
+			},
+		},
 	}
-	defer s.tMu.RUnlock()
-	t.add(d)
 }
 
-func (s *stats) newCounter(key string) *counter {
-	s.cMu.Lock()
-	defer s.cMu.Unlock()
-	c := &counter{interval: s.interval}
-	s.counters[key] = c
-	return c
+// entrySamples returns a sample, labelled with the entry name and
+// serial, for each entry that value returns true for. value is called
+// with the entry's read lock held, which is released straight after, so
+// collecting metrics doesn't hold up refreshes
+func (s *stapled) entrySamples(value func(e *Entry) (float64, bool)) []gaugeSample {
+	samples := []gaugeSample{}
+	entries := s.c.snapshot()
+	sort.Sort(entriesByName(entries))
+	for _, e := range entries {
+		e.mu.RLock()
+		v, ok := value(e)
+		e.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		serial := ""
+		if e.serial != nil {
+			serial = fmt.Sprintf("%X", e.serial)
+		}
+		samples = append(samples, gaugeSample{[]string{e.name, serial}, v})
+	}
+	return samples
 }
 
-func (s *stats) increase(key string, value int64) {
-	s.cMu.RLock()
-	c, present := s.counters[key]
-	if !present {
-		s.cMu.RUnlock()
-		c = s.newCounter(key)
-		s.cMu.RLock()
+// serveStats handles requests to the stats listener, which serves the
+// metrics and the admin endpoints
+func (s *stapled) serveStats(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		s.serveAdmin(w, r)
+		return
+	}
+	if r.URL.Path != "/metrics" {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
-	defer s.cMu.RUnlock()
-	c.increase(value)
+	s.serveMetrics(w, r)
 }
 
-func (s *stats) decrease(key string, value int64) {
-	s.cMu.RLock()
-	c, present := s.counters[key]
-	if !present {
-		s.cMu.RUnlock()
-		c = s.newCounter(key)
-		s.cMu.RLock()
+// serveMetrics writes all of the metrics in the Prometheus text
+// exposition format
+func (s *stapled) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics := append([]metric{}, globalMetrics...)
+	for _, m := range append(metrics, s.instanceMetrics()...) {
+		m.write(w)
 	}
-	defer s.cMu.RUnlock()
-	c.decrease(value)
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "a", "b")
+	c.inc("x", "y")
+	c.inc("x", "y")
+	c.add(3, "x", "\"z\"")
+	buf := new(bytes.Buffer)
+	c.write(buf)
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{a="x",b="\"z\""} 3
+test_total{a="x",b="y"} 2
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected counter output: wanted\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram("test_seconds", "Test histogram.", []float64{1, 5})
+	h.observe(0.5)
+	h.observe(2)
+	h.observe(10)
+	buf := new(bytes.Buffer)
+	h.write(buf)
+	expected := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="5"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 12.5
+test_seconds_count 3
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected histogram output: wanted\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	s, e := testResponder(t)
+	e.lastSync = s.clk.Now().Add(-time.Minute)
+	hits := lookupHits.value()
+	misses := lookupMisses.value()
+	for _, serial := range []*big.Int{e.serial, big.NewInt(7)} {
+		r := newTestRequest(t, "POST", "/", bytes.NewReader(testRequest(t, e, serial)))
+		r.Header.Set("Content-Type", "application/ocsp-request")
+		s.serveOCSP(httptest.NewRecorder(), r)
+	}
+	if lookupHits.value() != hits+1 {
+		t.Fatalf("Unexpected number of lookup hits: wanted %f, got %f", hits+1, lookupHits.value())
+	}
+	if lookupMisses.value() != misses+1 {
+		t.Fatalf("Unexpected number of lookup misses: wanted %f, got %f", misses+1, lookupMisses.value())
+	}
+
+	w := httptest.NewRecorder()
+	s.serveMetrics(w, newTestRequest(t, "GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, expected := range []string{
+		"stapled_cache_entries 1\n",
+		"# TYPE stapled_cache_evictions_total counter\nstapled_cache_evictions_total 0\n",
+		fmt.Sprintf("stapled_entry_last_sync_age_seconds{entry=\"test.der\",serial=\"%X\"} 60\n", e.serial),
+		fmt.Sprintf("stapled_entry_next_update_seconds{entry=\"test.der\",serial=\"%X\"} %g\n", e.serial, e.nextUpdate.Sub(s.clk.Now()).Seconds()),
+		"# TYPE stapled_cache_lookup_hits_total counter\n",
+		"# TYPE stapled_fetch_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Metrics output doesn't contain '%s':\n%s", expected, body)
+		}
+	}
+
+	// an entry that has never been synced shouldn't report an age
+	e.mu.Lock()
+	e.lastSync = time.Time{}
+	e.mu.Unlock()
+	w = httptest.NewRecorder()
+	s.serveMetrics(w, newTestRequest(t, "GET", "/metrics", nil))
+	if body := w.Body.String(); strings.Contains(body, "stapled_entry_last_sync_age_seconds{") {
+		t.Fatalf("Metrics output contains a sync age for an entry that was never synced:\n%s", body)
+	}
+}
+
+func TestStatusMetrics(t *testing.T) {
+	s, e := testResponder(t)
+	e.log, e.clk = s.log, s.clk
+	e.log.stdout = ioutil.Discard
+	issuer, key := testIssuer(t)
+	metrics := func() string {
+		w := httptest.NewRecorder()
+		s.serveMetrics(w, newTestRequest(t, "GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	for _, status := range []int{ocsp.Good, ocsp.Revoked} {
+		name := statusToString[status]
+		before := responseStatuses.value(name)
+		respBytes := testResponse(t, issuer, key, ocsp.Response{
+			Status:       status,
+			SerialNumber: e.serial,
+			ThisUpdate:   s.clk.Now(),
+			NextUpdate:   s.clk.Now().Add(time.Hour),
+			RevokedAt:    s.clk.Now(),
+		}, nil)
+		resp, err := ocsp.ParseResponse(respBytes, nil)
+		if err != nil {
+			t.Fatalf("Failed to parse response: %s", err)
+		}
+		err = e.updateResponse("", cacheControl{}, resp, respBytes, false)
+		if err != nil {
+			t.Fatalf("Failed to update response: %s", err)
+		}
+		if responseStatuses.value(name) != before+1 {
+			t.Fatalf("New %s response wasn't counted", name)
+		}
+		body := metrics()
+		expected := fmt.Sprintf("stapled_entry_status{entry=\"test.der\",serial=\"%X\",status=\"%s\"} 1\n", e.serial, name)
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Metrics output doesn't contain '%s':\n%s", expected, body)
+		}
+		if strings.Count(body, "stapled_entry_status{") != 1 {
+			t.Fatalf("Metrics output doesn't contain exactly one status for the entry:\n%s", body)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// storage is somewhere responses, and their metadata, can be cached
+// so they survive restarts. Reading something that hasn't been written
+// returns an error that satisfies os.IsNotExist. Stores that support it
+// may forget contents once ttl has passed, a ttl of zero means never
+type storage interface {
+	read(key string) ([]byte, error)
+	write(key string, contents []byte, ttl time.Duration) error
+}
+
+// fileStorage stores each key as a file, keys are paths
+type fileStorage struct{}
+
+func (fileStorage) read(key string) ([]byte, error) {
+	return ioutil.ReadFile(key)
+}
+
+func (fileStorage) write(key string, contents []byte, _ time.Duration) error {
+	// the shard directory may not exist yet
+	err := os.MkdirAll(filepath.Dir(key), 0755)
+	if err != nil {
+		return err
+	}
+	return writeFile(key, contents)
+}
+
+// maxStoredSize is the largest object that will be read from a
+// httpStorage
+const maxStoredSize = 1 << 20
+
+// httpStorage stores each key as an object on a HTTP server, such as
+// a object store shared between multiple stapled instances, using GET
+// and PUT requests to base + key. Requests are sent using transport, the
+// same one used to fetch responses, so they go through the same proxy
+type httpStorage struct {
+	base   string
+	client *http.Client
+}
+
+func newHTTPStorage(base string, timeout time.Duration, transport http.RoundTripper) *httpStorage {
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return &httpStorage{base: base, client: &http.Client{Timeout: timeout, Transport: transport}}
+}
+
+func (h *httpStorage) read(key string) ([]byte, error) {
+	resp, err := h.client.Get(h.base + key)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got a non-200 response for '%s': %d", key, resp.StatusCode)
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxStoredSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) > maxStoredSize {
+		return nil, fmt.Errorf("'%s' is larger than %d bytes", key, maxStoredSize)
+	}
+	return contents, nil
+}
+
+func (h *httpStorage) write(key string, contents []byte, _ time.Duration) error {
+	req, err := http.NewRequest("PUT", h.base+key, bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got a non-2xx response writing '%s': %d", key, resp.StatusCode)
+	}
+	return nil
+}
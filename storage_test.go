@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/context"
+)
+
+// testObjectStore starts a HTTP server that stores the bodies of PUT
+// requests and returns them for GET requests to the same path
+func testObjectStore() (*httptest.Server, map[string][]byte) {
+	objects := make(map[string][]byte)
+	mu := new(sync.Mutex)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "GET":
+			contents, present := objects[r.URL.Path]
+			if !present {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(contents)
+		case "PUT":
+			contents, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			objects[r.URL.Path] = contents
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	return srv, objects
+}
+
+func TestHTTPStorage(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	srv, objects := testObjectStore()
+	defer srv.Close()
+	store := newHTTPStorage(srv.URL+"/ocsp", time.Second, nil)
+
+	newEntry := func(name string) *Entry {
+		e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+		e.name = name
+		e.issuer = issuer
+		e.serial = big.NewInt(1337)
+		e.store = store
+		e.generateResponseFilename("")
+		return e
+	}
+	respBytes := testResponse(t, issuer, key, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1337),
+		ThisUpdate:   clk.Now().Add(-time.Hour),
+		NextUpdate:   clk.Now().Add(time.Hour),
+	}, nil)
+	resp, err := ocsp.ParseResponse(respBytes, issuer)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %s", err)
+	}
+
+	a := newEntry("a/cert.der")
+	_, keyHash, err := hashNameAndPKI(crypto.SHA1.New(), issuer.RawSubject, issuer.RawSubjectPublicKeyInfo)
+	if err != nil {
+		t.Fatalf("Failed to hash issuer: %s", err)
+	}
+	if !strings.HasPrefix(a.responseFilename, fmt.Sprintf("%X-539", keyHash)) {
+		t.Fatalf("Unexpected storage key: %s", a.responseFilename)
+	}
+	err = a.updateResponse("abc", cacheControl{}, resp, respBytes, true)
+	if err != nil {
+		t.Fatalf("Failed to update response: %s", err)
+	}
+	if !bytes.Equal(objects["/ocsp/"+a.responseFilename], respBytes) {
+		t.Fatal("Response wasn't written to the store")
+	}
+
+	// another instance with a differently named certificate should
+	// find the same response
+	b := newEntry("b/other.der")
+	err = b.readFromDisk()
+	if err != nil {
+		t.Fatalf("Failed to read response from the store: %s", err)
+	}
+	if !bytes.Equal(b.response, respBytes) || b.eTag != "abc" {
+		t.Fatal("Response and metadata weren't read from the store")
+	}
+
+	_, err = store.read("missing")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Unexpected error reading missing key: %v", err)
+	}
+}
+
+// blockingStorage is a storage whose writes block until release is
+// closed, recording the contents written under each key
+type blockingStorage struct {
+	started chan struct{}
+	release chan struct{}
+	mu      sync.Mutex
+	written map[string][]byte
+}
+
+func (b *blockingStorage) read(key string) ([]byte, error) {
+	return nil, os.ErrNotExist
+}
+
+func (b *blockingStorage) write(key string, contents []byte, _ time.Duration) error {
+	select {
+	case b.started <- struct{}{}:
+	default:
+	}
+	<-b.release
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.written[key] = contents
+	return nil
+}
+
+// failingStorage is a storage whose writes always fail
+type failingStorage struct{}
+
+func (failingStorage) read(key string) ([]byte, error) {
+	return nil, os.ErrNotExist
+}
+
+func (failingStorage) write(key string, contents []byte, _ time.Duration) error {
+	return fmt.Errorf("store is broken")
+}
+
+func TestRefreshWriteFailure(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	srv := testOCSPServer(t, issuer, key, clk)
+	defer srv.Close()
+
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second*5, time.Minute, 0)
+	e.name = "unwritable"
+	e.issuer = issuer
+	e.serial = big.NewInt(1337)
+	request, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: e.serial}, issuer, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	e.request = request
+	e.client = new(http.Client)
+	e.responders = []string{srv.URL}
+	e.store = failingStorage{}
+	e.responseFilename = "unwritable"
+
+	failures := refreshResults.value("failure")
+	successes := refreshResults.value("success")
+	err = e.refreshResponse(context.Background())
+	if err == nil {
+		t.Fatal("refreshResponse didn't fail when the response couldn't be written")
+	}
+	if refreshResults.value("failure") != failures+1 {
+		t.Fatal("Failed write wasn't counted as a failed refresh")
+	}
+	if refreshResults.value("success") != successes {
+		t.Fatal("Failed write was counted as a successful refresh")
+	}
+	if e.failures != 1 || !e.backingOff() {
+		t.Fatalf("Entry isn't backing off after a failed write, failures: %d", e.failures)
+	}
+	// the fetched response is still served from memory
+	if e.response == nil {
+		t.Fatal("Fetched response wasn't kept after a failed write")
+	}
+}
+
+func TestStoreWriteDoesntHoldLock(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	store := &blockingStorage{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+		written: make(map[string][]byte),
+	}
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	e.name = "example"
+	e.serial = big.NewInt(1337)
+	e.store = store
+	e.responseFilename = "example"
+	respBytes := testResponse(t, issuer, key, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1337),
+		ThisUpdate:   clk.Now(),
+		NextUpdate:   clk.Now().Add(time.Hour),
+	}, nil)
+	resp, err := ocsp.ParseResponse(respBytes, issuer)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %s", err)
+	}
+
+	updated := make(chan error)
+	go func() {
+		updated <- e.updateResponse("", cacheControl{}, resp, respBytes, true)
+	}()
+	<-store.started
+	// the response should be servable while the write is in progress
+	locked := make(chan struct{})
+	go func() {
+		e.mu.RLock()
+		e.mu.RUnlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Entry lock was held while writing to the store")
+	}
+	if !bytes.Equal(e.response, respBytes) {
+		t.Fatal("Response wasn't updated before writing it to the store")
+	}
+	close(store.release)
+	err = <-updated
+	if err != nil {
+		t.Fatalf("Failed to update response: %s", err)
+	}
+	if !bytes.Equal(store.written["example"], respBytes) {
+		t.Fatal("Response wasn't written to the store")
+	}
+
+	// a snapshot taken before one that has already been written is
+	// skipped rather than overwriting it
+	e.mu.Lock()
+	older, err := e.snapshotWrite(true)
+	if err != nil {
+		t.Fatalf("Failed to snapshot entry: %s", err)
+	}
+	e.response = []byte("newer")
+	newer, err := e.snapshotWrite(true)
+	e.mu.Unlock()
+	if err != nil {
+		t.Fatalf("Failed to snapshot entry: %s", err)
+	}
+	for _, w := range []*pendingWrite{newer, older} {
+		err = e.writeSnapshot(w)
+		if err != nil {
+			t.Fatalf("Failed to write snapshot: %s", err)
+		}
+	}
+	if string(store.written["example"]) != "newer" {
+		t.Fatal("Older snapshot overwrote a newer one")
+	}
+}
+
+// fakeRedis is a Redis server that only understands GET and SET
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	values   map[string][]byte
+	ttls     map[string]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	f := &fakeRedis{listener: l, values: make(map[string][]byte), ttls: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		return strings.TrimSuffix(line, "\r\n"), err
+	}
+	for {
+		line, err := readLine()
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimPrefix(line, "*"))
+		args := make([]string, n)
+		for i := range args {
+			line, err = readLine()
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimPrefix(line, "$"))
+			arg := make([]byte, size+2)
+			if _, err = io.ReadFull(r, arg); err != nil {
+				return
+			}
+			args[i] = string(arg[:size])
+		}
+		f.mu.Lock()
+		switch args[0] {
+		case "GET":
+			if value, present := f.values[args[1]]; present {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		case "SET":
+			f.values[args[1]] = []byte(args[2])
+			if len(args) == 5 {
+				f.ttls[args[1]] = args[4]
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		f.mu.Unlock()
+	}
+}
+
+func TestRedisStorage(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.listener.Close()
+	store := newRedisStorage(f.listener.Addr().String(), time.Second)
+
+	err := store.write("a", []byte("hello\r\nworld"), 90*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to write: %s", err)
+	}
+	if f.ttls["a"] != "90000" {
+		t.Fatalf("Unexpected TTL: %q", f.ttls["a"])
+	}
+	value, err := store.read("a")
+	if err != nil {
+		t.Fatalf("Failed to read: %s", err)
+	}
+	if string(value) != "hello\r\nworld" {
+		t.Fatalf("Unexpected value: %q", value)
+	}
+	_, err = store.read("b")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Unexpected error reading missing key: %v", err)
+	}
+	_, err = store.do([]byte("DEL"), []byte("a"))
+	if _, isReply := err.(redisError); !isReply {
+		t.Fatalf("Expected a error reply, got: %v", err)
+	}
+	if store.conn == nil {
+		t.Fatal("Connection was dropped after a error reply")
+	}
+
+	// when the server goes away commands should fail rather than
+	// hang, and succeed again once it's back
+	store.conn.Close()
+	_, err = store.read("a")
+	if err == nil {
+		t.Fatal("Read succeeded with a closed connection")
+	}
+	value, err = store.read("a")
+	if err != nil {
+		t.Fatalf("Failed to read after reconnecting: %s", err)
+	}
+	if string(value) != "hello\r\nworld" {
+		t.Fatalf("Unexpected value after reconnecting: %q", value)
+	}
+}
+
+func TestRedisStorageUnresponsive(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	// a server that accepts connections but never replies
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+	e.name = "example"
+	e.serial = big.NewInt(1337)
+	e.store = newRedisStorage(l.Addr().String(), 500*time.Millisecond)
+	e.responseFilename = "example"
+	respBytes := testResponse(t, issuer, key, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1337),
+		ThisUpdate:   clk.Now(),
+		NextUpdate:   clk.Now().Add(time.Hour),
+	}, nil)
+	resp, err := ocsp.ParseResponse(respBytes, issuer)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %s", err)
+	}
+
+	updated := make(chan error)
+	go func() {
+		updated <- e.updateResponse("", cacheControl{}, resp, respBytes, true)
+	}()
+	// the new response should be servable while the write is waiting
+	// on the server
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		e.mu.RLock()
+		current := e.response
+		e.mu.RUnlock()
+		if bytes.Equal(current, respBytes) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Response wasn't updated while writing to Redis")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err = <-updated:
+		t.Fatalf("Write to Redis finished before timing out: %v", err)
+	default:
+	}
+	err = <-updated
+	if err == nil {
+		t.Fatal("Write to an unresponsive Redis server succeeded")
+	}
+}
+
+func TestRefreshFromSharedStore(t *testing.T) {
+	issuer, key := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	f := newFakeRedis(t)
+	defer f.listener.Close()
+	store := newRedisStorage(f.listener.Addr().String(), time.Second)
+	fetches := 0
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer responder.Close()
+
+	newEntry := func(name string) *Entry {
+		e := NewEntry(NewLogger("", "", 10, clk), clk, time.Second, time.Second, 0)
+		e.name = name
+		e.issuer = issuer
+		e.serial = big.NewInt(1337)
+		e.responders = []string{responder.URL}
+		e.store = store
+		e.generateResponseFilename("")
+		return e
+	}
+	makeResponse := func(thisUpdate time.Time) (*ocsp.Response, []byte) {
+		respBytes := testResponse(t, issuer, key, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(1337),
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   thisUpdate.Add(48 * time.Hour),
+		}, nil)
+		resp, err := ocsp.ParseResponse(respBytes, issuer)
+		if err != nil {
+			t.Fatalf("Failed to parse response: %s", err)
+		}
+		return resp, respBytes
+	}
+
+	// b has a response that has expired while a has already written
+	// a fresh one to the shared store
+	b := newEntry("b")
+	oldResp, oldBytes := makeResponse(clk.Now().Add(-49 * time.Hour))
+	b.updateResponse("", cacheControl{}, oldResp, oldBytes, false)
+	a := newEntry("a")
+	newResp, newBytes := makeResponse(clk.Now())
+	err := a.updateResponse("", cacheControl{}, newResp, newBytes, true)
+	if err != nil {
+		t.Fatalf("Failed to update response: %s", err)
+	}
+	if f.ttls[a.responseFilename] != "172800000" {
+		t.Fatalf("Response wasn't stored until it expires: %q", f.ttls[a.responseFilename])
+	}
+
+	err = b.refreshResponse(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to refresh: %s", err)
+	}
+	if fetches != 0 {
+		t.Fatalf("Responder was asked for a response %d times", fetches)
+	}
+	if !bytes.Equal(b.response, newBytes) {
+		t.Fatal("Response wasn't loaded from the shared store")
+	}
+
+	// if the store is unreachable the entry falls back to asking
+	// the responder itself
+	f.listener.Close()
+	store.conn.Close()
+	clk.Add(49 * time.Hour)
+	b.refreshResponse(context.Background())
+	if fetches != 1 {
+		t.Fatalf("Responder was asked for a response %d times, expected 1", fetches)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+)
+
+// tlsVersions maps the configurable minimum TLS versions to their
+// crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuites maps the configurable cipher suite names to their
+// crypto/tls constants. They only apply to TLS 1.2 and earlier, the
+// TLS 1.3 suites aren't configurable in crypto/tls
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// keyPair holds the certificate the responder serves over TLS so that
+// it can be replaced without restarting
+type keyPair struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// load replaces the current certificate with the one read from
+// certFile and keyFile, the current certificate is kept if they
+// can't be loaded
+func (k *keyPair) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %s", err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cert = &cert
+	return nil
+}
+
+func (k *keyPair) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.cert, nil
+}
+
+// newClientTLSConfig builds the configuration used to talk to responders
+// over TLS, nil if tc doesn't change Go's defaults
+func newClientTLSConfig(tc TransportConfig) (*tls.Config, error) {
+	if tc.ClientCertificate == "" && tc.ClientKey == "" && tc.RootCAs == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if tc.ClientCertificate != "" || tc.ClientKey != "" {
+		if tc.ClientCertificate == "" || tc.ClientKey == "" {
+			return nil, fmt.Errorf("both client-certificate and client-key must be provided")
+		}
+		cert, err := tls.LoadX509KeyPair(tc.ClientCertificate, tc.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	// this only affects the TLS connection to responders, responses
+	// are still verified against the entry's issuer
+	if tc.RootCAs != "" {
+		roots, err := ReadCertificates(tc.RootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read root-cas: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		for _, root := range roots {
+			config.RootCAs.AddCert(root)
+		}
+	}
+	return config, nil
+}
+
+// newTLSConfig builds the configuration used to serve the responder
+// over TLS, the certificate is served from the returned keyPair
+func newTLSConfig(rt ResponderTLS) (*tls.Config, *keyPair, error) {
+	if rt.Certificate == "" || rt.Key == "" {
+		return nil, nil, fmt.Errorf("both certificate and key must be provided")
+	}
+	kp := &keyPair{}
+	err := kp.load(rt.Certificate, rt.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: kp.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if rt.MinVersion != "" {
+		version, present := tlsVersions[rt.MinVersion]
+		if !present {
+			return nil, nil, fmt.Errorf("invalid min-version '%s', must be 1.0, 1.1, 1.2, or 1.3", rt.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	for _, name := range rt.CipherSuites {
+		suite, present := cipherSuites[name]
+		if !present {
+			return nil, nil, fmt.Errorf("unsupported cipher suite '%s'", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, suite)
+	}
+	return config, kp, nil
+}
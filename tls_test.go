@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// writeTestKeyPair writes a self-signed certificate for 127.0.0.1, and
+// its key, to certFile and keyFile
+func writeTestKeyPair(t *testing.T, serial int64, certFile, keyFile string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "stapled test responder"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %s", err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write certificate: %s", err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write key: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %s", err)
+	}
+	return cert
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stapled-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	certFile, keyFile := filepath.Join(tmpDir, "cert.pem"), filepath.Join(tmpDir, "key.pem")
+	writeTestKeyPair(t, 1, certFile, keyFile)
+
+	config, _, err := newTLSConfig(ResponderTLS{
+		Certificate:  certFile,
+		Key:          keyFile,
+		MinVersion:   "1.1",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create TLS config: %s", err)
+	}
+	if config.MinVersion != tls.VersionTLS11 {
+		t.Fatalf("Unexpected minimum version: %d", config.MinVersion)
+	}
+	if len(config.CipherSuites) != 1 || config.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("Unexpected cipher suites: %v", config.CipherSuites)
+	}
+
+	for version, expected := range map[string]uint16{"": tls.VersionTLS12, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13} {
+		config, _, err := newTLSConfig(ResponderTLS{Certificate: certFile, Key: keyFile, MinVersion: version})
+		if err != nil {
+			t.Fatalf("Failed to create TLS config with min-version '%s': %s", version, err)
+		}
+		if config.MinVersion != expected {
+			t.Fatalf("Unexpected minimum version for min-version '%s': wanted %d, got %d", version, expected, config.MinVersion)
+		}
+	}
+
+	for _, rt := range []ResponderTLS{
+		{Certificate: certFile},
+		{Certificate: certFile, Key: filepath.Join(tmpDir, "missing.pem")},
+		{Certificate: certFile, Key: keyFile, MinVersion: "1.5"},
+		{Certificate: certFile, Key: keyFile, CipherSuites: []string{"TLS_NOT_A_SUITE"}},
+	} {
+		if _, _, err := newTLSConfig(rt); err == nil {
+			t.Fatalf("newTLSConfig didn't fail for %#v", rt)
+		}
+	}
+}
+
+func TestTLSResponder(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stapled-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	certFile, keyFile := filepath.Join(tmpDir, "cert.pem"), filepath.Join(tmpDir, "key.pem")
+	first := writeTestKeyPair(t, 1, certFile, keyFile)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	s, _ := testResponder(t)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.responder.Addr = addr
+	s.tlsConfig, s.tlsKeyPair, err = newTLSConfig(ResponderTLS{Certificate: certFile, Key: keyFile})
+	if err != nil {
+		t.Fatalf("Failed to create TLS config: %s", err)
+	}
+	ran := make(chan error, 1)
+	go func() {
+		ran <- s.Run()
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(first)
+	get := func() *http.Response {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			resp, err = client.Get("https://" + addr + "/")
+			if err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		if err != nil {
+			t.Fatalf("Failed to send request over TLS: %s", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := get(); resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 1 {
+		t.Fatalf("Unexpected certificate served: %X", resp.TLS.PeerCertificates[0].SerialNumber)
+	}
+
+	// reloading picks up a replaced certificate for new connections
+	roots.AddCert(writeTestKeyPair(t, 2, certFile, keyFile))
+	err = s.tlsKeyPair.load(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to reload certificate: %s", err)
+	}
+	if resp := get(); resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Fatalf("Reloaded certificate wasn't served: %X", resp.TLS.PeerCertificates[0].SerialNumber)
+	}
+	// a broken replacement doesn't replace the current certificate
+	err = s.tlsKeyPair.load(certFile, filepath.Join(tmpDir, "missing.pem"))
+	if err == nil {
+		t.Fatal("Loading a missing key didn't fail")
+	}
+	if resp := get(); resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Fatal("Certificate was replaced by a failed reload")
+	}
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop stapled: %s", err)
+	}
+	if err = <-ran; err != nil {
+		t.Fatalf("Run returned an error after being stopped: %s", err)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stapled-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	certFile, keyFile := filepath.Join(tmpDir, "client.pem"), filepath.Join(tmpDir, "client.key")
+	client := writeTestKeyPair(t, 7, certFile, keyFile)
+	otherCert, otherKey := filepath.Join(tmpDir, "other.pem"), filepath.Join(tmpDir, "other.key")
+	writeTestKeyPair(t, 8, otherCert, otherKey)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || !r.TLS.PeerCertificates[0].Equal(client) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("authenticated"))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	rootsFile := filepath.Join(tmpDir, "roots.pem")
+	err = ioutil.WriteFile(rootsFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write roots: %s", err)
+	}
+
+	get := func(tc TransportConfig) error {
+		tc.RootCAs = rootsFile
+		transport, err := newTransport(tc, "")
+		if err != nil {
+			t.Fatalf("Failed to create transport: %s", err)
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("got status %d", resp.StatusCode)
+		}
+		return nil
+	}
+	err = get(TransportConfig{ClientCertificate: certFile, ClientKey: keyFile})
+	if err != nil {
+		t.Fatalf("Request with client certificate failed: %s", err)
+	}
+	if get(TransportConfig{}) == nil {
+		t.Fatal("Request without client certificate succeeded")
+	}
+
+	// per-definition settings replace the global pair as a whole
+	merged := TransportConfig{ClientCertificate: otherCert, ClientKey: otherKey}.merge(TransportConfig{ClientCertificate: certFile, ClientKey: keyFile})
+	if merged.ClientCertificate != certFile || merged.ClientKey != keyFile {
+		t.Fatalf("Unexpected merged client certificate: %+v", merged)
+	}
+
+	for _, tc := range []TransportConfig{
+		{ClientCertificate: certFile},
+		{ClientKey: keyFile},
+		{ClientCertificate: certFile, ClientKey: otherKey},
+		{ClientCertificate: filepath.Join(tmpDir, "missing.pem"), ClientKey: keyFile},
+	} {
+		if _, err := newTransport(tc, ""); err == nil {
+			t.Fatalf("newTransport didn't fail with invalid client certificate configuration %+v", tc)
+		}
+	}
+}
+
+func TestRootCAs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stapled-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// the test server's certificate is signed by a CA the system
+	// doesn't trust
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("response"))
+	}))
+	defer srv.Close()
+	other := writeTestKeyPair(t, 1, filepath.Join(tmpDir, "other.pem"), filepath.Join(tmpDir, "other.key"))
+	rootsFile := filepath.Join(tmpDir, "roots.pem")
+	bundle := append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})...,
+	)
+	err = ioutil.WriteFile(rootsFile, bundle, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write roots: %s", err)
+	}
+
+	get := func(tc TransportConfig) error {
+		transport, err := newTransport(tc, "")
+		if err != nil {
+			t.Fatalf("Failed to create transport: %s", err)
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if get(TransportConfig{}) == nil {
+		t.Fatal("Request to responder using a private CA succeeded with the system roots")
+	}
+	err = get(TransportConfig{RootCAs: rootsFile})
+	if err != nil {
+		t.Fatalf("Request to responder using a private CA failed with custom roots: %s", err)
+	}
+	if get(TransportConfig{RootCAs: filepath.Join(tmpDir, "other.pem")}) == nil {
+		t.Fatal("Request succeeded with roots that don't include the responder's CA")
+	}
+
+	if merged := (TransportConfig{RootCAs: "global.pem"}).merge(TransportConfig{RootCAs: rootsFile}); merged.RootCAs != rootsFile {
+		t.Fatalf("Per-definition root-cas didn't override the global setting: %s", merged.RootCAs)
+	}
+	if _, err := newTransport(TransportConfig{RootCAs: filepath.Join(tmpDir, "missing.pem")}, ""); err == nil {
+		t.Fatal("newTransport didn't fail with missing root-cas")
+	}
+}
+
+func TestTransportPoolRotation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "stapled-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("response"))
+	}))
+	defer srv.Close()
+	other := writeTestKeyPair(t, 1, filepath.Join(tmpDir, "other.pem"), filepath.Join(tmpDir, "other.key"))
+	rootsFile := filepath.Join(tmpDir, "roots.pem")
+	writeRoots := func(root *x509.Certificate) {
+		err := ioutil.WriteFile(rootsFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write roots: %s", err)
+		}
+	}
+	writeRoots(other)
+
+	pool := newTransportPool()
+	tc := TransportConfig{RootCAs: rootsFile}
+	before, err := pool.get(tc, "")
+	if err != nil {
+		t.Fatalf("Failed to get transport: %s", err)
+	}
+	again, err := pool.get(tc, "")
+	if err != nil {
+		t.Fatalf("Failed to get transport: %s", err)
+	}
+	if again != before {
+		t.Fatal("Pool didn't reuse the transport for unchanged files")
+	}
+
+	// rotating the roots should give a new transport that uses them
+	writeRoots(srv.Certificate())
+	after, err := pool.get(tc, "")
+	if err != nil {
+		t.Fatalf("Failed to get transport: %s", err)
+	}
+	if after == before {
+		t.Fatal("Pool reused the transport after the roots file was rotated")
+	}
+	resp, err := (&http.Client{Transport: after}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Request using the rotated roots failed: %s", err)
+	}
+	resp.Body.Close()
+	if len(pool.transports) != 1 {
+		t.Fatalf("Pool kept %d transports, expected 1", len(pool.transports))
+	}
+
+	pool.prune(map[http.RoundTripper]bool{after: true})
+	if len(pool.transports) != 1 {
+		t.Fatal("Pool pruned a transport that is in use")
+	}
+	pool.prune(nil)
+	if len(pool.transports) != 0 {
+		t.Fatal("Pool didn't prune a transport that isn't in use")
+	}
+}
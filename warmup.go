@@ -0,0 +1,137 @@
+// Warming the cache from a peer instance at start up, so a new instance
+// in a rolling deploy doesn't have to fetch every response from the CA.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultWarmupTimeout is how long fetching the responses from a peer
+// can take if warmup.timeout isn't set
+const defaultWarmupTimeout = 10 * time.Second
+
+// maxPeerEntriesSize is the largest admin entries body that will be read
+// from a peer
+const maxPeerEntriesSize = 256 << 20
+
+// checkPeer checks that peer is an absolute URL and, since token grants
+// access to the peer's admin endpoints, that it uses https if a token
+// is set
+func checkPeer(peer, token string) error {
+	u, err := url.Parse(peer)
+	if err != nil {
+		return fmt.Errorf("failed to parse peer: %s", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("peer '%s' isn't an absolute URL", peer)
+	}
+	if token != "" && u.Scheme != "https" {
+		return fmt.Errorf("peer '%s' must use https to be sent a token", peer)
+	}
+	return nil
+}
+
+// fetchPeerResponses fetches the responses held by the stapled instance
+// whose responder is at peer using its admin entries endpoint, keyed by
+// serial. token is sent as a bearer token if it is set, peers without a
+// admin token only serve the endpoint over the loopback interface
+func fetchPeerResponses(client *http.Client, peer, token string) (map[string][][]byte, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(peer, "/")+"/admin/entries?responses=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	var infos []entryInfo
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxPeerEntriesSize)).Decode(&infos)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse entries: %s", err)
+	}
+	responses := make(map[string][][]byte)
+	for _, info := range infos {
+		if info.Response != nil {
+			responses[info.Serial] = append(responses[info.Serial], info.Response)
+		}
+	}
+	return responses, nil
+}
+
+// warmFromPeer gives each of the entries the responses the peer has for
+// certificates with the same serial, which Init uses instead of fetching
+// from the responders if one of them verifies. If the peer can't be
+// reached within timeout the entries are initialized as usual. Requests
+// to the peer are made using transport
+func warmFromPeer(log *Logger, transport http.RoundTripper, peer, token string, timeout time.Duration, entries []*Entry) {
+	responses, err := fetchPeerResponses(&http.Client{Timeout: timeout, Transport: transport}, peer, token)
+	if err != nil {
+		log.Warning("Failed to fetch responses from peer '%s', fetching them from responders instead: %s", peer, err)
+		return
+	}
+	matched := 0
+	for _, e := range entries {
+		if e.serial == nil || e.useNonce {
+			continue
+		}
+		e.peerResponses = responses[fmt.Sprintf("%X", e.serial)]
+		if e.peerResponses != nil {
+			matched++
+		}
+	}
+	log.Info("Fetched %d responses from peer '%s', %d of %d entries have one", len(responses), peer, matched, len(entries))
+}
+
+// usePeerResponse caches the first of the responses pulled from a peer
+// that verifies against the entry's certificate and issuer, returning
+// whether there was one. The responses are only considered once
+func (e *Entry) usePeerResponse() bool {
+	responses := e.peerResponses
+	e.peerResponses = nil
+	for _, respBytes := range responses {
+		err := e.adoptPeerResponse(respBytes)
+		if err != nil {
+			e.warning("Ignoring response from peer: %s", err)
+			continue
+		}
+		e.info("Using response from peer")
+		return true
+	}
+	return false
+}
+
+// adoptPeerResponse verifies a response pulled from a peer and caches
+// it, as if it had been fetched from a responder
+func (e *Entry) adoptPeerResponse(respBytes []byte) error {
+	if e.issuer == nil {
+		return errors.New("the issuer is needed to verify responses from a peer")
+	}
+	resp, err := e.parseResponse(respBytes)
+	if err != nil {
+		return err
+	}
+	err = e.verifyResponse(resp, respBytes)
+	if err != nil {
+		return err
+	}
+	err = e.updateResponse("", cacheControl{}, resp, respBytes, true)
+	if err != nil {
+		e.err("Failed to write response from peer: %s", err)
+	}
+	return nil
+}
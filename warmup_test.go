@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestWarmFromPeer(t *testing.T) {
+	issuer, key := testIssuer(t)
+	otherIssuer, otherKey := testIssuer(t)
+	clk := clock.NewFake()
+	clk.Add(time.Hour * 24 * 365)
+	response := func(issuer *x509.Certificate, key crypto.Signer, serial int64) []byte {
+		return testResponse(t, issuer, key, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(serial),
+			ThisUpdate:   clk.Now().Add(-time.Hour),
+			NextUpdate:   clk.Now().Add(time.Hour),
+		}, nil)
+	}
+	infos := []entryInfo{
+		{Name: "good.der", Serial: "1", Response: response(issuer, key, 1)},
+		{Name: "forged.der", Serial: "2", Response: response(otherIssuer, otherKey, 2)},
+		{Name: "no-response.der", Serial: "3"},
+	}
+	peer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/entries" || r.URL.Query().Get("responses") != "true" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, err := json.Marshal(infos)
+		if err != nil {
+			t.Fatalf("Failed to marshal entries: %s", err)
+		}
+		w.Write(body)
+	}))
+	transport := peer.Client().Transport
+	defer peer.Close()
+
+	log := NewLogger("", "", 10, clk)
+	log.stdout = ioutil.Discard
+	newEntry := func(serial int64) *Entry {
+		e := NewEntry(log, clk, time.Second, time.Second, 0)
+		e.issuer = issuer
+		e.serial = big.NewInt(serial)
+		return e
+	}
+	good, forged, missing := newEntry(1), newEntry(2), newEntry(3)
+	entries := []*Entry{good, forged, missing}
+
+	warmFromPeer(log, transport, peer.URL, "wrong", time.Second, entries)
+	for _, e := range entries {
+		if e.peerResponses != nil {
+			t.Fatal("Entry was given responses from a peer that rejected the request")
+		}
+	}
+
+	warmFromPeer(log, transport, peer.URL+"/", "secret", time.Second, entries)
+	if good.peerResponses == nil || forged.peerResponses == nil || missing.peerResponses != nil {
+		t.Fatal("Responses from peer weren't matched to entries by serial")
+	}
+	// none of the entries have responders, so the only response they
+	// can get is the one from the peer and without it Init fails
+	err := good.Init()
+	if err != nil {
+		t.Fatalf("Failed to initialize entry: %s", err)
+	}
+	for _, e := range []*Entry{forged, missing} {
+		if e.Init() == nil {
+			t.Fatal("Entry without a response from the peer or responders was initialized")
+		}
+	}
+	if good.response == nil {
+		t.Fatal("Entry didn't use the response from the peer")
+	}
+	if forged.response != nil {
+		t.Fatal("Entry used a response from the peer that wasn't signed by its issuer")
+	}
+	if good.peerResponses != nil || forged.peerResponses != nil {
+		t.Fatal("Responses from the peer were kept after Init")
+	}
+
+	peer.Close()
+	unreachable := newEntry(1)
+	warmFromPeer(log, transport, peer.URL, "secret", time.Second, []*Entry{unreachable})
+	if unreachable.peerResponses != nil {
+		t.Fatal("Entry was given responses from an unreachable peer")
+	}
+}
+
+func TestCheckPeer(t *testing.T) {
+	for _, tc := range []struct {
+		peer, token string
+		valid       bool
+	}{
+		{"https://peer.example.com", "secret", true},
+		{"http://peer.example.com", "", true},
+		{"http://peer.example.com", "secret", false},
+		{"peer.example.com", "", false},
+		{"://peer.example.com", "", false},
+	} {
+		err := checkPeer(tc.peer, tc.token)
+		if tc.valid && err != nil {
+			t.Fatalf("Peer '%s' with token '%s' was rejected: %s", tc.peer, tc.token, err)
+		}
+		if !tc.valid && err == nil {
+			t.Fatalf("Peer '%s' with token '%s' was accepted", tc.peer, tc.token)
+		}
+	}
+}